@@ -1,13 +1,20 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/replicatedcom/harpoon/importer"
 	"github.com/replicatedcom/harpoon/log"
+	"github.com/replicatedcom/harpoon/params"
 	"github.com/replicatedcom/harpoon/remote"
 
+	"github.com/pkg/errors"
 	"github.com/urfave/cli"
+	"golang.org/x/crypto/ssh/terminal"
 )
 
 func main() {
@@ -19,6 +26,18 @@ func main() {
 			Value: "english",
 			Usage: "language for the greeting",
 		},
+		cli.StringFlag{
+			Name:        "docker-endpoint",
+			Value:       params.DefaultDockerEndpoint,
+			Usage:       "docker endpoint to load images into",
+			Destination: &params.Get().DockerEndpoint,
+		},
+		cli.StringFlag{
+			Name:        "docker-cert-path",
+			Value:       params.DefaultDockerCertPath(),
+			Usage:       "directory with cert.pem, key.pem and ca.pem for a TLS docker endpoint",
+			Destination: &params.Get().DockerCertPath,
+		},
 	}
 
 	app.Name = "harpoon"
@@ -31,8 +50,83 @@ func main() {
 			Flags: []cli.Flag{
 				cli.StringFlag{Name: "proxy"},
 				cli.BoolFlag{Name: "no-load"},
+				cli.StringFlag{
+					Name:  "output, o",
+					Usage: "with --no-load, write the image to this path, gzipped if it ends in .gz or .tgz",
+				},
+				cli.StringFlag{
+					Name:  "format",
+					Value: "docker-archive",
+					Usage: "with --no-load, write the image as docker-archive (docker save), oci (OCI image layout directory) or oci-archive",
+				},
 				cli.BoolFlag{Name: "force-v1"},
-				cli.StringFlag{Name: "token"},
+				cli.StringFlag{
+					Name:  "username",
+					Usage: "username to authenticate to the registry with, instead of the docker credentials",
+				},
+				cli.StringFlag{
+					Name:  "password",
+					Usage: "password to authenticate to the registry with",
+				},
+				cli.StringSliceFlag{
+					Name:  "pull-secret",
+					Usage: "Kubernetes .dockerconfigjson file to look up registry credentials in, can be repeated",
+				},
+				cli.StringFlag{
+					Name:  "refresh-token-file",
+					Value: remote.DefaultRefreshTokenFile(),
+					Usage: "file to keep the OAuth2 refresh tokens of registries in between pulls, empty to not keep them",
+				},
+				cli.StringFlag{
+					Name:  "token",
+					Usage: "bearer token, or OAuth2 identity/refresh token, to authenticate to the registry with",
+				},
+				cli.StringSliceFlag{
+					Name:  "insecure-registry",
+					Usage: "host[:port] or CIDR of a registry that may be reached over http, or over https without verifying its certificate, can be repeated",
+				},
+				cli.StringSliceFlag{
+					Name:  "registry-mirror",
+					Usage: "[<registry>=]<endpoint> of a mirror to pull manifests and blobs from before the registry, Docker Hub when no registry is given, can be repeated",
+				},
+				cli.StringFlag{
+					Name:        "registry-certs-dir",
+					Value:       params.DefaultDockerCertsDir,
+					Usage:       "directory with a <host>[:<port>] directory of CA bundles (*.crt) and client certificates (*.cert, *.key) per registry",
+					Destination: &params.Get().DockerCertsDir,
+				},
+				cli.IntFlag{
+					Name:  "max-concurrent-downloads",
+					Value: importer.DefaultMaxConcurrentDownloads,
+					Usage: "maximum number of layers to download in parallel",
+				},
+				cli.IntFlag{
+					Name:  "max-attempts",
+					Value: remote.DefaultMaxAttempts,
+					Usage: "number of times a request is sent when the registry is unreachable or returns a transient error",
+				},
+				cli.BoolFlag{
+					Name:  "no-cache",
+					Usage: "do not read blobs from or add blobs to the blob cache",
+				},
+				cli.StringFlag{
+					Name:  "cache-dir",
+					Value: importer.DefaultBlobCacheDir(),
+					Usage: "location of the blob cache",
+				},
+				cli.Int64Flag{
+					Name:  "cache-size",
+					Value: importer.DefaultBlobCacheSize,
+					Usage: "size limit of the blob cache in bytes, least recently used blobs are evicted past it",
+				},
+				cli.StringFlag{
+					Name:  "platform",
+					Usage: "pull the image for this platform (os/arch[/variant]) from a multi-arch image, defaults to the host platform",
+				},
+				cli.BoolFlag{
+					Name:  "quiet, q",
+					Usage: "do not report the progress of the pull",
+				},
 			},
 		},
 	}
@@ -43,14 +137,99 @@ func main() {
 func handlerPull(c *cli.Context) error {
 	log.Debugf("Pulling image %q", c.Args()[0])
 
-	dockerRemote, err := remote.ParseDockerURI(c.Args()[0])
+	dockerRemote, err := remote.ParseImageURI(c.Args()[0])
+	if err != nil {
+		log.Debugf("%v", err)
+		return err
+	}
+
+	// Interrupting the pull cancels the requests in progress, and the workspace is removed
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	dockerRemote.Retry.MaxAttempts = c.Int("max-attempts")
+
+	if err := remote.ValidateInsecureRegistries(c.StringSlice("insecure-registry")); err != nil {
+		log.Debugf("%v", err)
+		return err
+	}
+	dockerRemote.InsecureRegistries = c.StringSlice("insecure-registry")
+
+	mirrors, err := remote.ParseRegistryMirrors(c.StringSlice("registry-mirror"))
+	if err != nil {
+		log.Debugf("%v", err)
+		return err
+	}
+	dockerRemote.Mirrors = remote.MirrorsFor(mirrors, dockerRemote.Hostname)
+
+	// Without --username or --token, credentials are looked up in the pull secrets and the docker config
+	dockerRemote.Username = c.String("username")
+	dockerRemote.Password = c.String("password")
+	dockerRemote.PullSecrets = c.StringSlice("pull-secret")
+	dockerRemote.RefreshTokenFile = c.String("refresh-token-file")
+	dockerRemote.Token = c.String("token")
+
+	if c.Bool("force-v1") {
+		dockerRemote.PreferredProto = "v1"
+	}
+
+	if err := dockerRemote.InitClient(); err != nil {
+		log.Debugf("%v", err)
+		return err
+	}
+
+	i := &importer.Importer{
+		Remote:                 dockerRemote,
+		Platform:               c.String("platform"),
+		MaxConcurrentDownloads: c.Int("max-concurrent-downloads"),
+	}
+
+	// Progress goes to stderr, stdout has the path of the saved image with --no-load
+	if !c.Bool("quiet") {
+		printer := newProgressPrinter(os.Stderr, terminal.IsTerminal(int(os.Stderr.Fd())))
+		defer printer.Close()
+		i.Progress = printer.Handle
+	}
+
+	if !c.Bool("no-cache") {
+		i.Cache, err = importer.NewBlobCache(c.String("cache-dir"), c.Int64("cache-size"))
+		if err != nil {
+			log.Debugf("%v", err)
+			return err
+		}
+	}
+
+	if c.Bool("no-load") {
+		var path string
+		switch c.String("format") {
+		case "docker-archive":
+			path, err = i.SaveFromRemote(ctx, c.String("output"))
+		case "oci":
+			path, err = i.SaveOCILayout(ctx, c.String("output"))
+		case "oci-archive":
+			path, err = i.SaveOCIArchive(ctx, c.String("output"))
+		default:
+			err = errors.Errorf("unsupported output format %q", c.String("format"))
+		}
+		if err != nil {
+			log.Debugf("%v", err)
+			return err
+		}
+		fmt.Println(path)
+		return nil
+	}
+
+	if c.String("output") != "" || c.IsSet("format") {
+		return errors.New("--output and --format require --no-load")
+	}
+
+	i.Loader, err = importer.NewDockerLoaderFromParams()
 	if err != nil {
 		log.Debugf("%v", err)
 		return err
 	}
 
-	// TODO: Tell it to use force v1 if needed
-	if err := importer.ImportFromRemote(dockerRemote); err != nil {
+	if err := i.ImportFromRemote(ctx); err != nil {
 		log.Debugf("%v", err)
 		return err
 	}
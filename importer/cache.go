@@ -0,0 +1,607 @@
+package importer
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/replicatedcom/harpoon/log"
+
+	"github.com/docker/docker/layer"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+const (
+	// DefaultBlobCacheSize is the size limit of the blob cache in bytes
+	DefaultBlobCacheSize = 10 << 30
+
+	cacheBlobFileName   = "blob"
+	cacheDiffIDFileName = "diffid"
+	cacheTempDirName    = "tmp"
+	cachePartialDirName = "partial"
+	partialLockSuffix   = ".lock"
+
+	// partialBlobMaxAge is how long unfinished downloads are kept for a later pull to resume
+	partialBlobMaxAge = 7 * 24 * time.Hour
+)
+
+// BlobCache is an on-disk cache of compressed blobs keyed by digest, shared across pulls.  Each
+// entry is a directory holding the blob and, when it is known, the diff ID of its contents.
+// The least recently used entries are evicted once the cache grows past MaxSize.  Unfinished
+// downloads are kept in the cache too, so that later pulls resume them, and count towards MaxSize.
+// Processes that share the cache dir lock the unfinished downloads they write.
+type BlobCache struct {
+	Dir string
+
+	// MaxSize is the size limit in bytes.  Zero means no limit.
+	MaxSize int64
+
+	mu sync.Mutex
+
+	partialsMu sync.Mutex
+	partials   map[digest.Digest]*sync.Mutex
+}
+
+// DefaultBlobCacheDir returns the cache location in the user's cache directory
+func DefaultBlobCacheDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		dir = os.TempDir()
+	}
+	return filepath.Join(dir, "harpoon", "blobs")
+}
+
+// NewBlobCache creates the cache directory if it does not exist yet
+func NewBlobCache(dir string, maxSize int64) (*BlobCache, error) {
+	if err := os.MkdirAll(filepath.Join(dir, cacheTempDirName), 0755); err != nil {
+		return nil, errors.Wrapf(err, "failed to create cache dir %s", dir)
+	}
+
+	cache := &BlobCache{Dir: dir, MaxSize: maxSize}
+	cache.prunePartials()
+	return cache, nil
+}
+
+func (c *BlobCache) entryDir(dgst digest.Digest) string {
+	return filepath.Join(c.Dir, dgst.Algorithm().String(), dgst.Hex())
+}
+
+// Get returns the path of the cached blob, and its diff ID if one was recorded
+func (c *BlobCache) Get(dgst digest.Digest) (string, layer.DiffID, bool) {
+	if err := dgst.Validate(); err != nil {
+		return "", layer.DiffID(""), false
+	}
+
+	blobPath := filepath.Join(c.entryDir(dgst), cacheBlobFileName)
+	if _, err := os.Stat(blobPath); err != nil {
+		return "", layer.DiffID(""), false
+	}
+
+	// The modification time records the last use, for eviction
+	now := time.Now()
+	if err := os.Chtimes(blobPath, now, now); err != nil {
+		log.Debugf("Failed to update access time of cached blob %s: %v", dgst, err)
+	}
+
+	diffID, err := ioutil.ReadFile(filepath.Join(c.entryDir(dgst), cacheDiffIDFileName))
+	if err != nil {
+		return blobPath, layer.DiffID(""), true
+	}
+
+	return blobPath, layer.DiffID(strings.TrimSpace(string(diffID))), true
+}
+
+// Open returns a reader for the cached blob and its size.  The digest of the blob is verified as
+// it is read, so it is only read once.  When the blob does not match, the last read fails with
+// errInvalidCachedBlob, and the blob is removed, so that it is downloaded again.
+func (c *BlobCache) Open(dgst digest.Digest) (io.ReadCloser, int64, bool) {
+	blobPath, _, ok := c.Get(dgst)
+	if !ok {
+		return nil, 0, false
+	}
+
+	file, err := os.Open(blobPath)
+	if err != nil {
+		return nil, 0, false
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, 0, false
+	}
+
+	return &verifyingCacheReader{File: file, cache: c, digest: dgst, verifier: dgst.Verifier()}, info.Size(), true
+}
+
+// errInvalidCachedBlob is returned by the readers of Open for blobs that do not match their digest
+var errInvalidCachedBlob = errors.New("cached blob does not match its digest")
+
+// verifyingCacheReader verifies a cached blob against its digest as it is read
+type verifyingCacheReader struct {
+	*os.File
+	cache    *BlobCache
+	digest   digest.Digest
+	verifier digest.Verifier
+}
+
+func (r *verifyingCacheReader) Read(p []byte) (int, error) {
+	n, err := r.File.Read(p)
+	r.verifier.Write(p[:n])
+
+	if err == io.EOF && !r.verifier.Verified() {
+		log.Infof("Cached blob %s is invalid, removing it", r.digest)
+		if err := r.cache.Remove(r.digest); err != nil {
+			log.Infof("Failed to remove cached blob %s: %v", r.digest, err)
+		}
+		return n, errors.Wrapf(errInvalidCachedBlob, "blob %s", r.digest)
+	}
+	return n, err
+}
+
+// PartialPath returns the file an unfinished download of the blob is kept in.  Downloads of the
+// blob must hold LockPartial while they use it.
+func (c *BlobCache) PartialPath(dgst digest.Digest) (string, error) {
+	if err := dgst.Validate(); err != nil {
+		return "", err
+	}
+
+	dir := filepath.Join(c.Dir, cachePartialDirName, dgst.Algorithm().String())
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", errors.Wrap(err, "failed to create partial downloads dir")
+	}
+	return filepath.Join(dir, dgst.Hex()), nil
+}
+
+// LockPartial waits for other downloads of the blob, in this process and in other processes that
+// share the cache dir, and returns the function to release the partial file
+func (c *BlobCache) LockPartial(dgst digest.Digest) func() {
+	lock := c.partialMutex(dgst)
+	lock.Lock()
+
+	file, err := c.lockPartialFile(dgst, true)
+	if err != nil {
+		log.Infof("Failed to lock partial download of %s for other processes: %v", dgst, err)
+		return lock.Unlock
+	}
+
+	return func() {
+		unlockPartialFile(file)
+		lock.Unlock()
+	}
+}
+
+// tryLockPartial locks the partial file of the blob when no download holds it
+func (c *BlobCache) tryLockPartial(dgst digest.Digest) (func(), bool) {
+	lock := c.partialMutex(dgst)
+	if !lock.TryLock() {
+		return nil, false
+	}
+
+	file, err := c.lockPartialFile(dgst, false)
+	if err != nil || file == nil {
+		lock.Unlock()
+		return nil, false
+	}
+
+	return func() {
+		unlockPartialFile(file)
+		lock.Unlock()
+	}, true
+}
+
+// partialMutex returns the mutex of the partial file of the blob, for the downloads of this process
+func (c *BlobCache) partialMutex(dgst digest.Digest) *sync.Mutex {
+	c.partialsMu.Lock()
+	defer c.partialsMu.Unlock()
+
+	if c.partials == nil {
+		c.partials = map[digest.Digest]*sync.Mutex{}
+	}
+	lock, ok := c.partials[dgst]
+	if !ok {
+		lock = &sync.Mutex{}
+		c.partials[dgst] = lock
+	}
+	return lock
+}
+
+// lockPartialFile locks the lock file next to the partial file of the blob, for the processes that
+// share the cache dir.  Without block, it returns nil when another download holds the lock.
+func (c *BlobCache) lockPartialFile(dgst digest.Digest, block bool) (*os.File, error) {
+	partialPath, err := c.PartialPath(dgst)
+	if err != nil {
+		return nil, err
+	}
+	lockPath := partialPath + partialLockSuffix
+
+	for {
+		file, err := os.OpenFile(lockPath, os.O_CREATE|os.O_RDWR, 0644)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to open lock file")
+		}
+
+		locked, err := lockFile(file, block)
+		if err != nil || !locked {
+			file.Close()
+			return nil, err
+		}
+
+		// The download that held the lock may have removed the lock file, which then locks nothing
+		info, err := file.Stat()
+		if err != nil {
+			file.Close()
+			return nil, errors.Wrap(err, "failed to stat lock file")
+		}
+		if pathInfo, err := os.Stat(lockPath); err == nil && os.SameFile(info, pathInfo) {
+			return file, nil
+		}
+		file.Close()
+	}
+}
+
+// unlockPartialFile releases the lock file, and removes it when there is no partial file left
+func unlockPartialFile(file *os.File) {
+	if _, err := os.Stat(strings.TrimSuffix(file.Name(), partialLockSuffix)); os.IsNotExist(err) {
+		os.Remove(file.Name())
+	}
+	file.Close()
+}
+
+// listPartials returns the partial files in the cache, as entries
+func (c *BlobCache) listPartials() []blobCacheEntry {
+	var entries []blobCacheEntry
+	filepath.Walk(filepath.Join(c.Dir, cachePartialDirName), func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || strings.HasSuffix(path, partialLockSuffix) {
+			return nil
+		}
+
+		dgst := digest.NewDigestFromHex(filepath.Base(filepath.Dir(path)), info.Name())
+		if dgst.Validate() != nil {
+			return nil
+		}
+		entries = append(entries, blobCacheEntry{
+			digest:   dgst,
+			dir:      path,
+			size:     info.Size(),
+			lastUsed: info.ModTime(),
+			partial:  true,
+		})
+		return nil
+	})
+	return entries
+}
+
+// removePartial removes the partial file of the blob, unless a download holds it
+func (c *BlobCache) removePartial(dgst digest.Digest) bool {
+	unlock, ok := c.tryLockPartial(dgst)
+	if !ok {
+		return false
+	}
+	defer unlock()
+
+	partialPath, err := c.PartialPath(dgst)
+	if err != nil {
+		return false
+	}
+	return os.Remove(partialPath) == nil
+}
+
+// prunePartials removes the unfinished downloads that no pull resumed for partialBlobMaxAge, and
+// the lock files that a download left behind without a partial file
+func (c *BlobCache) prunePartials() {
+	for _, entry := range c.listPartials() {
+		if time.Since(entry.lastUsed) > partialBlobMaxAge {
+			log.Debugf("Removing stale partial download %s", entry.dir)
+			c.removePartial(entry.digest)
+		}
+	}
+
+	lockPaths, _ := filepath.Glob(filepath.Join(c.Dir, cachePartialDirName, "*", "*"+partialLockSuffix))
+	for _, lockPath := range lockPaths {
+		dgst := digest.NewDigestFromHex(filepath.Base(filepath.Dir(lockPath)), strings.TrimSuffix(filepath.Base(lockPath), partialLockSuffix))
+		if _, err := os.Stat(strings.TrimSuffix(lockPath, partialLockSuffix)); os.IsNotExist(err) && dgst.Validate() == nil {
+			// Releasing the lock removes the lock file, as there is no partial file
+			if unlock, ok := c.tryLockPartial(dgst); ok {
+				unlock()
+			}
+		}
+	}
+}
+
+// Remove drops the blob from the cache, for example after it failed verification
+func (c *BlobCache) Remove(dgst digest.Digest) error {
+	if err := dgst.Validate(); err != nil {
+		return err
+	}
+	return os.RemoveAll(c.entryDir(dgst))
+}
+
+// Add copies the blob at blobPath into the cache.  The digest is verified while copying.
+func (c *BlobCache) Add(dgst digest.Digest, blobPath string, diffID layer.DiffID) error {
+	src, err := os.Open(blobPath)
+	if err != nil {
+		return errors.Wrapf(err, "failed to open blob %s", blobPath)
+	}
+	defer src.Close()
+
+	writer, err := c.Writer(dgst)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(writer, src); err != nil {
+		writer.Cancel()
+		return errors.Wrapf(err, "failed to copy blob %s to cache", dgst)
+	}
+
+	return writer.Commit(diffID)
+}
+
+// Writer returns a writer that adds a blob to the cache once Commit verifies its digest
+func (c *BlobCache) Writer(dgst digest.Digest) (*BlobCacheWriter, error) {
+	if err := dgst.Validate(); err != nil {
+		return nil, err
+	}
+
+	file, err := ioutil.TempFile(filepath.Join(c.Dir, cacheTempDirName), "blob")
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create cache file")
+	}
+
+	return &BlobCacheWriter{
+		cache:    c,
+		digest:   dgst,
+		file:     file,
+		digester: dgst.Algorithm().Digester(),
+	}, nil
+}
+
+// add moves the verified blob at tempPath into its entry and evicts old entries
+func (c *BlobCache) add(dgst digest.Digest, tempPath string, diffID layer.DiffID) error {
+	entryTempDir, err := ioutil.TempDir(filepath.Join(c.Dir, cacheTempDirName), "entry")
+	if err != nil {
+		return errors.Wrap(err, "failed to create cache entry")
+	}
+	defer os.RemoveAll(entryTempDir)
+
+	if err := os.Rename(tempPath, filepath.Join(entryTempDir, cacheBlobFileName)); err != nil {
+		return errors.Wrap(err, "failed to move blob to cache entry")
+	}
+
+	if diffID != "" {
+		if err := ioutil.WriteFile(filepath.Join(entryTempDir, cacheDiffIDFileName), []byte(diffID), 0644); err != nil {
+			return errors.Wrap(err, "failed to write diff id to cache entry")
+		}
+	}
+
+	entryDir := c.entryDir(dgst)
+	if err := os.MkdirAll(filepath.Dir(entryDir), 0755); err != nil {
+		return errors.Wrap(err, "failed to create cache dir")
+	}
+
+	if err := os.Rename(entryTempDir, entryDir); err != nil {
+		// Another pull may have cached the same blob first
+		if _, statErr := os.Stat(entryDir); statErr == nil {
+			return nil
+		}
+		return errors.Wrap(err, "failed to move cache entry")
+	}
+
+	log.Debugf("Cached blob %s", dgst)
+
+	return c.evict()
+}
+
+type blobCacheEntry struct {
+	digest   digest.Digest
+	dir      string // dir is the entry dir, or the file of a partial entry
+	size     int64
+	lastUsed time.Time
+	partial  bool
+}
+
+// list returns the entries in the cache
+func (c *BlobCache) list() ([]blobCacheEntry, error) {
+	algorithms, err := ioutil.ReadDir(c.Dir)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read cache dir")
+	}
+
+	var entries []blobCacheEntry
+	for _, algorithm := range algorithms {
+		if !algorithm.IsDir() || algorithm.Name() == cacheTempDirName || algorithm.Name() == cachePartialDirName {
+			continue
+		}
+
+		hexes, err := ioutil.ReadDir(filepath.Join(c.Dir, algorithm.Name()))
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read cache dir")
+		}
+
+		for _, hex := range hexes {
+			dir := filepath.Join(c.Dir, algorithm.Name(), hex.Name())
+			info, err := os.Stat(filepath.Join(dir, cacheBlobFileName))
+			if err != nil {
+				continue
+			}
+			entries = append(entries, blobCacheEntry{
+				digest:   digest.NewDigestFromHex(algorithm.Name(), hex.Name()),
+				dir:      dir,
+				size:     info.Size(),
+				lastUsed: info.ModTime(),
+			})
+		}
+	}
+
+	return entries, nil
+}
+
+// Digests returns the digests of the cached blobs, and the diff IDs recorded for them
+func (c *BlobCache) Digests() ([]digest.Digest, error) {
+	entries, err := c.list()
+	if err != nil {
+		return nil, err
+	}
+
+	var digests []digest.Digest
+	for _, entry := range entries {
+		digests = append(digests, entry.digest)
+		if diffID, err := ioutil.ReadFile(filepath.Join(entry.dir, cacheDiffIDFileName)); err == nil {
+			digests = append(digests, digest.Digest(strings.TrimSpace(string(diffID))))
+		}
+	}
+
+	return digests, nil
+}
+
+// GetByDiffID returns the digest and path of a cached blob with the diff ID
+func (c *BlobCache) GetByDiffID(diffID layer.DiffID) (digest.Digest, string, bool) {
+	entries, err := c.list()
+	if err != nil {
+		return "", "", false
+	}
+
+	for _, entry := range entries {
+		recorded, err := ioutil.ReadFile(filepath.Join(entry.dir, cacheDiffIDFileName))
+		if err != nil || layer.DiffID(strings.TrimSpace(string(recorded))) != diffID {
+			continue
+		}
+		if blobPath, _, ok := c.Get(entry.digest); ok {
+			return entry.digest, blobPath, true
+		}
+	}
+
+	return "", "", false
+}
+
+// evict removes the least recently used entries until the cache fits in MaxSize.  Partial
+// downloads count towards the size, and are removed too, unless a download holds them.
+func (c *BlobCache) evict() error {
+	if c.MaxSize <= 0 {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entries, err := c.list()
+	if err != nil {
+		return err
+	}
+	entries = append(entries, c.listPartials()...)
+
+	var total int64
+	for _, entry := range entries {
+		total += entry.size
+	}
+
+	sort.Slice(entries, func(j, k int) bool {
+		return entries[j].lastUsed.Before(entries[k].lastUsed)
+	})
+
+	for _, entry := range entries {
+		if total <= c.MaxSize {
+			break
+		}
+		if entry.partial {
+			if c.removePartial(entry.digest) {
+				log.Debugf("Evicted partial download %s from blob cache", entry.dir)
+				total -= entry.size
+			}
+			continue
+		}
+		log.Debugf("Evicting %s from blob cache", entry.dir)
+		if err := os.RemoveAll(entry.dir); err != nil {
+			return errors.Wrapf(err, "failed to evict %s", entry.dir)
+		}
+		total -= entry.size
+	}
+
+	return nil
+}
+
+// BlobCacheWriter writes a blob to a temp file in the cache.  The blob only becomes visible to
+// readers after Commit.
+type BlobCacheWriter struct {
+	cache    *BlobCache
+	digest   digest.Digest
+	file     *os.File
+	digester digest.Digester
+}
+
+func (w *BlobCacheWriter) Write(p []byte) (int, error) {
+	w.digester.Hash().Write(p)
+	return w.file.Write(p)
+}
+
+// Commit verifies the digest of the data written and adds the blob to the cache
+func (w *BlobCacheWriter) Commit(diffID layer.DiffID) error {
+	if err := w.file.Close(); err != nil {
+		os.Remove(w.file.Name())
+		return errors.Wrap(err, "failed to close cache file")
+	}
+
+	if computed := w.digester.Digest(); computed != w.digest {
+		os.Remove(w.file.Name())
+		return errors.Errorf("blob digest does not match expected digest: %s != %s", w.digest, computed)
+	}
+
+	if err := w.cache.add(w.digest, w.file.Name(), diffID); err != nil {
+		os.Remove(w.file.Name())
+		return err
+	}
+
+	return nil
+}
+
+// Cancel discards the data written
+func (w *BlobCacheWriter) Cancel() {
+	w.file.Close()
+	os.Remove(w.file.Name())
+}
+
+// cachingReadCloser adds the data read to the cache once the whole blob has been read
+type cachingReadCloser struct {
+	io.ReadCloser
+	writer *BlobCacheWriter
+}
+
+func (r *cachingReadCloser) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if r.writer == nil {
+		return n, err
+	}
+
+	if n > 0 {
+		if _, werr := r.writer.Write(p[:n]); werr != nil {
+			log.Infof("Failed to write blob %s to cache: %v", r.writer.digest, werr)
+			r.writer.Cancel()
+			r.writer = nil
+			return n, err
+		}
+	}
+
+	if err == io.EOF {
+		if cerr := r.writer.Commit(layer.DiffID("")); cerr != nil {
+			log.Infof("Failed to cache blob %s: %v", r.writer.digest, cerr)
+		}
+		r.writer = nil
+	}
+
+	return n, err
+}
+
+func (r *cachingReadCloser) Close() error {
+	if r.writer != nil {
+		r.writer.Cancel()
+		r.writer = nil
+	}
+	return r.ReadCloser.Close()
+}
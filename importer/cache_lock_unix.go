@@ -0,0 +1,27 @@
+//go:build !windows
+
+package importer
+
+import (
+	"os"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// lockFile takes an exclusive lock on the file, which is released when the file is closed.
+// Without block, it returns false when another open file holds the lock.
+func lockFile(file *os.File, block bool) (bool, error) {
+	how := syscall.LOCK_EX
+	if !block {
+		how |= syscall.LOCK_NB
+	}
+
+	if err := syscall.Flock(int(file.Fd()), how); err != nil {
+		if err == syscall.EWOULDBLOCK {
+			return false, nil
+		}
+		return false, errors.Wrap(err, "failed to lock file")
+	}
+	return true, nil
+}
@@ -0,0 +1,13 @@
+//go:build windows
+
+package importer
+
+import (
+	"os"
+)
+
+// lockFile does not lock files on Windows, so only the downloads of one process at a time are kept
+// from writing the same partial file there
+func lockFile(file *os.File, block bool) (bool, error) {
+	return true, nil
+}
@@ -0,0 +1,201 @@
+package importer
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/layer"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestBlobCache(t *testing.T, maxSize int64) *BlobCache {
+	dir, err := ioutil.TempDir("", "blobcache")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	cache, err := NewBlobCache(dir, maxSize)
+	require.NoError(t, err)
+	return cache
+}
+
+func addTestBlob(t *testing.T, cache *BlobCache, contents string) digest.Digest {
+	dgst := digest.FromString(contents)
+	writer, err := cache.Writer(dgst)
+	require.NoError(t, err)
+	_, err = writer.Write([]byte(contents))
+	require.NoError(t, err)
+	require.NoError(t, writer.Commit(layer.DiffID("sha256:"+dgst.Hex())))
+	return dgst
+}
+
+func TestBlobCacheEviction(t *testing.T) {
+	cache := newTestBlobCache(t, 25)
+
+	first := addTestBlob(t, cache, "0123456789")
+	second := addTestBlob(t, cache, "abcdefghij")
+
+	// Make the first blob the most recently used one
+	old := time.Now().Add(-time.Hour)
+	require.NoError(t, os.Chtimes(filepath.Join(cache.entryDir(second), cacheBlobFileName), old, old))
+	require.NoError(t, os.Chtimes(filepath.Join(cache.entryDir(first), cacheBlobFileName), old.Add(-time.Hour), old.Add(-time.Hour)))
+	_, diffID, ok := cache.Get(first)
+	require.True(t, ok)
+	assert.Equal(t, layer.DiffID("sha256:"+first.Hex()), diffID)
+
+	third := addTestBlob(t, cache, "ABCDEFGHIJ")
+
+	_, _, ok = cache.Get(first)
+	assert.True(t, ok)
+	_, _, ok = cache.Get(second)
+	assert.False(t, ok)
+	_, _, ok = cache.Get(third)
+	assert.True(t, ok)
+}
+
+func TestBlobCacheRejectsBadDigest(t *testing.T) {
+	cache := newTestBlobCache(t, 0)
+
+	dgst := digest.FromString("expected")
+	writer, err := cache.Writer(dgst)
+	require.NoError(t, err)
+	_, err = writer.Write([]byte("actual"))
+	require.NoError(t, err)
+	require.Error(t, writer.Commit(layer.DiffID("")))
+
+	_, _, ok := cache.Get(dgst)
+	assert.False(t, ok)
+}
+
+func TestPullImageCached(t *testing.T) {
+	registry := newTestRegistry(t)
+	img := newTestImageSchema2(t, map[string]string{"1": "1"}, map[string]string{"2": "2"})
+	registry.addImage("1.0", img)
+
+	var blobRequests int32
+	registry.onBlob = func() {
+		atomic.AddInt32(&blobRequests, 1)
+	}
+
+	cache := newTestBlobCache(t, 0)
+	pull := func() {
+		i := &Importer{Remote: registry.remote(t, "ns/img", "1.0"), Cache: cache}
+		localStore, err := i.PullImage(context.Background())
+		if localStore != nil {
+			defer localStore.delete()
+		}
+		require.NoError(t, err)
+		assertStoreImage(t, localStore, img)
+	}
+
+	pull()
+	assert.Equal(t, int32(3), atomic.LoadInt32(&blobRequests))
+
+	pull()
+	assert.Equal(t, int32(3), atomic.LoadInt32(&blobRequests))
+
+	// A corrupt entry is replaced from the registry
+	corrupted := digest.FromBytes(img.Layers[0])
+	require.NoError(t, ioutil.WriteFile(filepath.Join(cache.entryDir(corrupted), cacheBlobFileName), []byte("corrupt"), 0644))
+
+	pull()
+	assert.Equal(t, int32(4), atomic.LoadInt32(&blobRequests))
+	_, _, ok := cache.Get(corrupted)
+	assert.True(t, ok)
+
+	// So is a truncated config, which is read from the cache without extracting it
+	config := digest.FromBytes(img.Config)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(cache.entryDir(config), cacheBlobFileName), img.Config[:10], 0644))
+
+	pull()
+	assert.Equal(t, int32(5), atomic.LoadInt32(&blobRequests))
+	pull()
+	assert.Equal(t, int32(5), atomic.LoadInt32(&blobRequests))
+}
+
+func TestBlobCacheOpenRemovesCorruptBlob(t *testing.T) {
+	cache := newTestBlobCache(t, 0)
+	dgst := addTestBlob(t, cache, "0123456789")
+
+	reader, size, ok := cache.Open(dgst)
+	require.True(t, ok)
+	contents, err := ioutil.ReadAll(reader)
+	reader.Close()
+	require.NoError(t, err)
+	assert.Equal(t, "0123456789", string(contents))
+	assert.Equal(t, int64(10), size)
+
+	// The blob is verified as it is read, and removed when it does not match
+	require.NoError(t, ioutil.WriteFile(filepath.Join(cache.entryDir(dgst), cacheBlobFileName), []byte("01234"), 0644))
+	reader, _, ok = cache.Open(dgst)
+	require.True(t, ok)
+	_, err = ioutil.ReadAll(reader)
+	reader.Close()
+	require.ErrorIs(t, err, errInvalidCachedBlob)
+	_, _, ok = cache.Get(dgst)
+	assert.False(t, ok)
+}
+
+func TestBlobCacheEvictsPartials(t *testing.T) {
+	cache := newTestBlobCache(t, 25)
+
+	held := digest.FromString("held")
+	stale := digest.FromString("stale")
+	for _, dgst := range []digest.Digest{held, stale} {
+		partialPath, err := cache.PartialPath(dgst)
+		require.NoError(t, err)
+		require.NoError(t, ioutil.WriteFile(partialPath, []byte(strings.Repeat("p", 10)), 0644))
+		old := time.Now().Add(-time.Hour)
+		require.NoError(t, os.Chtimes(partialPath, old, old))
+	}
+
+	// Partials count towards the size, and are evicted first when they are older, unless a
+	// download holds them
+	unlock := cache.LockPartial(held)
+	addTestBlob(t, cache, strings.Repeat("a", 10))
+	unlock()
+
+	for dgst, exists := range map[digest.Digest]bool{held: true, stale: false} {
+		partialPath, err := cache.PartialPath(dgst)
+		require.NoError(t, err)
+		_, err = os.Stat(partialPath)
+		assert.Equal(t, exists, err == nil, dgst.String())
+	}
+	assert.Len(t, cache.listPartials(), 1)
+}
+
+func TestBlobCacheLockPartialAcrossProcesses(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("partial files are not locked across processes on windows")
+	}
+
+	cache := newTestBlobCache(t, 0)
+	dgst := digest.FromString("blob")
+
+	// Another process that shares the cache dir has its own locks
+	other, err := NewBlobCache(cache.Dir, 0)
+	require.NoError(t, err)
+
+	unlock := cache.LockPartial(dgst)
+	_, ok := other.tryLockPartial(dgst)
+	assert.False(t, ok)
+	unlock()
+
+	otherUnlock, ok := other.tryLockPartial(dgst)
+	require.True(t, ok)
+	otherUnlock()
+
+	// Without a partial file, the lock file is removed
+	partialPath, err := cache.PartialPath(dgst)
+	require.NoError(t, err)
+	_, err = os.Stat(partialPath + partialLockSuffix)
+	assert.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,590 @@
+package importer
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/replicatedcom/harpoon/log"
+
+	"github.com/docker/docker/layer"
+	"github.com/docker/docker/pkg/archive"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+const (
+	DefaultMaxConcurrentDownloads = 3
+
+	partialBlobFileName = "blob.partial"
+)
+
+// downloadLayers will download the blobs into temp layer folders in the store, running at most
+// MaxConcurrentDownloads downloads at a time.  Folders and diff IDs are returned in the same order
+// as the blobsums, so the caller can compute the v1 layer IDs once all of them are known.
+func (i *Importer) downloadLayers(ctx context.Context, localStore *v1Store, blobsums []digest.Digest) ([]string, []layer.DiffID, error) {
+	layerTempDirs := make([]string, len(blobsums))
+	diffIDs := make([]layer.DiffID, len(blobsums))
+
+	// Create layer.tar, json, and VERSION files for the layer in a temp folder because v1 layer ID is not known ahead of time.
+	for j := range blobsums {
+		layerTempDir, err := ioutil.TempDir(localStore.Workspace, "tmp_layer")
+		if err != nil {
+			log.Error(err)
+			return nil, nil, err
+		}
+		layerTempDirs[j] = layerTempDir
+	}
+
+	err := i.runDownloads(ctx, len(blobsums), func(j int) error {
+		diffID, err := i.downloadBlob(ctx, blobsums[j], layerTempDirs[j])
+		if err != nil {
+			return errors.Wrapf(err, "failed to download layer %s", blobsums[j])
+		}
+		diffIDs[j] = diffID
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return layerTempDirs, diffIDs, nil
+}
+
+// runDownloads calls download for every index up to count, running at most MaxConcurrentDownloads
+// of them at a time.  No new downloads are started after one fails or ctx is cancelled, and the
+// first error is returned.
+func (i *Importer) runDownloads(ctx context.Context, count int, download func(j int) error) error {
+	concurrency := i.MaxConcurrentDownloads
+	if concurrency <= 0 {
+		concurrency = DefaultMaxConcurrentDownloads
+	}
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+	)
+	sem := make(chan struct{}, concurrency)
+
+	for j := 0; j < count; j++ {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+		}
+
+		mu.Lock()
+		if firstErr == nil {
+			firstErr = ctx.Err()
+		}
+		failed := firstErr != nil
+		mu.Unlock()
+		if failed {
+			break
+		}
+
+		wg.Add(1)
+		go func(j int) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			if err := download(j); err != nil {
+				mu.Lock()
+				if firstErr == nil {
+					firstErr = err
+				}
+				mu.Unlock()
+			}
+		}(j)
+	}
+
+	wg.Wait()
+
+	return firstErr
+}
+
+// downloadBlob will download and write the layer to the layerDir, in the docker format.
+// The compressed blob is kept on disk while it downloads, so an interrupted download resumes
+// where it stopped instead of starting over.  With a cache, it is kept in the cache until it is
+// complete, so later pulls resume it too.
+func (i *Importer) downloadBlob(ctx context.Context, blobsum digest.Digest, layerDir string) (layer.DiffID, error) {
+	i.progress(ProgressLayerStarted, blobsum.String(), 0, -1)
+
+	if i.Cache != nil {
+		unlock := i.Cache.LockPartial(blobsum)
+		defer unlock()
+
+		if cachedPath, cachedDiffID, ok := i.Cache.Get(blobsum); ok {
+			diffID, err := extractBlob(blobsum, cachedPath, layerDir)
+			if err == nil && (cachedDiffID == "" || cachedDiffID == diffID) {
+				log.Debugf("Using cached blob %s", blobsum)
+				i.progress(ProgressLayerVerified, blobsum.String(), 0, -1)
+				i.progress(ProgressLayerExtracted, blobsum.String(), 0, -1)
+				return diffID, nil
+			}
+			log.Infof("Cached blob %s is invalid, downloading it again: %v", blobsum, err)
+			if err := i.Cache.Remove(blobsum); err != nil {
+				log.Infof("Failed to remove cached blob %s: %v", blobsum, err)
+			}
+		}
+	}
+
+	blobPath, kept := i.partialBlobPath(blobsum, filepath.Join(layerDir, partialBlobFileName))
+	if !kept {
+		defer os.Remove(blobPath)
+	}
+
+	var diffID layer.DiffID
+	err := i.fetchAndVerifyBlob(ctx, blobsum, blobPath, func() error {
+		var err error
+		diffID, err = extractBlob(blobsum, blobPath, layerDir)
+		return err
+	})
+	if err != nil {
+		return layer.DiffID(""), err
+	}
+
+	log.Debugf("Downloaded layer %s, with blobsum %s", diffID, blobsum)
+	i.progress(ProgressLayerVerified, blobsum.String(), 0, -1)
+	i.progress(ProgressLayerExtracted, blobsum.String(), 0, -1)
+
+	if i.Cache != nil {
+		if err := i.Cache.Add(blobsum, blobPath, diffID); err != nil {
+			log.Infof("Failed to cache blob %s: %v", blobsum, err)
+		}
+	}
+	if kept {
+		os.Remove(blobPath)
+	}
+
+	return diffID, nil
+}
+
+// downloadBlobTo will download the compressed blob to blobPath and verify its digest
+func (i *Importer) downloadBlobTo(ctx context.Context, blobsum digest.Digest, blobPath string) error {
+	i.progress(ProgressLayerStarted, blobsum.String(), 0, -1)
+
+	if i.Cache != nil {
+		unlock := i.Cache.LockPartial(blobsum)
+		defer unlock()
+
+		if cachedPath, _, ok := i.Cache.Get(blobsum); ok {
+			err := copyBlob(blobsum, cachedPath, blobPath)
+			if err == nil {
+				log.Debugf("Using cached blob %s", blobsum)
+				i.progress(ProgressLayerVerified, blobsum.String(), 0, -1)
+				return nil
+			}
+			log.Infof("Cached blob %s is invalid, downloading it again: %v", blobsum, err)
+			if err := i.Cache.Remove(blobsum); err != nil {
+				log.Infof("Failed to remove cached blob %s: %v", blobsum, err)
+			}
+			if err := os.Remove(blobPath); err != nil && !os.IsNotExist(err) {
+				return errors.Wrap(err, "failed to remove invalid blob")
+			}
+		}
+	}
+
+	fetchPath, kept := i.partialBlobPath(blobsum, blobPath)
+	err := i.fetchAndVerifyBlob(ctx, blobsum, fetchPath, func() error {
+		return verifyBlob(blobsum, fetchPath)
+	})
+	if err != nil {
+		if !kept {
+			os.Remove(fetchPath)
+		}
+		return err
+	}
+
+	log.Debugf("Downloaded blob %s", blobsum)
+	i.progress(ProgressLayerVerified, blobsum.String(), 0, -1)
+
+	if i.Cache != nil {
+		if err := i.Cache.Add(blobsum, fetchPath, layer.DiffID("")); err != nil {
+			log.Infof("Failed to cache blob %s: %v", blobsum, err)
+		}
+	}
+	if kept {
+		err := copyBlob(blobsum, fetchPath, blobPath)
+		os.Remove(fetchPath)
+		if err != nil {
+			os.Remove(blobPath)
+			return err
+		}
+	}
+
+	return nil
+}
+
+// partialBlobPath returns where to download the blob to.  With a cache, it is the partial file of
+// the blob in the cache, which is kept when the download fails so that a later pull, even after a
+// crash, resumes it.  Otherwise it is tempPath, which the caller removes.  It reports whether the
+// file is kept.
+func (i *Importer) partialBlobPath(blobsum digest.Digest, tempPath string) (string, bool) {
+	if i.Cache == nil {
+		return tempPath, false
+	}
+
+	partialPath, err := i.Cache.PartialPath(blobsum)
+	if err != nil {
+		log.Infof("Not keeping the partial download of %s: %v", blobsum, err)
+		return tempPath, false
+	}
+	return partialPath, true
+}
+
+// fetchAndVerifyBlob will download the blob to blobPath and verify it.  A resumed download that
+// fails verification is downloaded again from the start, and a blob that still fails verification
+// is removed.
+func (i *Importer) fetchAndVerifyBlob(ctx context.Context, blobsum digest.Digest, blobPath string, verify func() error) error {
+	resumed, err := i.fetchBlob(ctx, blobsum, blobPath)
+	if err != nil {
+		return err
+	}
+
+	err = verify()
+	if err == nil {
+		return nil
+	}
+	if !resumed {
+		os.Remove(blobPath)
+		return err
+	}
+
+	// Data from the resumed request may not line up with the data already on disk
+	log.Infof("Resumed download of %s failed verification, downloading it again: %v", blobsum, err)
+	if err := os.Remove(blobPath); err != nil {
+		return errors.Wrap(err, "failed to remove partial blob")
+	}
+	if _, err := i.fetchBlob(ctx, blobsum, blobPath); err != nil {
+		return err
+	}
+
+	if err := verify(); err != nil {
+		os.Remove(blobPath)
+		return err
+	}
+	return nil
+}
+
+// fetchBlob will download the blob to blobPath, resuming from the end of the partial data after
+// an interrupted transfer.  Attempts and the backoff between them follow the retry policy of the
+// remote.  It reports whether any of the data was fetched with a range request.
+func (i *Importer) fetchBlob(ctx context.Context, blobsum digest.Digest, blobPath string) (bool, error) {
+	file, err := os.OpenFile(blobPath, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return false, errors.Wrapf(err, "failed to create blob file %s", blobPath)
+	}
+	defer file.Close()
+
+	resumed := false
+	var lastErr error
+	attempts := i.Remote.Retry.Attempts()
+	for attempt := 1; attempt <= attempts; attempt++ {
+		offset, err := file.Seek(0, io.SeekEnd)
+		if err != nil {
+			return resumed, errors.Wrap(err, "failed to seek blob file")
+		}
+
+		rangeUsed, retry, err := i.fetchBlobFrom(ctx, blobsum, file, offset)
+		resumed = resumed || rangeUsed
+		if err == nil {
+			return resumed, nil
+		}
+		if !retry || ctx.Err() != nil {
+			return resumed, err
+		}
+
+		lastErr = err
+		if attempt == attempts {
+			break
+		}
+
+		log.Infof("Download of %s was interrupted, retrying: %v", blobsum, err)
+		if err := i.Remote.Retry.Wait(ctx, attempt, nil); err != nil {
+			return resumed, err
+		}
+	}
+
+	return resumed, errors.Wrapf(lastErr, "failed to download %s after %d attempts", blobsum, attempts)
+}
+
+// fetchBlobFrom will append the blob data starting at offset to the file.  Registries that do not
+// support range requests send the whole blob, in which case the file is truncated first.
+func (i *Importer) fetchBlobFrom(ctx context.Context, blobsum digest.Digest, file *os.File, offset int64) (rangeUsed bool, retry bool, err error) {
+	uri := fmt.Sprintf("%s/v2/%s/blobs/%s", i.Remote.BaseURL(), i.Remote.Repository, blobsum.String())
+
+	log.Debugf("Downloading blob from %q at offset %d", uri, offset)
+
+	req, err := i.Remote.NewHttpRequest(ctx, "GET", uri, nil)
+	if err != nil {
+		return false, false, errors.Wrap(err, "failed to create request")
+	}
+
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+
+	// Requests that fail outright were already retried by the remote, which also authenticates
+	// again when the token of the pull is refused part way
+	resp, err := i.Remote.DoWithRetry(req, maxRetries)
+	if err != nil {
+		return false, false, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		if offset > 0 {
+			log.Debugf("Registry ignored range request for %s, downloading the whole blob", blobsum)
+			if err := truncateFile(file); err != nil {
+				return false, false, err
+			}
+		}
+	case http.StatusPartialContent:
+		start, err := contentRangeStart(resp.Header.Get("Content-Range"))
+		if err != nil || start != offset {
+			// Start over rather than guess where the data belongs
+			if err := truncateFile(file); err != nil {
+				return false, false, err
+			}
+			return false, true, errors.Errorf("unexpected content range %q for offset %d", resp.Header.Get("Content-Range"), offset)
+		}
+		rangeUsed = true
+	case http.StatusRequestedRangeNotSatisfiable:
+		if offset == 0 {
+			err := fmt.Errorf("Unexpected status code for %s: %d", uri, resp.StatusCode)
+			log.Error(err)
+			return false, false, err
+		}
+		// The partial data is already complete, or longer than the blob.  Verification will tell.
+		return true, false, nil
+	default:
+		err := fmt.Errorf("Unexpected status code for %s: %d", uri, resp.StatusCode)
+		log.Error(err)
+		return false, false, err
+	}
+
+	// The data already on disk counts towards the progress of a resumed download
+	current := int64(0)
+	if rangeUsed {
+		current = offset
+	}
+	total := int64(-1)
+	if resp.ContentLength >= 0 {
+		total = current + resp.ContentLength
+	}
+
+	if _, err := io.Copy(file, i.newProgressReader(resp.Body, blobsum.String(), current, total)); err != nil {
+		return rangeUsed, true, errors.Wrapf(err, "failed to download blob %s", blobsum)
+	}
+
+	return rangeUsed, false, nil
+}
+
+// resumingReader reads a blob from the registry, and resumes it with a range request when the
+// connection breaks part way.  Registries that ignore the range send the whole blob again, and the
+// part that was already read is skipped.  The reader's consumer still verifies the digest.
+type resumingReader struct {
+	ctx      context.Context
+	importer *Importer
+	blobsum  digest.Digest
+	body     io.ReadCloser
+	offset   int64
+	retries  int
+
+	// err is returned by the next read, after the data that came with it
+	err error
+}
+
+func (r *resumingReader) Read(p []byte) (int, error) {
+	for {
+		n, err := 0, r.err
+		r.err = nil
+		if err == nil {
+			n, err = r.body.Read(p)
+			r.offset += int64(n)
+		}
+
+		if err == nil || err == io.EOF {
+			return n, err
+		}
+		if n > 0 {
+			r.err = err
+			return n, nil
+		}
+
+		if r.ctx.Err() != nil || r.retries+1 >= r.importer.Remote.Retry.Attempts() {
+			return 0, err
+		}
+		r.retries++
+
+		log.Infof("Download of %s was interrupted after %d bytes, resuming: %v", r.blobsum, r.offset, err)
+		if err := r.importer.Remote.Retry.Wait(r.ctx, r.retries, nil); err != nil {
+			return 0, err
+		}
+
+		body, err := r.importer.resumeBlob(r.ctx, r.blobsum, r.offset)
+		if err != nil {
+			return 0, errors.Wrapf(err, "failed to resume download of %s", r.blobsum)
+		}
+		r.body.Close()
+		r.body = body
+	}
+}
+
+func (r *resumingReader) Close() error {
+	return r.body.Close()
+}
+
+// resumeBlob returns the blob data from offset on
+func (i *Importer) resumeBlob(ctx context.Context, blobsum digest.Digest, offset int64) (io.ReadCloser, error) {
+	uri := fmt.Sprintf("%s/v2/%s/blobs/%s", i.Remote.BaseURL(), i.Remote.Repository, blobsum.String())
+
+	req, err := i.Remote.NewHttpRequest(ctx, "GET", uri, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create request")
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+
+	resp, err := i.Remote.DoWithRetry(req, maxRetries)
+	if err != nil {
+		return nil, err
+	}
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		start, err := contentRangeStart(resp.Header.Get("Content-Range"))
+		if err != nil || start != offset {
+			resp.Body.Close()
+			return nil, errors.Errorf("unexpected content range %q for offset %d", resp.Header.Get("Content-Range"), offset)
+		}
+	case http.StatusOK:
+		log.Debugf("Registry ignored range request for %s, skipping %d bytes", blobsum, offset)
+		if _, err := io.CopyN(io.Discard, resp.Body, offset); err != nil {
+			resp.Body.Close()
+			return nil, errors.Wrap(err, "failed to skip the data already read")
+		}
+	default:
+		resp.Body.Close()
+		return nil, errors.Errorf("unexpected status code for %s: %d", uri, resp.StatusCode)
+	}
+
+	return resp.Body, nil
+}
+
+// extractBlob will verify the blob at blobPath and write its uncompressed contents to layer.tar
+func extractBlob(blobsum digest.Digest, blobPath, layerDir string) (layer.DiffID, error) {
+	blobFile, err := os.Open(blobPath)
+	if err != nil {
+		return layer.DiffID(""), errors.Wrapf(err, "failed to open blob file %s", blobPath)
+	}
+	defer blobFile.Close()
+
+	gzipDigest := digest.Canonical.Digester()
+	blobReader := io.TeeReader(blobFile, gzipDigest.Hash())
+
+	// Layers may be gzipped (schema1, schema2 and OCI tar+gzip) or plain tar (OCI tar)
+	decompressed, err := archive.DecompressStream(blobReader)
+	if err != nil {
+		return layer.DiffID(""), errors.Wrap(err, "failed to create decompressing reader")
+	}
+	defer decompressed.Close()
+
+	target := filepath.Join(layerDir, "layer.tar")
+	writer, err := os.Create(target)
+	if err != nil {
+		return layer.DiffID(""), errors.Wrapf(err, "failed to create tar file %s", target)
+	}
+	defer writer.Close()
+
+	tarDigest := digest.Canonical.Digester()
+	tarWriter := io.MultiWriter(writer, tarDigest.Hash())
+
+	if _, err := io.Copy(tarWriter, decompressed); err != nil {
+		return layer.DiffID(""), errors.Wrapf(err, "failed to decompress blob %s", blobsum)
+	}
+
+	// Make sure the whole blob went through the digester, even if the decompressor stopped early
+	if _, err := io.Copy(ioutil.Discard, blobReader); err != nil {
+		return layer.DiffID(""), errors.Wrap(err, "failed to read blob")
+	}
+
+	computedBlobsum := digest.Digest(gzipDigest.Digest())
+	if blobsum.String() != computedBlobsum.String() {
+		return layer.DiffID(""), errors.Errorf("downloaded layer blobsum does not match expected blobsum: %s != %s", blobsum, computedBlobsum)
+	}
+
+	return layer.DiffID(tarDigest.Digest()), nil
+}
+
+// verifyBlob will check the blob at blobPath against its digest
+func verifyBlob(blobsum digest.Digest, blobPath string) error {
+	file, err := os.Open(blobPath)
+	if err != nil {
+		return errors.Wrapf(err, "failed to open blob file %s", blobPath)
+	}
+	defer file.Close()
+
+	verifier := blobsum.Verifier()
+	if _, err := io.Copy(verifier, file); err != nil {
+		return errors.Wrap(err, "failed to read blob")
+	}
+	if !verifier.Verified() {
+		return errors.Errorf("downloaded blob does not match expected digest %s", blobsum)
+	}
+
+	return nil
+}
+
+// copyBlob will copy the blob at src to dst, verifying its digest on the way
+func copyBlob(blobsum digest.Digest, src, dst string) error {
+	srcFile, err := os.Open(src)
+	if err != nil {
+		return errors.Wrapf(err, "failed to open blob file %s", src)
+	}
+	defer srcFile.Close()
+
+	dstFile, err := os.Create(dst)
+	if err != nil {
+		return errors.Wrapf(err, "failed to create blob file %s", dst)
+	}
+	defer dstFile.Close()
+
+	verifier := blobsum.Verifier()
+	if _, err := io.Copy(io.MultiWriter(dstFile, verifier), srcFile); err != nil {
+		return errors.Wrap(err, "failed to copy blob")
+	}
+	if !verifier.Verified() {
+		return errors.Errorf("blob does not match expected digest %s", blobsum)
+	}
+
+	return nil
+}
+
+func truncateFile(file *os.File) error {
+	if err := file.Truncate(0); err != nil {
+		return errors.Wrap(err, "failed to truncate file")
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return errors.Wrap(err, "failed to seek file")
+	}
+	return nil
+}
+
+// contentRangeStart returns the first byte position of a "bytes first-last/length" content range
+func contentRangeStart(contentRange string) (int64, error) {
+	var start, end int64
+	var length string
+	if _, err := fmt.Sscanf(contentRange, "bytes %d-%d/%s", &start, &end, &length); err != nil {
+		return 0, errors.Wrapf(err, "invalid content range %q", contentRange)
+	}
+	return start, nil
+}
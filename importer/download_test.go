@@ -0,0 +1,298 @@
+package importer
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/replicatedcom/harpoon/remote"
+
+	digest "github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDownloadLayersConcurrency(t *testing.T) {
+	registry := newTestRegistry(t)
+	img := newTestImageSchema2(t,
+		map[string]string{"1": "1"},
+		map[string]string{"2": "2"},
+		map[string]string{"3": "3"},
+		map[string]string{"4": "4"},
+		map[string]string{"5": "5"},
+	)
+	registry.addImage("1.0", img)
+
+	var mu sync.Mutex
+	inFlight, maxInFlight := 0, 0
+	registry.onBlob = func() {
+		mu.Lock()
+		inFlight++
+		if inFlight > maxInFlight {
+			maxInFlight = inFlight
+		}
+		mu.Unlock()
+
+		time.Sleep(50 * time.Millisecond)
+
+		mu.Lock()
+		inFlight--
+		mu.Unlock()
+	}
+
+	i := &Importer{
+		Remote:                 registry.remote(t, "ns/img", "1.0"),
+		MaxConcurrentDownloads: 2,
+	}
+	localStore, err := i.PullImage(context.Background())
+	if localStore != nil {
+		defer localStore.delete()
+	}
+	require.NoError(t, err)
+
+	assertStoreImage(t, localStore, img)
+	assert.Equal(t, 2, maxInFlight)
+}
+
+func TestDownloadBlobResume(t *testing.T) {
+	tests := []struct {
+		name         string
+		ignoreRange  bool
+		corruptRange bool
+	}{
+		{name: "resume"},
+		{name: "range ignored", ignoreRange: true},
+		{name: "resumed data corrupt", corruptRange: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			registry := newTestRegistry(t)
+			img := newTestImageSchema2(t, map[string]string{"1": strings.Repeat("1", 4096)})
+			registry.addImage("1.0", img)
+			registry.dropBlob = 1
+			registry.ignoreRange = test.ignoreRange
+			registry.corruptRange = test.corruptRange
+
+			i := &Importer{Remote: registry.remote(t, "ns/img", "1.0")}
+			layerDir, err := ioutil.TempDir("", "layer")
+			require.NoError(t, err)
+			defer os.RemoveAll(layerDir)
+
+			blobsum := digest.FromBytes(img.Layers[0])
+			diffID, err := i.downloadBlob(context.Background(), blobsum, layerDir)
+			require.NoError(t, err)
+			assert.Equal(t, img.DiffIDs[0], digest.Digest(diffID))
+
+			assert.Equal(t, []string{fmt.Sprintf("bytes=%d-", len(img.Layers[0])/2)}, registry.ranges)
+
+			_, err = os.Stat(filepath.Join(layerDir, partialBlobFileName))
+			assert.True(t, os.IsNotExist(err))
+		})
+	}
+}
+
+func TestDownloadBlobResumeAcrossPulls(t *testing.T) {
+	registry := newTestRegistry(t)
+	img := newTestImageSchema2(t, map[string]string{"1": strings.Repeat("1", 4096)})
+	registry.addImage("1.0", img)
+	registry.dropBlob = 1
+
+	cache := newTestBlobCache(t, 0)
+	blobsum := digest.FromBytes(img.Layers[0])
+	download := func(maxAttempts int) error {
+		dockerRemote := registry.remote(t, "ns/img", "1.0")
+		dockerRemote.Retry.MaxAttempts = maxAttempts
+		i := &Importer{Remote: dockerRemote, Cache: cache}
+
+		layerDir, err := ioutil.TempDir("", "layer")
+		require.NoError(t, err)
+		defer os.RemoveAll(layerDir)
+
+		_, err = i.downloadBlob(context.Background(), blobsum, layerDir)
+		return err
+	}
+
+	// The interrupted download is kept in the cache
+	require.Error(t, download(1))
+	partialPath, err := cache.PartialPath(blobsum)
+	require.NoError(t, err)
+	info, err := os.Stat(partialPath)
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(img.Layers[0])/2), info.Size())
+
+	// And the next pull resumes it
+	require.NoError(t, download(0))
+	assert.Equal(t, []string{fmt.Sprintf("bytes=%d-", len(img.Layers[0])/2)}, registry.ranges)
+
+	_, err = os.Stat(partialPath)
+	assert.True(t, os.IsNotExist(err))
+	_, _, ok := cache.Get(blobsum)
+	assert.True(t, ok)
+}
+
+func TestPullImageRepeatedLayerCached(t *testing.T) {
+	registry := newTestRegistry(t)
+	img := newTestImageSchema2(t, map[string]string{}, map[string]string{"1": "1"}, map[string]string{})
+	registry.addImage("1.0", img)
+
+	i := &Importer{Remote: registry.remote(t, "ns/img", "1.0"), Cache: newTestBlobCache(t, 0), MaxConcurrentDownloads: 3}
+	localStore, err := i.PullImage(context.Background())
+	if localStore != nil {
+		defer localStore.delete()
+	}
+	require.NoError(t, err)
+	assertStoreImage(t, localStore, img)
+}
+
+func TestDownloadBlobReauthenticates(t *testing.T) {
+	registry := newTestRegistry(t)
+	img := newTestImageSchema2(t, map[string]string{"1": strings.Repeat("1", 4096)})
+	registry.addImage("1.0", img)
+	// The download is cut off, and the registry asks for a token when it resumes
+	registry.dropBlob = 1
+	registry.unauthorizedRange = 1
+
+	i := &Importer{Remote: registry.remote(t, "ns/img", "1.0")}
+	layerDir, err := ioutil.TempDir("", "layer")
+	require.NoError(t, err)
+	defer os.RemoveAll(layerDir)
+
+	_, err = i.downloadBlob(context.Background(), digest.FromBytes(img.Layers[0]), layerDir)
+	require.NoError(t, err)
+	assert.Equal(t, []string{fmt.Sprintf("bytes=%d-", len(img.Layers[0])/2), fmt.Sprintf("bytes=%d-", len(img.Layers[0])/2)}, registry.ranges)
+}
+
+func TestDownloadBlobUnsatisfiable(t *testing.T) {
+	registry := newTestRegistry(t)
+	img := newTestImageSchema2(t, map[string]string{"1": "1"})
+	registry.addImage("1.0", img)
+	registry.unsatisfiableBlob = 1
+
+	i := &Importer{Remote: registry.remote(t, "ns/img", "1.0")}
+	layerDir, err := ioutil.TempDir("", "layer")
+	require.NoError(t, err)
+	defer os.RemoveAll(layerDir)
+
+	// Without a range, 416 is not taken for a complete download
+	_, err = i.downloadBlob(context.Background(), digest.FromBytes(img.Layers[0]), layerDir)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "416")
+}
+
+func TestDownloadBlobGivesUp(t *testing.T) {
+	registry := newTestRegistry(t)
+	img := newTestImageSchema2(t, map[string]string{"1": "1"})
+	registry.addImage("1.0", img)
+	registry.dropBlob = remote.DefaultMaxAttempts
+
+	i := &Importer{Remote: registry.remote(t, "ns/img", "1.0")}
+	layerDir, err := ioutil.TempDir("", "layer")
+	require.NoError(t, err)
+	defer os.RemoveAll(layerDir)
+
+	_, err = i.downloadBlob(context.Background(), digest.FromBytes(img.Layers[0]), layerDir)
+	require.Error(t, err)
+}
+
+func TestImportFromRemoteCancelled(t *testing.T) {
+	registry := newTestRegistry(t)
+	img := newTestImageSchema2(t, map[string]string{"1": "1"}, map[string]string{"2": "2"})
+	registry.addImage("1.0", img)
+
+	// The config is downloaded, then the pull is cancelled while the layers hang
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	registry.hangBlobs(t, 1, cancel)
+
+	tempDir := t.TempDir()
+	t.Setenv("TMPDIR", tempDir)
+
+	loader := &testLoader{}
+	i := &Importer{Remote: registry.remote(t, "ns/img", "1.0"), Loader: loader}
+	requireCancelled(t, func() error {
+		return i.ImportFromRemote(ctx)
+	})
+
+	assert.Empty(t, loader.files)
+
+	// The workspace is removed
+	entries, err := os.ReadDir(tempDir)
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+func TestPullImageRetriesUnavailable(t *testing.T) {
+	registry := newTestRegistry(t)
+	img := newTestImageSchema2(t, map[string]string{"1": "1"})
+	registry.addImage("1.0", img)
+	registry.unavailable = remote.DefaultMaxAttempts - 1
+
+	i := &Importer{Remote: registry.remote(t, "ns/img", "1.0")}
+	localStore, err := i.PullImage(context.Background())
+	if localStore != nil {
+		defer localStore.delete()
+	}
+	require.NoError(t, err)
+	assertStoreImage(t, localStore, img)
+
+	// Without retries, the registry looks down
+	registry.unavailable = 1
+	registry.requests = 0
+	i = &Importer{Remote: registry.remote(t, "ns/img", "1.0")}
+	i.Remote.Retry.MaxAttempts = 1
+	_, _, err = i.GetManifestBytes(context.Background())
+	require.Error(t, err)
+	assert.Equal(t, 1, registry.requests)
+}
+
+func TestPullImageFromMirror(t *testing.T) {
+	upstream := newTestRegistry(t)
+	mirror := newTestRegistry(t)
+	img := newTestImageSchema2(t, map[string]string{"1": "1"}, map[string]string{"2": "2"})
+	mirror.addImage("1.0", img)
+
+	i := &Importer{Remote: upstream.remote(t, "ns/img", "1.0")}
+	i.Remote.Mirrors = []string{"https://" + mirror.Host()}
+	localStore, err := i.PullImage(context.Background())
+	if localStore != nil {
+		defer localStore.delete()
+	}
+	require.NoError(t, err)
+	assertStoreImage(t, localStore, img)
+
+	assert.Empty(t, upstream.paths)
+	assert.Len(t, mirror.paths, 4)
+}
+
+func TestPullImageMirrorFallback(t *testing.T) {
+	upstream := newTestRegistry(t)
+	mirror := newTestRegistry(t)
+	img := newTestImageSchema2(t, map[string]string{"1": "1"}, map[string]string{"2": "2"})
+	upstream.addImage("1.0", img)
+	mirror.addImage("1.0", img)
+
+	// The mirror does not have the second layer, and the first mirror is down
+	missing := digest.FromBytes(img.Layers[1])
+	delete(mirror.blobs, missing)
+	down := newTestServer(t, http.NotFoundHandler())
+	down.Close()
+
+	i := &Importer{Remote: upstream.remote(t, "ns/img", "1.0")}
+	i.Remote.Mirrors = []string{serverHost(down), mirror.Host()}
+	localStore, err := i.PullImage(context.Background())
+	if localStore != nil {
+		defer localStore.delete()
+	}
+	require.NoError(t, err)
+	assertStoreImage(t, localStore, img)
+
+	assert.Equal(t, []string{"/v2/ns/img/blobs/" + missing.String()}, upstream.paths)
+}
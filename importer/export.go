@@ -0,0 +1,79 @@
+package importer
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/replicatedcom/harpoon/log"
+
+	"github.com/docker/docker/pkg/archive"
+	"github.com/docker/docker/pkg/ioutils"
+	"github.com/pkg/errors"
+)
+
+// PullArchive pulls the image and returns it as a docker-save tarball that can be passed to
+// `docker load`.  The workspace is removed when the reader is closed.
+func (i *Importer) PullArchive(ctx context.Context, compression archive.Compression) (io.ReadCloser, error) {
+	localStore, err := i.PullImage(ctx)
+	if err != nil {
+		if localStore != nil {
+			localStore.delete()
+		}
+		return nil, err
+	}
+
+	reader, err := localStore.archive(compression)
+	if err != nil {
+		localStore.delete()
+		return nil, err
+	}
+
+	return ioutils.NewReadCloserWrapper(reader, func() error {
+		reader.Close()
+		return localStore.delete()
+	}), nil
+}
+
+// SaveFromRemote pulls the image and writes it as a docker-save tarball to path, without loading
+// it into Docker.  The archive is gzipped when the path ends in .gz or .tgz.  A temp file is used
+// when path is empty.  The path of the archive is returned.
+func (i *Importer) SaveFromRemote(ctx context.Context, path string) (string, error) {
+	compression := archive.Uncompressed
+	if path == "" || strings.HasSuffix(path, ".gz") || strings.HasSuffix(path, ".tgz") {
+		compression = archive.Gzip
+	}
+
+	reader, err := i.PullArchive(ctx, compression)
+	if err != nil {
+		return "", err
+	}
+	defer reader.Close()
+
+	var file *os.File
+	if path == "" {
+		file, err = ioutil.TempFile("", "harpoon-*.tar.gz")
+	} else {
+		file, err = os.Create(path)
+	}
+	if err != nil {
+		return "", errors.Wrap(err, "failed to create archive")
+	}
+
+	log.Debugf("Writing image to %s", file.Name())
+
+	if _, err := io.Copy(file, reader); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return "", errors.Wrap(err, "failed to write archive")
+	}
+
+	if err := file.Close(); err != nil {
+		os.Remove(file.Name())
+		return "", errors.Wrap(err, "failed to close archive")
+	}
+
+	return file.Name(), nil
+}
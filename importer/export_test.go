@@ -0,0 +1,86 @@
+package importer
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/docker/docker/pkg/archive"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSaveFromRemote(t *testing.T) {
+	registry := newTestRegistry(t)
+	img := newTestImageSchema2(t, map[string]string{"1": "1"}, map[string]string{"2": "2"})
+	registry.addImage("1.0", img)
+
+	dir, err := ioutil.TempDir("", "export")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name        string
+		path        string
+		compression archive.Compression
+	}{
+		{name: "gzip", path: filepath.Join(dir, "image.tar.gz"), compression: archive.Gzip},
+		{name: "plain", path: filepath.Join(dir, "image.tar"), compression: archive.Uncompressed},
+		{name: "temp file", compression: archive.Gzip},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			i := &Importer{Remote: registry.remote(t, "ns/img", "1.0")}
+			path, err := i.SaveFromRemote(context.Background(), test.path)
+			require.NoError(t, err)
+			defer os.Remove(path)
+			if test.path != "" {
+				assert.Equal(t, test.path, path)
+			}
+
+			file, err := os.Open(path)
+			require.NoError(t, err)
+			defer file.Close()
+
+			header := make([]byte, 10)
+			_, err = io.ReadFull(file, header)
+			require.NoError(t, err)
+			assert.Equal(t, test.compression, archive.DetectCompression(header))
+			_, err = file.Seek(0, io.SeekStart)
+			require.NoError(t, err)
+
+			decompressed, err := archive.DecompressStream(file)
+			require.NoError(t, err)
+			defer decompressed.Close()
+
+			files := map[string][]byte{}
+			tarReader := tar.NewReader(decompressed)
+			for {
+				hdr, err := tarReader.Next()
+				if err == io.EOF {
+					break
+				}
+				require.NoError(t, err)
+				contents, err := ioutil.ReadAll(tarReader)
+				require.NoError(t, err)
+				files[hdr.Name] = contents
+			}
+
+			var manifest []manifestItem
+			require.NoError(t, json.Unmarshal(files["manifest.json"], &manifest))
+			require.Len(t, manifest, 1)
+			assert.Equal(t, digest.FromBytes(img.Config).Hex()+".json", manifest[0].Config)
+			assert.Len(t, manifest[0].Layers, 2)
+			for _, layer := range manifest[0].Layers {
+				assert.Contains(t, files, layer)
+			}
+		})
+	}
+}
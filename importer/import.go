@@ -1,32 +1,33 @@
 package importer
 
 import (
-	"github.com/pkg/errors"
+	"context"
+
 	"github.com/replicatedcom/harpoon/log"
 	"github.com/replicatedcom/harpoon/remote"
 
 	"github.com/docker/docker/pkg/archive"
-	docker "github.com/fsouza/go-dockerclient"
-)
-
-var (
-	dockerClient *docker.Client
 )
 
-func init() {
-	var err error
-	dockerClient, err = docker.NewClient("unix:///var/run/docker.sock")
+// ImportFromRemote imports an image into the Docker daemon configured in params from a remote repo.
+// It is a shorthand for library callers, and Importer.ImportFromRemote takes the other options.
+func ImportFromRemote(ctx context.Context, dockerRemote *remote.DockerRemote) error {
+	loader, err := NewDockerLoaderFromParams()
 	if err != nil {
-		panic(errors.Wrap(err, "failed to create docker client"))
+		return err
 	}
+
+	i := &Importer{Remote: dockerRemote, Loader: loader}
+	return i.ImportFromRemote(ctx)
 }
 
-// ImportFromRemote imports an image into the store from a remote repo.
-// unused I THINK
-func ImportFromRemote(dockerRemote *remote.DockerRemote) error {
-	i := &Importer{Remote: dockerRemote}
+// ImportFromRemote imports the image from the importer's remote repo with the importer's loader.
+func (i *Importer) ImportFromRemote(ctx context.Context) error {
+	if i.Loader == nil {
+		return ErrNoLoader
+	}
 
-	localStore, err := i.PullImage()
+	localStore, err := i.PullImage(ctx)
 	if localStore != nil {
 		defer localStore.delete()
 	}
@@ -35,24 +36,26 @@ func ImportFromRemote(dockerRemote *remote.DockerRemote) error {
 		return err
 	}
 
-	return i.ImportFromLocal(localStore)
+	return i.ImportFromLocal(ctx, localStore)
 }
 
-func (i *Importer) ImportFromLocal(localStore *v1Store) error {
+func (i *Importer) ImportFromLocal(ctx context.Context, localStore *v1Store) error {
+	if i.Loader == nil {
+		return ErrNoLoader
+	}
+
 	log.Debugf("Loading image from %s", localStore.Workspace)
 
-	archive, err := archive.TarWithOptions(localStore.Workspace, &archive.TarOptions{Compression: archive.Uncompressed})
+	archive, err := localStore.archive(archive.Uncompressed)
 	if err != nil {
 		return err
 	}
 	defer archive.Close()
 
-	loadImageOptions := docker.LoadImageOptions{
-		InputStream: archive,
-	}
-	if err = dockerClient.LoadImage(loadImageOptions); err != nil {
-		return errors.Wrap(err, "failed to load image")
+	if err := i.Loader.Load(ctx, archive); err != nil {
+		return err
 	}
 
+	i.progress(ProgressLoadFinished, "", 0, -1)
 	return nil
 }
@@ -1,6 +1,7 @@
 package importer
 
 import (
+	"context"
 	"testing"
 
 	"github.com/replicatedcom/harpoon/remote"
@@ -12,6 +13,6 @@ func TestImportFromRemote(t *testing.T) {
 	dockerRemote, err := remote.ParseDockerURI("docker://redis:3.0.5")
 	require.NoError(t, err)
 
-	err = ImportFromRemote(dockerRemote)
+	err = ImportFromRemote(context.Background(), dockerRemote)
 	require.NoError(t, err)
 }
@@ -0,0 +1,90 @@
+package importer
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/replicatedcom/harpoon/log"
+	"github.com/replicatedcom/harpoon/params"
+
+	docker "github.com/fsouza/go-dockerclient"
+	"github.com/pkg/errors"
+)
+
+// ErrNoLoader is returned when an image is imported by an Importer without a Loader
+var ErrNoLoader = errors.New("no image loader configured")
+
+// Loader loads a docker-save tarball into an image store.  Loading stops when ctx is cancelled.
+type Loader interface {
+	Load(ctx context.Context, archive io.Reader) error
+}
+
+// DockerLoader loads images into a Docker daemon, like `docker load`
+type DockerLoader struct {
+	client *docker.Client
+}
+
+// NewDockerLoader creates a loader for the Docker daemon at endpoint.  TCP endpoints use TLS when
+// certsDir contains cert.pem, key.pem and ca.pem.
+func NewDockerLoader(endpoint, certsDir string) (*DockerLoader, error) {
+	if endpoint == "" {
+		endpoint = params.DefaultDockerEndpoint
+	}
+
+	var client *docker.Client
+	var err error
+	if cert, key, ca, ok := dockerTLSFiles(endpoint, certsDir); ok {
+		log.Debugf("Connecting to docker at %s with TLS certificates from %s", endpoint, certsDir)
+		client, err = docker.NewTLSClient(endpoint, cert, key, ca)
+	} else {
+		client, err = docker.NewClient(endpoint)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to create docker client for %s", endpoint)
+	}
+
+	return &DockerLoader{client: client}, nil
+}
+
+// NewDockerLoaderFromParams creates a loader for the Docker daemon configured in params
+func NewDockerLoaderFromParams() (*DockerLoader, error) {
+	p := params.Get()
+	return NewDockerLoader(p.DockerEndpoint, p.DockerCertPath)
+}
+
+// dockerTLSFiles returns the client certificate, key and CA in certsDir, if they all exist and
+// the endpoint is reached over TCP
+func dockerTLSFiles(endpoint, certsDir string) (string, string, string, bool) {
+	if certsDir == "" || !(strings.HasPrefix(endpoint, "tcp://") || strings.HasPrefix(endpoint, "https://")) {
+		return "", "", "", false
+	}
+
+	files := []string{
+		filepath.Join(certsDir, "cert.pem"),
+		filepath.Join(certsDir, "key.pem"),
+		filepath.Join(certsDir, "ca.pem"),
+	}
+	for _, file := range files {
+		if _, err := os.Stat(file); err != nil {
+			return "", "", "", false
+		}
+	}
+
+	return files[0], files[1], files[2], true
+}
+
+// Load will load the archive into the daemon
+func (l *DockerLoader) Load(ctx context.Context, archive io.Reader) error {
+	loadImageOptions := docker.LoadImageOptions{
+		InputStream: archive,
+		Context:     ctx,
+	}
+	if err := l.client.LoadImage(loadImageOptions); err != nil {
+		return errors.Wrap(err, "failed to load image")
+	}
+
+	return nil
+}
@@ -0,0 +1,97 @@
+package importer
+
+import (
+	"archive/tar"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testLoader records the names of the files in the loaded archive
+type testLoader struct {
+	files []string
+}
+
+func (l *testLoader) Load(ctx context.Context, archive io.Reader) error {
+	tarReader := tar.NewReader(archive)
+	for {
+		hdr, err := tarReader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		l.files = append(l.files, hdr.Name)
+	}
+}
+
+func TestImportFromRemoteLoader(t *testing.T) {
+	registry := newTestRegistry(t)
+	img := newTestImageSchema2(t, map[string]string{"1": "1"})
+	registry.addImage("1.0", img)
+
+	i := &Importer{Remote: registry.remote(t, "ns/img", "1.0")}
+	assert.Equal(t, ErrNoLoader, i.ImportFromRemote(context.Background()))
+
+	loader := &testLoader{}
+	i.Loader = loader
+	require.NoError(t, i.ImportFromRemote(context.Background()))
+	assert.Contains(t, loader.files, "manifest.json")
+	assert.Contains(t, loader.files, "repositories")
+}
+
+func TestDockerLoader(t *testing.T) {
+	var loaded []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "POST" || !strings.HasSuffix(req.URL.Path, "/images/load") {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		loaded, _ = ioutil.ReadAll(req.Body)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	// No certificates in the directory, so TLS is not used
+	certsDir, err := ioutil.TempDir("", "certs")
+	require.NoError(t, err)
+	defer os.RemoveAll(certsDir)
+
+	loader, err := NewDockerLoader("tcp://"+serverHost(server), certsDir)
+	require.NoError(t, err)
+	require.NoError(t, loader.Load(context.Background(), strings.NewReader("image")))
+	assert.Equal(t, "image", string(loaded))
+}
+
+func TestDockerTLSFiles(t *testing.T) {
+	certsDir, err := ioutil.TempDir("", "certs")
+	require.NoError(t, err)
+	defer os.RemoveAll(certsDir)
+
+	_, _, _, ok := dockerTLSFiles("tcp://docker:2376", certsDir)
+	assert.False(t, ok)
+
+	for _, name := range []string{"cert.pem", "key.pem", "ca.pem"} {
+		require.NoError(t, ioutil.WriteFile(filepath.Join(certsDir, name), nil, 0600))
+	}
+
+	cert, key, ca, ok := dockerTLSFiles("tcp://docker:2376", certsDir)
+	assert.True(t, ok)
+	assert.Equal(t, filepath.Join(certsDir, "cert.pem"), cert)
+	assert.Equal(t, filepath.Join(certsDir, "key.pem"), key)
+	assert.Equal(t, filepath.Join(certsDir, "ca.pem"), ca)
+
+	// Unix sockets never use TLS
+	_, _, _, ok = dockerTLSFiles("unix:///var/run/docker.sock", certsDir)
+	assert.False(t, ok)
+}
@@ -0,0 +1,348 @@
+package importer
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/replicatedcom/harpoon/log"
+
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/manifest/schema1"
+	"github.com/docker/distribution/manifest/schema2"
+	"github.com/docker/docker/pkg/archive"
+	digest "github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+const (
+	ociBlobsDir  = "blobs"
+	ociIndexFile = "index.json"
+
+	// containerdImageNameAnnotation is read by `ctr import` for the full image name
+	containerdImageNameAnnotation = "io.containerd.image.name"
+)
+
+// ociLayout is an OCI image layout directory: oci-layout, index.json and blobs/<alg>/<hex>
+type ociLayout struct {
+	Dir string
+}
+
+func newOCILayout(dir string) (*ociLayout, error) {
+	if err := os.MkdirAll(filepath.Join(dir, ociBlobsDir, digest.Canonical.String()), 0755); err != nil {
+		return nil, errors.Wrapf(err, "failed to create OCI layout in %s", dir)
+	}
+
+	return &ociLayout{Dir: dir}, nil
+}
+
+func (l *ociLayout) blobPath(dgst digest.Digest) string {
+	return filepath.Join(l.Dir, ociBlobsDir, dgst.Algorithm().String(), dgst.Hex())
+}
+
+func (l *ociLayout) writeBlob(contents []byte) (digest.Digest, error) {
+	dgst := digest.FromBytes(contents)
+	if err := ioutil.WriteFile(l.blobPath(dgst), contents, 0644); err != nil {
+		return "", errors.Wrapf(err, "failed to write blob %s", dgst)
+	}
+	return dgst, nil
+}
+
+// writeIndex will write index.json, replacing any existing one, with the manifest as its only entry
+func (l *ociLayout) writeIndex(manifest ocispec.Descriptor) error {
+	layout, err := json.Marshal(ocispec.ImageLayout{Version: ocispec.ImageLayoutVersion})
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal oci-layout")
+	}
+	if err := ioutil.WriteFile(filepath.Join(l.Dir, ocispec.ImageLayoutFile), layout, 0644); err != nil {
+		return errors.Wrap(err, "failed to write oci-layout")
+	}
+
+	index := ocispec.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageIndex,
+		Manifests: []ocispec.Descriptor{manifest},
+	}
+	contents, err := json.Marshal(index)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal index")
+	}
+	if err := ioutil.WriteFile(filepath.Join(l.Dir, ociIndexFile), contents, 0644); err != nil {
+		return errors.Wrap(err, "failed to write index")
+	}
+
+	return nil
+}
+
+// SaveOCILayout pulls the image and writes it as an OCI image layout to dir, without loading it
+// into Docker.  Layers are kept as served by the registry.  A temp dir is used when dir is empty.
+// The path of the layout is returned.
+func (i *Importer) SaveOCILayout(ctx context.Context, dir string) (string, error) {
+	if dir == "" {
+		tempDir, err := ioutil.TempDir("", "harpoon-oci")
+		if err != nil {
+			return "", errors.Wrap(err, "failed to create layout dir")
+		}
+
+		if err := i.saveOCILayout(ctx, tempDir); err != nil {
+			os.RemoveAll(tempDir)
+			return "", err
+		}
+		return tempDir, nil
+	}
+
+	if err := i.saveOCILayout(ctx, dir); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+func (i *Importer) saveOCILayout(ctx context.Context, dir string) error {
+	layout, err := newOCILayout(dir)
+	if err != nil {
+		return err
+	}
+
+	if i.Remote.PreferredProto == "v1" {
+		localStore, err := i.PullImageV1(ctx)
+		if localStore != nil {
+			defer localStore.delete()
+		}
+		if err != nil {
+			return err
+		}
+		return i.saveStoreToLayout(layout, localStore)
+	}
+
+	rawManifest, mediaType, ref, err := i.resolveManifest(ctx)
+	if err != nil {
+		return err
+	}
+
+	switch mediaType {
+	case schema2.MediaTypeManifest:
+		manifest, err := verifySchema2Manifest(rawManifest, ref)
+		if err != nil {
+			return errors.Wrap(err, "failed to verify schema2 manifest")
+		}
+		return i.saveManifestToLayout(ctx, layout, rawManifest, mediaType, manifest.Config, manifest.Layers)
+	case ocispec.MediaTypeImageManifest:
+		manifest, err := verifyOCIManifest(rawManifest, ref)
+		if err != nil {
+			return errors.Wrap(err, "failed to verify OCI manifest")
+		}
+		return i.saveManifestToLayout(ctx, layout, rawManifest, mediaType, manifest.Config, manifest.Layers)
+	case schema1.MediaTypeSignedManifest, schema1.MediaTypeManifest:
+		// schema1 has no config blob, so the manifest is rebuilt from the docker-save store
+		localStore, err := i.pullImageV2ManifestV1(ctx, rawManifest)
+		if localStore != nil {
+			defer localStore.delete()
+		}
+		if err != nil {
+			return err
+		}
+		return i.saveStoreToLayout(layout, localStore)
+	default:
+		return errors.Errorf("unsupported manifest media type %q", mediaType)
+	}
+}
+
+// SaveOCIArchive pulls the image and writes it as an oci-archive, a tar of an OCI image layout,
+// to path.  A temp file is used when path is empty.  The path of the archive is returned.
+func (i *Importer) SaveOCIArchive(ctx context.Context, path string) (string, error) {
+	layoutDir, err := ioutil.TempDir("", "harpoon-oci")
+	if err != nil {
+		return "", errors.Wrap(err, "failed to create layout dir")
+	}
+	defer os.RemoveAll(layoutDir)
+
+	if err := i.saveOCILayout(ctx, layoutDir); err != nil {
+		return "", err
+	}
+
+	reader, err := archive.TarWithOptions(layoutDir, &archive.TarOptions{Compression: archive.Uncompressed})
+	if err != nil {
+		return "", errors.Wrap(err, "failed to archive OCI layout")
+	}
+	defer reader.Close()
+
+	var file *os.File
+	if path == "" {
+		file, err = ioutil.TempFile("", "harpoon-*.oci.tar")
+	} else {
+		file, err = os.Create(path)
+	}
+	if err != nil {
+		return "", errors.Wrap(err, "failed to create archive")
+	}
+
+	log.Debugf("Writing OCI archive to %s", file.Name())
+
+	if _, err := io.Copy(file, reader); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return "", errors.Wrap(err, "failed to write archive")
+	}
+
+	if err := file.Close(); err != nil {
+		os.Remove(file.Name())
+		return "", errors.Wrap(err, "failed to close archive")
+	}
+
+	return file.Name(), nil
+}
+
+// saveManifestToLayout will download the config and layers of a schema2 or OCI manifest into the
+// layout.  The manifest is stored unchanged, so its digest matches the one in the registry.
+func (i *Importer) saveManifestToLayout(ctx context.Context, layout *ociLayout, rawManifest []byte, mediaType string, configDescriptor distribution.Descriptor, layers []distribution.Descriptor) error {
+	rawConfig, err := i.getConfigBlob(ctx, configDescriptor.Digest)
+	if err != nil {
+		return errors.Wrap(err, "failed to get image config")
+	}
+
+	if _, err := layout.writeBlob(rawConfig); err != nil {
+		return err
+	}
+
+	for _, descriptor := range layers {
+		if !isSupportedLayerMediaType(descriptor.MediaType) {
+			return errors.Errorf("unsupported layer media type %q", descriptor.MediaType)
+		}
+	}
+
+	// Layers can be listed more than once, like empty layers, and each blob is written by one download
+	digests := []digest.Digest{}
+	seen := map[digest.Digest]bool{}
+	for _, descriptor := range layers {
+		if !seen[descriptor.Digest] {
+			seen[descriptor.Digest] = true
+			digests = append(digests, descriptor.Digest)
+		}
+	}
+
+	err = i.runDownloads(ctx, len(digests), func(j int) error {
+		if err := i.downloadBlobTo(ctx, digests[j], layout.blobPath(digests[j])); err != nil {
+			return errors.Wrapf(err, "failed to download layer %s", digests[j])
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	manifestDigest, err := layout.writeBlob(rawManifest)
+	if err != nil {
+		return err
+	}
+
+	return layout.writeIndex(i.layoutDescriptor(mediaType, manifestDigest, int64(len(rawManifest))))
+}
+
+// saveStoreToLayout will move the layers of a docker-save store into the layout.  This is used for
+// images without a config blob, schema1 and v1, so the layers are stored uncompressed under their
+// diff ids.
+func (i *Importer) saveStoreToLayout(layout *ociLayout, localStore *v1Store) error {
+	rawManifestItems, err := ioutil.ReadFile(filepath.Join(localStore.Workspace, "manifest.json"))
+	if err != nil {
+		return errors.Wrap(err, "failed to read manifest file")
+	}
+
+	var manifestItems []manifestItem
+	if err := json.Unmarshal(rawManifestItems, &manifestItems); err != nil {
+		return errors.Wrap(err, "failed to unmarshal manifest file")
+	}
+	if len(manifestItems) != 1 {
+		return errors.Errorf("expected one image in store, found %d", len(manifestItems))
+	}
+
+	rawConfig, err := ioutil.ReadFile(filepath.Join(localStore.Workspace, manifestItems[0].Config))
+	if err != nil {
+		return errors.Wrap(err, "failed to read image config")
+	}
+
+	configDigest, err := layout.writeBlob(rawConfig)
+	if err != nil {
+		return err
+	}
+
+	manifest := ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config: ocispec.Descriptor{
+			MediaType: ocispec.MediaTypeImageConfig,
+			Digest:    configDigest,
+			Size:      int64(len(rawConfig)),
+		},
+	}
+
+	for _, layerPath := range manifestItems[0].Layers {
+		layerPath = filepath.Join(localStore.Workspace, layerPath)
+
+		diffID, size, err := digestFile(layerPath)
+		if err != nil {
+			return err
+		}
+
+		// The store is deleted afterwards, so the layer is moved rather than copied
+		if err := os.Rename(layerPath, layout.blobPath(diffID)); err != nil {
+			return errors.Wrapf(err, "failed to move layer %s", diffID)
+		}
+
+		manifest.Layers = append(manifest.Layers, ocispec.Descriptor{
+			MediaType: ocispec.MediaTypeImageLayer,
+			Digest:    diffID,
+			Size:      size,
+		})
+	}
+
+	rawManifest, err := json.Marshal(manifest)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal manifest")
+	}
+
+	manifestDigest, err := layout.writeBlob(rawManifest)
+	if err != nil {
+		return err
+	}
+
+	return layout.writeIndex(i.layoutDescriptor(ocispec.MediaTypeImageManifest, manifestDigest, int64(len(rawManifest))))
+}
+
+// layoutDescriptor returns the index.json entry for the manifest, annotated with the image name
+func (i *Importer) layoutDescriptor(mediaType string, manifestDigest digest.Digest, size int64) ocispec.Descriptor {
+	descriptor := ocispec.Descriptor{
+		MediaType: mediaType,
+		Digest:    manifestDigest,
+		Size:      size,
+		Annotations: map[string]string{
+			containerdImageNameAnnotation: i.Remote.Ref.String(),
+		},
+	}
+
+	if i.Remote.Tag != "" {
+		descriptor.Annotations[ocispec.AnnotationRefName] = i.Remote.Tag
+	}
+
+	return descriptor
+}
+
+func digestFile(path string) (digest.Digest, int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", 0, errors.Wrapf(err, "failed to open %s", path)
+	}
+	defer file.Close()
+
+	digester := digest.Canonical.Digester()
+	size, err := io.Copy(digester.Hash(), file)
+	if err != nil {
+		return "", 0, errors.Wrapf(err, "failed to read %s", path)
+	}
+
+	return digester.Digest(), size, nil
+}
@@ -0,0 +1,160 @@
+package importer
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func readLayoutIndex(t *testing.T, dir string) ocispec.Descriptor {
+	layout, err := ioutil.ReadFile(filepath.Join(dir, ocispec.ImageLayoutFile))
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"imageLayoutVersion":"1.0.0"}`, string(layout))
+
+	rawIndex, err := ioutil.ReadFile(filepath.Join(dir, "index.json"))
+	require.NoError(t, err)
+	var index ocispec.Index
+	require.NoError(t, json.Unmarshal(rawIndex, &index))
+	require.Len(t, index.Manifests, 1)
+
+	return index.Manifests[0]
+}
+
+func readLayoutBlob(t *testing.T, dir string, dgst digest.Digest) []byte {
+	contents, err := ioutil.ReadFile(filepath.Join(dir, "blobs", dgst.Algorithm().String(), dgst.Hex()))
+	require.NoError(t, err)
+	assert.Equal(t, dgst, digest.FromBytes(contents))
+	return contents
+}
+
+func TestSaveOCILayout(t *testing.T) {
+	registry := newTestRegistry(t)
+	img := newTestImageSchema2(t, map[string]string{"1": "1"}, map[string]string{"2": "2"})
+	registry.addImage("1.0", img)
+
+	dir, err := ioutil.TempDir("", "layout")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	i := &Importer{Remote: registry.remote(t, "ns/img", "1.0")}
+	path, err := i.SaveOCILayout(context.Background(), dir)
+	require.NoError(t, err)
+	assert.Equal(t, dir, path)
+
+	descriptor := readLayoutIndex(t, dir)
+	assert.Equal(t, img.MediaType, descriptor.MediaType)
+	assert.Equal(t, digest.FromBytes(img.Manifest), descriptor.Digest)
+	assert.Equal(t, "1.0", descriptor.Annotations[ocispec.AnnotationRefName])
+	assert.Equal(t, registry.Host()+"/ns/img:1.0", descriptor.Annotations[containerdImageNameAnnotation])
+
+	// The manifest and blobs are stored as served by the registry
+	assert.Equal(t, img.Manifest, readLayoutBlob(t, dir, descriptor.Digest))
+	assert.Equal(t, img.Config, readLayoutBlob(t, dir, digest.FromBytes(img.Config)))
+	for _, l := range img.Layers {
+		assert.Equal(t, l, readLayoutBlob(t, dir, digest.FromBytes(l)))
+	}
+}
+
+func TestSaveOCILayoutRepeatedLayer(t *testing.T) {
+	registry := newTestRegistry(t)
+	img := newTestImageSchema2(t, map[string]string{}, map[string]string{"1": "1"}, map[string]string{}, map[string]string{})
+	require.Equal(t, img.Layers[0], img.Layers[2])
+	registry.addImage("1.0", img)
+
+	dir, err := ioutil.TempDir("", "layout")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	i := &Importer{Remote: registry.remote(t, "ns/img", "1.0"), MaxConcurrentDownloads: 3}
+	_, err = i.SaveOCILayout(context.Background(), dir)
+	require.NoError(t, err)
+
+	// The repeated layer is downloaded once
+	for _, l := range img.Layers {
+		assert.Equal(t, l, readLayoutBlob(t, dir, digest.FromBytes(l)))
+	}
+	blobPaths := 0
+	for _, path := range registry.paths {
+		if strings.Contains(path, "/blobs/") {
+			blobPaths++
+		}
+	}
+	assert.Equal(t, 3, blobPaths)
+}
+
+func TestSaveOCILayoutSchema1(t *testing.T) {
+	registry := newTestRegistry(t)
+	img := newTestImageSchema1(t, map[string]string{"1": "1"}, map[string]string{}, map[string]string{"2": "2"})
+	registry.addImage("1.0", img)
+
+	i := &Importer{Remote: registry.remote(t, "ns/img", "1.0")}
+	dir, err := i.SaveOCILayout(context.Background(), "")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	descriptor := readLayoutIndex(t, dir)
+	assert.Equal(t, ocispec.MediaTypeImageManifest, descriptor.MediaType)
+
+	var manifest ocispec.Manifest
+	require.NoError(t, json.Unmarshal(readLayoutBlob(t, dir, descriptor.Digest), &manifest))
+
+	var config ocispec.Image
+	require.NoError(t, json.Unmarshal(readLayoutBlob(t, dir, manifest.Config.Digest), &config))
+	assert.Equal(t, img.DiffIDs, config.RootFS.DiffIDs)
+
+	// Layers are stored uncompressed under their diff ids
+	require.Len(t, manifest.Layers, len(img.DiffIDs))
+	for j, l := range manifest.Layers {
+		assert.Equal(t, ocispec.MediaTypeImageLayer, l.MediaType)
+		assert.Equal(t, img.DiffIDs[j], l.Digest)
+		readLayoutBlob(t, dir, l.Digest)
+	}
+}
+
+func TestSaveOCIArchive(t *testing.T) {
+	registry := newTestRegistry(t)
+	img := newTestImageOCI(t, ocispec.MediaTypeImageLayerGzip, "amd64", map[string]string{"1": "1"})
+	registry.addImage("1.0", img)
+
+	i := &Importer{Remote: registry.remote(t, "ns/img", "1.0")}
+	path, err := i.SaveOCIArchive(context.Background(), "")
+	require.NoError(t, err)
+	defer os.Remove(path)
+
+	file, err := os.Open(path)
+	require.NoError(t, err)
+	defer file.Close()
+
+	names := []string{}
+	tarReader := tar.NewReader(file)
+	for {
+		hdr, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		if hdr.Typeflag == tar.TypeReg {
+			names = append(names, hdr.Name)
+		}
+	}
+
+	manifestDigest := digest.FromBytes(img.Manifest)
+	assert.ElementsMatch(t, []string{
+		"oci-layout",
+		"index.json",
+		"blobs/sha256/" + manifestDigest.Hex(),
+		"blobs/sha256/" + digest.FromBytes(img.Config).Hex(),
+		"blobs/sha256/" + digest.FromBytes(img.Layers[0]).Hex(),
+	}, names)
+}
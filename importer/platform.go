@@ -0,0 +1,61 @@
+package importer
+
+import (
+	"encoding/json"
+
+	"github.com/replicatedcom/harpoon/log"
+
+	"github.com/containerd/containerd/platforms"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// platform returns the requested platform, or the host platform if none was requested
+func (i *Importer) platform() (ocispec.Platform, error) {
+	if i.Platform == "" {
+		return platforms.DefaultSpec(), nil
+	}
+
+	platform, err := platforms.Parse(i.Platform)
+	if err != nil {
+		return ocispec.Platform{}, errors.Wrapf(err, "invalid platform %q", i.Platform)
+	}
+
+	return platform, nil
+}
+
+// checkConfigPlatform compares the platform in an image config with the requested platform.  Like
+// docker, an image for another platform is refused when a platform was requested, and only warned
+// about when it defaults to the host platform.  Configs without an os or architecture are accepted.
+func (i *Importer) checkConfigPlatform(rawConfig []byte) error {
+	var config ocispec.Image
+	if err := json.Unmarshal(rawConfig, &config); err != nil {
+		return errors.Wrap(err, "failed to parse image config")
+	}
+	if config.OS == "" || config.Architecture == "" {
+		return nil
+	}
+
+	platform, err := i.platform()
+	if err != nil {
+		return err
+	}
+
+	imagePlatform := ocispec.Platform{OS: config.OS, Architecture: config.Architecture, Variant: config.Variant}
+	if platforms.Only(platform).Match(imagePlatform) {
+		return nil
+	}
+
+	if i.Platform == "" {
+		log.Warningf("The image platform %s does not match the host platform %s", formatPlatform(&imagePlatform), platforms.Format(platform))
+		return nil
+	}
+	return errors.Errorf("image platform %s does not match the requested platform %s", formatPlatform(&imagePlatform), platforms.Format(platform))
+}
+
+func formatPlatform(platform *ocispec.Platform) string {
+	if platform == nil {
+		return "unknown"
+	}
+	return platforms.Format(*platform)
+}
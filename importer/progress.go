@@ -0,0 +1,94 @@
+package importer
+
+import (
+	"io"
+)
+
+// ProgressEventType is the kind of progress a ProgressEvent reports
+type ProgressEventType string
+
+const (
+	// ProgressManifestFetched is sent once the image manifest is fetched.  ID is the manifest digest.
+	ProgressManifestFetched ProgressEventType = "manifest fetched"
+	// ProgressLayerStarted is sent when a layer starts downloading or streaming
+	ProgressLayerStarted ProgressEventType = "layer started"
+	// ProgressLayerBytes is sent as layer data is transferred, with Current and Total set
+	ProgressLayerBytes ProgressEventType = "bytes transferred"
+	// ProgressLayerVerified is sent once the layer matches its digest, or for v1 registries, which
+	// serve no digest, once the whole layer was read
+	ProgressLayerVerified ProgressEventType = "layer verified"
+	// ProgressLayerExtracted is sent once the uncompressed layer is written to the image store
+	ProgressLayerExtracted ProgressEventType = "layer extracted"
+	// ProgressLoadFinished is sent once the Loader has loaded the image
+	ProgressLoadFinished ProgressEventType = "load finished"
+)
+
+// ProgressEvent reports the progress of a pull, stream or load
+type ProgressEvent struct {
+	Type ProgressEventType
+
+	// ID identifies the layer, by blob digest or, for v1 registries, by image ID
+	ID string
+
+	// Current is the number of bytes of the layer transferred so far.  Total is the size of the
+	// layer, or -1 when it is not known.
+	Current int64
+	Total   int64
+}
+
+// ProgressFunc receives progress events.  Calls are not made concurrently.
+type ProgressFunc func(event ProgressEvent)
+
+func (i *Importer) progress(eventType ProgressEventType, id string, current, total int64) {
+	if i.Progress == nil {
+		return
+	}
+
+	i.progressMu.Lock()
+	defer i.progressMu.Unlock()
+
+	i.Progress(ProgressEvent{
+		Type:    eventType,
+		ID:      id,
+		Current: current,
+		Total:   total,
+	})
+}
+
+// progressReader reports ProgressLayerBytes events for the data read through it
+type progressReader struct {
+	io.Reader
+	importer *Importer
+	id       string
+	current  int64
+	total    int64
+}
+
+// newProgressReader counts the data read through reader, starting from current bytes of total
+func (i *Importer) newProgressReader(reader io.Reader, id string, current, total int64) io.Reader {
+	if i.Progress == nil {
+		return reader
+	}
+
+	return &progressReader{
+		Reader:   reader,
+		importer: i,
+		id:       id,
+		current:  current,
+		total:    total,
+	}
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if n > 0 {
+		r.current += int64(n)
+		r.importer.progress(ProgressLayerBytes, r.id, r.current, r.total)
+	}
+	return n, err
+}
+
+type progressReadCloser struct {
+	io.Reader
+	io.Closer
+}
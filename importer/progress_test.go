@@ -0,0 +1,94 @@
+package importer
+
+import (
+	"context"
+	"testing"
+
+	digest "github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// recordProgress returns a ProgressFunc that appends the events to events
+func recordProgress(events *[]ProgressEvent) ProgressFunc {
+	return func(event ProgressEvent) {
+		*events = append(*events, event)
+	}
+}
+
+// assertLayerProgress checks the order of the events for the layer, and that the bytes add up
+func assertLayerProgress(t *testing.T, events []ProgressEvent, id string, size int64, expect ...ProgressEventType) {
+	var types []ProgressEventType
+	var last ProgressEvent
+	for _, event := range events {
+		if event.ID != id {
+			continue
+		}
+		if event.Type == ProgressLayerBytes {
+			assert.True(t, event.Current > last.Current || last.Type != ProgressLayerBytes)
+			last = event
+			if len(types) > 0 && types[len(types)-1] == ProgressLayerBytes {
+				continue
+			}
+		}
+		types = append(types, event.Type)
+	}
+
+	assert.Equal(t, expect, types)
+	assert.Equal(t, size, last.Current)
+	assert.Equal(t, size, last.Total)
+}
+
+func TestPullImageProgress(t *testing.T) {
+	registry := newTestRegistry(t)
+	img := newTestImageSchema2(t, map[string]string{"1": "1"}, map[string]string{"2": "2"})
+	registry.addImage("1.0", img)
+
+	var events []ProgressEvent
+	i := &Importer{
+		Remote:   registry.remote(t, "ns/img", "1.0"),
+		Progress: recordProgress(&events),
+		Loader:   &testLoader{},
+	}
+	require.NoError(t, i.ImportFromRemote(context.Background()))
+
+	require.NotEmpty(t, events)
+	assert.Equal(t, ProgressEvent{Type: ProgressManifestFetched, ID: digest.FromBytes(img.Manifest).String(), Total: -1}, events[0])
+	assert.Equal(t, ProgressLoadFinished, events[len(events)-1].Type)
+
+	for _, blob := range img.Layers {
+		assertLayerProgress(t, events, digest.FromBytes(blob).String(), int64(len(blob)),
+			ProgressLayerStarted, ProgressLayerBytes, ProgressLayerVerified, ProgressLayerExtracted)
+	}
+
+	// The config is not a layer
+	for _, event := range events {
+		assert.NotEqual(t, digest.FromBytes(img.Config).String(), event.ID)
+	}
+}
+
+func TestStreamImageProgress(t *testing.T) {
+	registry := newTestRegistry(t)
+	img := newTestImageSchema2(t, map[string]string{"1": "1"}, map[string]string{"2": "2"})
+	registry.addImage("1.0", img)
+
+	var sent, received []ProgressEvent
+	sender := &Importer{Remote: registry.remote(t, "ns/img", "1.0"), Progress: recordProgress(&sent)}
+	stream, err := sender.StreamLayers(context.Background())
+	require.NoError(t, err)
+	defer stream.Close()
+
+	receiver := &Importer{Progress: recordProgress(&received)}
+	localStore, err := receiver.streamToTempStore(context.Background(), stream, registry.Host()+"/ns/img:1.0")
+	if localStore != nil {
+		defer localStore.delete()
+	}
+	require.NoError(t, err)
+
+	for _, blob := range img.Layers {
+		id := digest.FromBytes(blob).String()
+		assertLayerProgress(t, sent, id, int64(len(blob)), ProgressLayerStarted, ProgressLayerBytes)
+		assertLayerProgress(t, received, id, int64(len(blob)),
+			ProgressLayerStarted, ProgressLayerBytes, ProgressLayerVerified, ProgressLayerExtracted)
+	}
+}
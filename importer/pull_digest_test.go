@@ -0,0 +1,83 @@
+package importer
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/replicatedcom/harpoon/remote"
+
+	digest "github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// remoteByDigest returns a remote for repo pinned to dgst, with a tag if one is given
+func (r *testRegistry) remoteByDigest(t *testing.T, repo, tag string, dgst digest.Digest) *remote.DockerRemote {
+	uri := "docker://" + r.Host() + "/" + repo
+	if tag != "" {
+		uri += ":" + tag
+	}
+	dockerRemote, err := remote.ParseDockerURI(uri + "@" + dgst.String())
+	require.NoError(t, err)
+	trustTestServers(t, dockerRemote)
+
+	return dockerRemote
+}
+
+func TestPullImageByDigest(t *testing.T) {
+	registry := newTestRegistry(t)
+	img := newTestImageSchema2(t, map[string]string{"1": "1"})
+	registry.addImage("1.0", img)
+	other := newTestImageSchema2(t, map[string]string{"2": "2"})
+	registry.addImage("2.0", other)
+
+	tests := []struct {
+		name     string
+		tag      string
+		repoTags []string
+	}{
+		{name: "digest", repoTags: nil},
+		{name: "tag and digest", tag: "1.0", repoTags: []string{registry.Host() + "/ns/img:1.0"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			i := &Importer{Remote: registry.remoteByDigest(t, "ns/img", test.tag, digest.FromBytes(img.Manifest))}
+			localStore, err := i.PullImage(context.Background())
+			if localStore != nil {
+				defer localStore.delete()
+			}
+			require.NoError(t, err)
+			assertStoreImage(t, localStore, img)
+
+			contents, err := os.ReadFile(filepath.Join(localStore.Workspace, "manifest.json"))
+			require.NoError(t, err)
+			var manifest []manifestItem
+			require.NoError(t, json.Unmarshal(contents, &manifest))
+			assert.Equal(t, test.repoTags, manifest[0].RepoTags)
+
+			_, err = os.Stat(filepath.Join(localStore.Workspace, "repositories"))
+			assert.Equal(t, test.tag == "", os.IsNotExist(err))
+		})
+	}
+}
+
+func TestPullImageByDigestMismatch(t *testing.T) {
+	registry := newTestRegistry(t)
+	img := newTestImageSchema2(t, map[string]string{"1": "1"})
+	registry.addImage("1.0", img)
+	other := newTestImageSchema2(t, map[string]string{"2": "2"})
+
+	// The registry serves img for other's digest
+	registry.manifests[digest.FromBytes(other.Manifest).String()] = registry.manifests["1.0"]
+
+	i := &Importer{Remote: registry.remoteByDigest(t, "ns/img", "", digest.FromBytes(other.Manifest))}
+	localStore, err := i.PullImage(context.Background())
+	if localStore != nil {
+		defer localStore.delete()
+	}
+	require.Error(t, err)
+}
@@ -1,6 +1,7 @@
 package importer
 
 import (
+	"context"
 	"os"
 	"testing"
 
@@ -19,12 +20,12 @@ func TestIsSupportedProtocol(t *testing.T) {
 	var ok bool
 
 	i.Remote.PreferredProto = "v1"
-	ok, err = i.isSupportedProtocol()
+	ok, err = i.isSupportedProtocol(context.Background())
 	require.NoError(t, err)
 	assert.True(t, ok)
 
 	i.Remote.PreferredProto = "v2"
-	ok, err = i.isSupportedProtocol()
+	ok, err = i.isSupportedProtocol(context.Background())
 	require.NoError(t, err)
 	assert.True(t, ok)
 }
@@ -42,13 +43,35 @@ func TestPullImagePrivate(t *testing.T) {
 	dockerRemote.Username = username
 	dockerRemote.Password = password
 	dockerRemote.PreferredProto = "v2"
+	loader, err := NewDockerLoaderFromParams()
+	require.NoError(t, err)
 	imageImporter := Importer{
 		Remote: dockerRemote,
+		Loader: loader,
 	}
-	readCloser, err := imageImporter.StreamLayers()
+	readCloser, err := imageImporter.StreamLayers(context.Background())
 	require.NotNil(t, readCloser)
 	defer readCloser.Close()
 
-	err = imageImporter.ImportFromStream(readCloser, image)
+	err = imageImporter.ImportFromStream(context.Background(), readCloser, image)
 	require.NoError(t, err)
 }
+
+func TestPullImageSchema1(t *testing.T) {
+	registry := newTestRegistry(t)
+	img := newTestImageSchema1(t,
+		map[string]string{"etc/hostname": "base"},
+		map[string]string{},
+		map[string]string{"app/main": "app"},
+	)
+	registry.addImage("1.0", img)
+
+	i := &Importer{Remote: registry.remote(t, "ns/img", "1.0")}
+	localStore, err := i.PullImage(context.Background())
+	if localStore != nil {
+		defer localStore.delete()
+	}
+	require.NoError(t, err)
+
+	assertStoreLayers(t, localStore, img.DiffIDs...)
+}
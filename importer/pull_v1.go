@@ -1,10 +1,310 @@
 package importer
 
-import "errors"
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
 
-// PullImageV1 will pull image from v1 (todo), using the proxy server at `proxy`, and will
-// ignore the cache if `force` is `true`.
-// TODO: Add auth info to args
-func (i *Importer) PullImageV1() (*v1Store, error) {
-	return nil, errors.New("pulling from v1 registry is not implemented")
+	"github.com/replicatedcom/harpoon/log"
+
+	"github.com/docker/docker/image"
+	v1 "github.com/docker/docker/image/v1"
+	"github.com/docker/docker/layer"
+	"github.com/docker/docker/pkg/archive"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+// PullImageV1 will pull image from a v1 registry.  The index is asked for the endpoints and token
+// to use, then the tag is resolved to an image ID and every image in its ancestry is downloaded,
+// MaxConcurrentDownloads layers at a time.  v1 layers have no digest, so they are not kept in the
+// Cache, and an interrupted layer download starts over instead of resuming.
+func (i *Importer) PullImageV1(ctx context.Context) (*v1Store, error) {
+	supported, err := i.isSupportedProtocol(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to check protocol support")
+	}
+	if !supported {
+		return nil, errors.New("Docker registry v1 protocol is not supported by remote")
+	}
+
+	if i.Remote.Digest != "" {
+		return nil, errors.New("Docker registry v1 protocol does not support pulling by digest")
+	}
+
+	if err := i.Remote.AuthV1(ctx); err != nil {
+		return nil, errors.Wrap(err, "failed to authenticate with v1 registry")
+	}
+
+	var lastErr error
+	for _, endpoint := range i.Remote.GetEndpointsV1() {
+		localStore, err := i.pullImageV1FromEndpoint(ctx, endpoint)
+		if err == nil {
+			return localStore, nil
+		}
+		if localStore != nil {
+			localStore.delete()
+		}
+		log.Infof("Failed to pull %s from v1 endpoint %s: %v", i.Remote.GetDisplayName(), endpoint, err)
+		lastErr = err
+	}
+
+	return nil, lastErr
+}
+
+func (i *Importer) pullImageV1FromEndpoint(ctx context.Context, endpoint string) (*v1Store, error) {
+	var imageID string
+	tagURI := fmt.Sprintf("%s://%s/v1/repositories/%s/tags/%s", i.Remote.Scheme(), endpoint, i.Remote.Repository, i.Remote.Tag)
+	if err := i.getJSONV1(ctx, tagURI, &imageID); err != nil {
+		return nil, errors.Wrap(err, "failed to resolve tag")
+	}
+
+	if err := v1.ValidateID(imageID); err != nil {
+		return nil, errors.Wrapf(err, "invalid image ID for tag %s", i.Remote.Tag)
+	}
+
+	// Ancestry starts with the image itself and ends with the base image
+	var ancestry []string
+	ancestryURI := fmt.Sprintf("%s://%s/v1/images/%s/ancestry", i.Remote.Scheme(), endpoint, imageID)
+	if err := i.getJSONV1(ctx, ancestryURI, &ancestry); err != nil {
+		return nil, errors.Wrap(err, "failed to get ancestry")
+	}
+
+	if len(ancestry) == 0 || ancestry[0] != imageID {
+		return nil, errors.Errorf("invalid ancestry for image %s", imageID)
+	}
+
+	localStore, err := newV1Store()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create v1 store")
+	}
+
+	// The json of every image is fetched first, base image first, so the layers can download in
+	// parallel
+	count := len(ancestry)
+	v1IDs := make([]string, count)
+	v1ImageJSONs := make([][]byte, count)
+	history := make([]image.History, 0, count)
+	for j := range v1IDs {
+		v1ID := ancestry[count-1-j]
+		if err := v1.ValidateID(v1ID); err != nil {
+			return localStore, errors.Wrapf(err, "invalid image ID in ancestry")
+		}
+
+		v1ImageJSON, err := i.getImageJSONV1(ctx, endpoint, v1ID)
+		if err != nil {
+			return localStore, err
+		}
+
+		h, err := v1.HistoryFromConfig(v1ImageJSON, false)
+		if err != nil {
+			return localStore, err
+		}
+		history = append(history, h)
+
+		v1IDs[j] = v1ID
+		v1ImageJSONs[j] = v1ImageJSON
+	}
+
+	// Create layer.tar, json, and VERSION files for each layer in a temp folder because v1 layer ID is not known ahead of time.
+	layerTempDirs := make([]string, count)
+	for j := range layerTempDirs {
+		layerTempDirs[j], err = ioutil.TempDir(localStore.Workspace, "tmp_layer")
+		if err != nil {
+			log.Error(err)
+			return localStore, err
+		}
+	}
+
+	diffIDs := make([]layer.DiffID, count)
+	err = i.runDownloads(ctx, count, func(j int) error {
+		diffID, err := i.downloadLayerV1(ctx, endpoint, v1IDs[j], layerTempDirs[j])
+		diffIDs[j] = diffID
+		return err
+	})
+	if err != nil {
+		return localStore, err
+	}
+
+	rootFS := image.NewRootFS()
+	var parent digest.Digest
+	layerV1IDs := make([]digest.Digest, 0, count)
+	for j, diffID := range diffIDs {
+		rootFS.Append(diffID) // rootFS must contain this layer ID to produce correct chain ID
+		v1Img := image.V1Image{}
+		if j == count-1 {
+			if err := json.Unmarshal(v1ImageJSONs[j], &v1Img); err != nil {
+				log.Error(err)
+				return localStore, err
+			}
+		}
+
+		layerV1ID, err := localStore.writeLayer(layerTempDirs[j], v1Img, rootFS.ChainID(), parent)
+		if err != nil {
+			return localStore, err
+		}
+
+		layerV1IDs = append(layerV1IDs, layerV1ID)
+		parent = layerV1ID
+	}
+
+	config, err := v1.MakeConfigFromV1Config(v1ImageJSONs[count-1], rootFS, history)
+	if err != nil {
+		return localStore, err
+	}
+
+	configID := image.ID(digest.FromBytes(config))
+
+	if err := localStore.writeConfigFile(configID, config); err != nil {
+		return localStore, err
+	}
+
+	if err := localStore.writeRepositoriesFile(i.Remote.Ref, configID); err != nil {
+		return localStore, err
+	}
+
+	if err := localStore.writeManifestFile(i.Remote.Ref, configID, layerV1IDs); err != nil {
+		return localStore, err
+	}
+
+	return localStore, nil
+}
+
+func (i *Importer) getJSONV1(ctx context.Context, uri string, v interface{}) error {
+	body, err := i.getBytesV1(ctx, uri)
+	if err != nil {
+		return err
+	}
+
+	if err := json.Unmarshal(body, v); err != nil {
+		return errors.Wrapf(err, "failed to unmarshal response from %s", uri)
+	}
+
+	return nil
+}
+
+func (i *Importer) getImageJSONV1(ctx context.Context, endpoint, v1ID string) ([]byte, error) {
+	uri := fmt.Sprintf("%s://%s/v1/images/%s/json", i.Remote.Scheme(), endpoint, v1ID)
+	body, err := i.getBytesV1(ctx, uri)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get json for image %s", v1ID)
+	}
+
+	var compat v1Compatibility
+	if err := json.Unmarshal(body, &compat); err != nil {
+		return nil, errors.Wrapf(err, "failed to unmarshal json for image %s", v1ID)
+	}
+	if compat.ID != v1ID {
+		return nil, errors.Errorf("registry returned json for image %q, but %q was requested", compat.ID, v1ID)
+	}
+
+	return body, nil
+}
+
+func (i *Importer) getBytesV1(ctx context.Context, uri string) ([]byte, error) {
+	log.Debugf("Get %s", uri)
+
+	req, err := i.Remote.NewHttpRequestV1(ctx, "GET", uri)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create request")
+	}
+
+	resp, err := i.Remote.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("unexpected status code for %s: %d", uri, resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read response body")
+	}
+
+	return body, nil
+}
+
+// downloadLayerV1 will download and write the layer to the layerDir, in the docker format.
+// v1 registries do not serve a digest for layers, so only the diff ID is computed, and the layer is
+// reported verified once it was read whole.  Interrupted downloads start over.
+func (i *Importer) downloadLayerV1(ctx context.Context, endpoint, v1ID, layerDir string) (layer.DiffID, error) {
+	i.progress(ProgressLayerStarted, v1ID, 0, -1)
+
+	attempts := i.Remote.Retry.Attempts()
+	var lastErr error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		diffID, retry, err := i.fetchLayerV1(ctx, endpoint, v1ID, layerDir)
+		if err == nil {
+			log.Debugf("Downloaded layer %s for image %s", diffID, v1ID)
+			i.progress(ProgressLayerVerified, v1ID, 0, -1)
+			i.progress(ProgressLayerExtracted, v1ID, 0, -1)
+			return diffID, nil
+		}
+		if !retry || ctx.Err() != nil {
+			return layer.DiffID(""), err
+		}
+
+		lastErr = err
+		if attempt == attempts {
+			break
+		}
+
+		log.Infof("Download of layer %s was interrupted, retrying: %v", v1ID, err)
+		if err := i.Remote.Retry.Wait(ctx, attempt, nil); err != nil {
+			return layer.DiffID(""), err
+		}
+	}
+
+	return layer.DiffID(""), errors.Wrapf(lastErr, "failed to download layer %s after %d attempts", v1ID, attempts)
+}
+
+// fetchLayerV1 will download the layer once, and reports whether a failure is worth retrying
+func (i *Importer) fetchLayerV1(ctx context.Context, endpoint, v1ID, layerDir string) (diffID layer.DiffID, retry bool, err error) {
+	uri := fmt.Sprintf("%s://%s/v1/images/%s/layer", i.Remote.Scheme(), endpoint, v1ID)
+
+	log.Debugf("Downloading layer from %q", uri)
+
+	req, err := i.Remote.NewHttpRequestV1(ctx, "GET", uri)
+	if err != nil {
+		return layer.DiffID(""), false, errors.Wrap(err, "failed to create request")
+	}
+
+	// Requests that fail outright were already retried by the remote
+	resp, err := i.Remote.Do(req)
+	if err != nil {
+		return layer.DiffID(""), false, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return layer.DiffID(""), false, errors.Errorf("unexpected status code for %s: %d", uri, resp.StatusCode)
+	}
+
+	decompressed, err := archive.DecompressStream(i.newProgressReader(resp.Body, v1ID, 0, resp.ContentLength))
+	if err != nil {
+		return layer.DiffID(""), true, errors.Wrap(err, "failed to create decompressing reader")
+	}
+	defer decompressed.Close()
+
+	target := filepath.Join(layerDir, "layer.tar")
+	writer, err := os.Create(target)
+	if err != nil {
+		return layer.DiffID(""), false, errors.Wrapf(err, "failed to create tar file %s", target)
+	}
+	defer writer.Close()
+
+	tarDigest := digest.Canonical.Digester()
+	if _, err := io.Copy(io.MultiWriter(writer, tarDigest.Hash()), decompressed); err != nil {
+		return layer.DiffID(""), true, errors.Wrapf(err, "failed to download layer %s", v1ID)
+	}
+
+	return layer.DiffID(tarDigest.Digest()), false, nil
 }
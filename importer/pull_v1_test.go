@@ -0,0 +1,99 @@
+package importer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPullImageV1(t *testing.T) {
+	baseID := strings.Repeat("a", 64)
+	topID := strings.Repeat("b", 64)
+	baseLayer, baseDiffID := newTestLayer(t, true, map[string]string{"etc/hostname": "base"})
+	topLayer, topDiffID := newTestLayer(t, false, map[string]string{"app/main": "app"})
+
+	images := map[string]struct {
+		json  string
+		layer []byte
+	}{
+		baseID: {json: fmt.Sprintf(`{"id":%q,"created":"2015-01-01T00:00:00Z"}`, baseID), layer: baseLayer},
+		topID:  {json: fmt.Sprintf(`{"id":%q,"parent":%q,"created":"2015-01-02T00:00:00Z","config":{"Cmd":["/bin/sh"]}}`, topID, baseID), layer: topLayer},
+	}
+
+	// The first download of the top layer is cut off half way
+	var mu sync.Mutex
+	dropped := false
+
+	var endpoint string
+	server := newTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch {
+		case req.URL.Path == "/v1/_ping":
+			w.WriteHeader(http.StatusOK)
+		case req.URL.Path == "/v1/repositories/ns/img/images":
+			assert.Equal(t, "true", req.Header.Get("X-Docker-Token"))
+			w.Header().Set("X-Docker-Token", "signature=abc,repository=\"ns/img\",access=read")
+			w.Header().Set("X-Docker-Endpoints", endpoint)
+			http.SetCookie(w, &http.Cookie{Name: "session", Value: "s1", Path: "/"})
+			w.WriteHeader(http.StatusOK)
+		default:
+			if req.Header.Get("Authorization") != "Token signature=abc,repository=\"ns/img\",access=read" || req.Header.Get("Cookie") != "session=s1" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			switch {
+			case req.URL.Path == "/v1/repositories/ns/img/tags/1.0":
+				json.NewEncoder(w).Encode(topID)
+			case req.URL.Path == fmt.Sprintf("/v1/images/%s/ancestry", topID):
+				json.NewEncoder(w).Encode([]string{topID, baseID})
+			case strings.HasSuffix(req.URL.Path, "/json"):
+				w.Write([]byte(images[strings.Split(req.URL.Path, "/")[3]].json))
+			case strings.HasSuffix(req.URL.Path, "/layer"):
+				id := strings.Split(req.URL.Path, "/")[3]
+				mu.Lock()
+				drop := id == topID && !dropped
+				dropped = dropped || drop
+				mu.Unlock()
+				if drop {
+					layer := images[id].layer
+					w.Header().Set("Content-Length", strconv.Itoa(len(layer)))
+					w.Write(layer[:len(layer)/2])
+					w.(http.Flusher).Flush()
+					panic(http.ErrAbortHandler)
+				}
+				w.Write(images[id].layer)
+			default:
+				w.WriteHeader(http.StatusNotFound)
+			}
+		}
+	}))
+	endpoint = serverHost(server)
+
+	dockerRemote := newTestRemote(t, serverHost(server), "ns/img", "1.0")
+	dockerRemote.PreferredProto = "v1"
+
+	var verified []string
+	i := &Importer{Remote: dockerRemote, Progress: func(event ProgressEvent) {
+		if event.Type == ProgressLayerVerified {
+			mu.Lock()
+			verified = append(verified, event.ID)
+			mu.Unlock()
+		}
+	}}
+	localStore, err := i.PullImage(context.Background())
+	if localStore != nil {
+		defer localStore.delete()
+	}
+	require.NoError(t, err)
+
+	assertStoreLayers(t, localStore, baseDiffID, topDiffID)
+	assert.True(t, dropped)
+	assert.ElementsMatch(t, []string{baseID, topID}, verified)
+}
@@ -1,9 +1,8 @@
 package importer
 
 import (
-	"archive/tar"
 	"bytes"
-	"compress/gzip"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -12,189 +11,347 @@ import (
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
+	"sync"
 
 	"github.com/replicatedcom/harpoon/log"
 	"github.com/replicatedcom/harpoon/remote"
 
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/manifest"
+	"github.com/docker/distribution/manifest/manifestlist"
 	"github.com/docker/distribution/manifest/schema1"
 	"github.com/docker/distribution/manifest/schema2"
 	"github.com/docker/distribution/reference"
 	"github.com/docker/docker/image"
 	v1 "github.com/docker/docker/image/v1"
 	"github.com/docker/docker/layer"
+	"github.com/docker/docker/pkg/archive"
 	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/pkg/errors"
 )
 
 const (
 	maxRetries       = 3
 	ManifestFileName = "_manifest.json"
+
+	// IndexFileName precedes the manifest in a layer stream when the image was resolved from a
+	// manifest list or an OCI index
+	IndexFileName = "_index.json"
 )
 
+// pullMediaTypes are the manifest media types accepted by PullImage, in order of preference.
+// Registries that can only serve schema1 will ignore the others.
+var pullMediaTypes = []string{
+	manifestlist.MediaTypeManifestList,
+	schema2.MediaTypeManifest,
+	ocispec.MediaTypeImageIndex,
+	ocispec.MediaTypeImageManifest,
+	schema1.MediaTypeSignedManifest,
+	schema1.MediaTypeManifest,
+}
+
 type Importer struct {
 	Remote *remote.DockerRemote
+
+	// Platform selects the image from a manifest list or an OCI index, in the os/arch[/variant]
+	// format.  Defaults to the host platform.  Single-platform images for another platform are
+	// refused when it is set, and only warned about otherwise.
+	Platform string
+
+	// MaxConcurrentDownloads limits the number of layers downloaded in parallel.
+	// Defaults to DefaultMaxConcurrentDownloads.
+	MaxConcurrentDownloads int
+
+	// Cache holds blobs from earlier pulls.  Blobs are always downloaded when it is nil.
+	Cache *BlobCache
+
+	// Loader receives the image from ImportFromRemote, ImportFromLocal and ImportFromStream.
+	// Saving the image to a file or an OCI layout does not use it.
+	Loader Loader
+
+	// Progress receives progress events when it is set
+	Progress   ProgressFunc
+	progressMu sync.Mutex
+}
+
+// StreamLayers streams the image in the format described in format_stream.md.  The stream is
+// written by a goroutine that stops when ctx is cancelled or the reader is closed.
+func (i *Importer) StreamLayers(ctx context.Context) (io.ReadCloser, error) {
+	return i.StreamLayersSkipping(ctx, nil)
 }
 
-func (i *Importer) StreamLayers() (io.ReadCloser, error) {
+// StreamLayersSkipping streams the image like StreamLayers, but leaves out the layers with a blob
+// digest or diff ID in held.  Only a reference to them is sent, and ImportFromStream fills them in
+// from the cache on the receiving side.  Receivers announce what they hold with LocalLayers.
+func (i *Importer) StreamLayersSkipping(ctx context.Context, held []digest.Digest) (io.ReadCloser, error) {
 	pipeReader, pipeWriter := io.Pipe()
-	go i.writeLayers(pipeWriter)
+	go i.writeLayers(ctx, pipeWriter, held)
 	return pipeReader, nil
 }
 
-func (i *Importer) writeLayers(pipeWriter *io.PipeWriter) {
-	tarWriter := tar.NewWriter(pipeWriter)
+// LocalLayers returns the blob digests and diff IDs of the layers this importer can fill in when
+// they are left out of a stream.  These come from the cache only, not from the images in the
+// Docker daemon, so nothing is held without one.
+func (i *Importer) LocalLayers() ([]digest.Digest, error) {
+	if i.Cache == nil {
+		return nil, nil
+	}
+	return i.Cache.Digests()
+}
 
-	var writeError error
-	defer func() {
-		pipeWriter.CloseWithError(writeError)
-		tarWriter.Close()
-	}()
+// writeLayers writes the stream to the pipe.  Cancelling ctx closes the pipe right away, so the
+// reader gets the error without waiting for a request in progress to notice.
+func (i *Importer) writeLayers(ctx context.Context, pipeWriter *io.PipeWriter, held []digest.Digest) {
+	stop := context.AfterFunc(ctx, func() {
+		pipeWriter.CloseWithError(ctx.Err())
+	})
+	defer stop()
 
-	supported, writeError := i.isSupportedProtocol()
-	if writeError != nil {
-		return
-	}
-	if !supported {
-		writeError = errors.New("Docker registry v2 protocol is not supported by remote")
-		return
+	err := i.writeStream(ctx, pipeWriter, held)
+	if err != nil {
+		log.Error(err)
 	}
+	pipeWriter.CloseWithError(err)
+}
 
-	i.Remote.AuthHeader = ""
-	// NOTE: v2 manifests not supported here
-	rawManifest, _, writeError := i.GetManifestBytes(schema1.MediaTypeManifest) // schema1.MediaTypeSignedManifest
-	if writeError != nil {
-		log.Error(writeError)
-		return
+// writeStream will write the image in the layer stream format described in format_stream.md
+func (i *Importer) writeStream(ctx context.Context, writer io.Writer, held []digest.Digest) error {
+	rawManifest, mediaType, err := i.getManifest(ctx)
+	if err != nil {
+		return err
 	}
 
-	writeError = i.writeLayersV1(tarWriter, rawManifest)
-	return
-}
+	header := streamHeader{Version: StreamFormatVersion}
+
+	// The receiver gets the whole index to verify the manifest against an index digest reference
+	var rawIndex []byte
+	ref := i.Remote.Ref
+	if mediaType == ocispec.MediaTypeImageIndex || mediaType == manifestlist.MediaTypeManifestList {
+		rawIndex = rawManifest
+		header.Entries = append(header.Entries, streamEntry{Name: IndexFileName, MediaType: mediaType, Size: int64(len(rawIndex))})
 
-func (i *Importer) writeLayersV1(tarWriter *tar.Writer, rawManifest []byte) error {
-	tarHeader := &tar.Header{
-		Name: ManifestFileName,
-		// Mode: 0655,
-		Size: int64(len(rawManifest)),
+		rawManifest, mediaType, err = i.resolveIndex(ctx, rawIndex, mediaType)
+		if err != nil {
+			return err
+		}
+		ref = reference.TrimNamed(ref)
 	}
-	if err := tarWriter.WriteHeader(tarHeader); err != nil {
-		log.Error(err)
+
+	i.progress(ProgressManifestFetched, digest.FromBytes(rawManifest).String(), 0, -1)
+
+	header.MediaType = mediaType
+	header.Entries = append(header.Entries, streamEntry{Name: ManifestFileName, MediaType: mediaType, Size: int64(len(rawManifest))})
+
+	blobs, rawConfig, err := i.streamBlobs(ctx, rawManifest, mediaType, ref)
+	if err != nil {
 		return err
 	}
 
-	if _, err := tarWriter.Write(rawManifest); err != nil {
-		log.Error(err)
-		return err
+	isHeld := make(map[digest.Digest]bool, len(held))
+	for _, dgst := range held {
+		isHeld[dgst] = true
 	}
+	for j, blob := range blobs {
+		if !isSupportedLayerMediaType(blob.MediaType) {
+			continue
+		}
+		if isHeld[digest.Digest(blob.Name)] || (blob.DiffID != "" && isHeld[blob.DiffID]) {
+			log.Debugf("Receiver holds layer %s, sending a reference", blob.Name)
+			blobs[j].Reference = true
+			blobs[j].Size = 0
+		}
+	}
+	header.Entries = append(header.Entries, blobs...)
 
-	var manifest schema1.SignedManifest
-	if err := json.Unmarshal(rawManifest, &manifest); err != nil {
-		log.Error(err)
+	stream, err := newStreamWriter(writer, header)
+	if err != nil {
 		return err
 	}
 
-	// Send layers in reverse because import needs to read them in reverse order
-	for j := len(manifest.FSLayers) - 1; j >= 0; j-- {
-		layer := manifest.FSLayers[j]
+	files := map[string][]byte{
+		IndexFileName:    rawIndex,
+		ManifestFileName: rawManifest,
+	}
+	if rawConfig != nil {
+		files[digest.FromBytes(rawConfig).String()] = rawConfig
+	}
 
-		blobStream, expectedLenght, err := i.getBlobStream(layer.BlobSum)
+	for _, entry := range header.Entries {
+		contents, isFile := files[entry.Name]
+		switch {
+		case entry.Reference:
+			err = stream.writeEntry(entry.Name, bytes.NewReader(nil))
+		case isFile:
+			err = stream.writeEntry(entry.Name, bytes.NewReader(contents))
+		default:
+			err = i.writeBlobToStream(ctx, stream, digest.Digest(entry.Name))
+		}
 		if err != nil {
-			return errors.Wrap(err, "failed to unmarshal manifest")
+			return err
 		}
-		defer blobStream.Close() // ok to keep open until func terminates
+	}
+
+	return stream.close()
+}
 
-		tarHeader := &tar.Header{
-			Name: layer.BlobSum.String(),
-			Size: expectedLenght,
+// streamBlobs returns the blobs of the manifest in the order they are streamed.  For schema2 and
+// OCI manifests the config comes first, and is returned so the layers can be listed with their
+// diff IDs.  Layers follow, base layer first, because import needs to read them in that order.
+func (i *Importer) streamBlobs(ctx context.Context, rawManifest []byte, mediaType string, ref reference.Named) ([]streamEntry, []byte, error) {
+	switch mediaType {
+	case schema2.MediaTypeManifest:
+		manifest, err := verifySchema2Manifest(rawManifest, ref)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "failed to verify schema2 manifest")
 		}
-		if err := tarWriter.WriteHeader(tarHeader); err != nil {
-			log.Error(err)
-			return err
+		return i.configStreamBlobs(ctx, manifest.Config, manifest.Layers)
+	case ocispec.MediaTypeImageManifest:
+		manifest, err := verifyOCIManifest(rawManifest, ref)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "failed to verify OCI manifest")
+		}
+		return i.configStreamBlobs(ctx, manifest.Config, manifest.Layers)
+	case schema1.MediaTypeSignedManifest, schema1.MediaTypeManifest:
+		manifest, err := parseSchema1Manifest(rawManifest, ref)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "failed to verify schema1 manifest")
 		}
 
-		if _, err := io.Copy(tarWriter, blobStream); err != nil {
-			log.Error(err)
-			return err
+		// schema1 manifests do not have the sizes of the layers
+		entries := make([]streamEntry, 0, len(manifest.FSLayers))
+		for j := len(manifest.FSLayers) - 1; j >= 0; j-- {
+			blobsum := manifest.FSLayers[j].BlobSum
+			size, err := i.getBlobSize(ctx, blobsum)
+			if err != nil {
+				return nil, nil, err
+			}
+			entries = append(entries, streamEntry{Name: blobsum.String(), MediaType: schema2.MediaTypeLayer, Size: size})
 		}
+		return entries, nil, nil
+	default:
+		return nil, nil, errors.Errorf("unsupported manifest media type %q", mediaType)
 	}
-
-	return nil
 }
 
-func (i *Importer) writeLayersV2(tarWriter *tar.Writer, rawManifest []byte) error {
-	tarHeader := &tar.Header{
-		Name: ManifestFileName,
-		// Mode: 0655,
-		Size: int64(len(rawManifest)),
-	}
-	if err := tarWriter.WriteHeader(tarHeader); err != nil {
-		log.Error(err)
-		return err
+func (i *Importer) configStreamBlobs(ctx context.Context, configDescriptor distribution.Descriptor, layers []distribution.Descriptor) ([]streamEntry, []byte, error) {
+	rawConfig, err := i.getConfigBlob(ctx, configDescriptor.Digest)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to get image config")
 	}
 
-	if _, err := tarWriter.Write(rawManifest); err != nil {
-		log.Error(err)
-		return err
+	img, err := newImageFromConfig(rawConfig, layers)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	var manifest schema2.DeserializedManifest
-	if err := json.Unmarshal(rawManifest, &manifest); err != nil {
-		log.Error(err)
-		return err
+	entries := []streamEntry{{
+		Name:      configDescriptor.Digest.String(),
+		MediaType: configDescriptor.MediaType,
+		Size:      int64(len(rawConfig)),
+	}}
+	for j, descriptor := range layers {
+		entries = append(entries, streamEntry{
+			Name:      descriptor.Digest.String(),
+			MediaType: descriptor.MediaType,
+			Size:      descriptor.Size,
+			DiffID:    digest.Digest(img.RootFS.DiffIDs[j]),
+		})
 	}
 
-	// Send layers in reverse because import needs to read them in reverse order
-	for j := len(manifest.Layers) - 1; j >= 0; j-- {
-		layer := manifest.Layers[j]
-
-		blobStream, expectedLenght, err := i.getBlobStream(layer.Digest)
-		if err != nil {
-			return errors.Wrap(err, "failed to write header")
-		}
-		defer blobStream.Close() // ok to keep open until func terminates
-
-		tarHeader := &tar.Header{
-			Name: layer.Digest.String(),
-			Size: expectedLenght,
-		}
-		if err := tarWriter.WriteHeader(tarHeader); err != nil {
-			log.Error(err)
-			return err
-		}
+	return entries, rawConfig, nil
+}
 
-		if _, err := io.Copy(tarWriter, blobStream); err != nil {
-			log.Error(err)
-			return err
-		}
+func (i *Importer) writeBlobToStream(ctx context.Context, stream *streamWriter, blobsum digest.Digest) error {
+	blobStream, _, err := i.getBlobStream(ctx, blobsum)
+	if err != nil {
+		return errors.Wrapf(err, "failed to get blob %s", blobsum)
 	}
+	defer blobStream.Close()
 
-	return nil
+	return stream.writeEntry(blobsum.String(), blobStream)
 }
 
-// ImportFromStream will read manifest and layer data from a single tar stream
-func (i *Importer) ImportFromStream(reader io.Reader, imageURI string) error {
-	tmpStore, err := streamToTempStore(reader, imageURI)
+// ImportFromStream will read manifest and layer data from a single tar stream.  When ctx is
+// cancelled, reading stops and the partial image is removed.
+func (i *Importer) ImportFromStream(ctx context.Context, reader io.Reader, imageURI string) error {
+	if i.Loader == nil {
+		return ErrNoLoader
+	}
+
+	tmpStore, err := i.streamToTempStore(ctx, reader, imageURI)
 	if tmpStore != nil {
 		defer tmpStore.delete()
 	}
 	if err != nil {
 		return err
 	}
-	return i.ImportFromLocal(tmpStore)
+	return i.ImportFromLocal(ctx, tmpStore)
 }
 
-func streamToTempStore(reader io.Reader, imageURI string) (*v1Store, error) {
+func (i *Importer) streamToTempStore(ctx context.Context, reader io.Reader, imageURI string) (*v1Store, error) {
 	ref, err := reference.ParseNormalizedNamed(imageURI)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to create http request")
 	}
+	if _, isCanonical := ref.(reference.Canonical); !isCanonical {
+		ref = reference.TagNameOnly(ref)
+	}
 
-	tarReader := tar.NewReader(reader)
-	verifiedManifest, err := getManifestFromTar(tarReader, ref)
+	stream, err := newStreamReader(&contextReader{ctx: ctx, reader: reader})
 	if err != nil {
-		return nil, errors.Wrap(err, "failed to verify schema1 manifest")
+		return nil, err
+	}
+
+	rawManifest, mediaType, manifestRef, err := readManifestFromStream(stream, ref)
+	if err != nil {
+		return nil, err
+	}
+
+	var localStore *v1Store
+	switch mediaType {
+	case schema2.MediaTypeManifest:
+		manifest, err := verifySchema2Manifest(rawManifest, manifestRef)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to verify schema2 manifest")
+		}
+		localStore, err = i.streamImageFromConfig(stream, manifest.Config, manifest.Layers, ref)
+		if err != nil {
+			return localStore, err
+		}
+	case ocispec.MediaTypeImageManifest:
+		manifest, err := verifyOCIManifest(rawManifest, manifestRef)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to verify OCI manifest")
+		}
+		localStore, err = i.streamImageFromConfig(stream, manifest.Config, manifest.Layers, ref)
+		if err != nil {
+			return localStore, err
+		}
+	case schema1.MediaTypeSignedManifest, schema1.MediaTypeManifest:
+		verifiedManifest, err := parseSchema1Manifest(rawManifest, manifestRef)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to verify schema1 manifest")
+		}
+		localStore, err = i.streamImageV1(stream, verifiedManifest, ref)
+		if err != nil {
+			return localStore, err
+		}
+	default:
+		return nil, errors.Errorf("unsupported manifest media type %q", mediaType)
 	}
 
+	// Nothing is loaded before the whole stream checks out against the trailer
+	if err := stream.close(); err != nil {
+		return localStore, err
+	}
+
+	return localStore, nil
+}
+
+// streamImageV1 will read the layers of a schema1 manifest from the stream, top layer last
+func (i *Importer) streamImageV1(stream *streamReader, verifiedManifest *schema1.Manifest, ref reference.Named) (*v1Store, error) {
 	localStore, err := getV1Store(verifiedManifest)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to get manifest bytes")
@@ -205,14 +362,14 @@ func streamToTempStore(reader io.Reader, imageURI string) (*v1Store, error) {
 	var parent digest.Digest
 	layerV1IDs := make([]digest.Digest, 0)
 
-	for i := len(verifiedManifest.FSLayers) - 1; i >= 0; i-- {
-		layer := verifiedManifest.FSLayers[i]
+	for j := len(verifiedManifest.FSLayers) - 1; j >= 0; j-- {
+		layer := verifiedManifest.FSLayers[j]
 
 		var throwAway struct {
 			ThrowAway bool `json:"throwaway,omitempty"`
 		}
 
-		v1ImageJSON := []byte(verifiedManifest.History[i].V1Compatibility)
+		v1ImageJSON := []byte(verifiedManifest.History[j].V1Compatibility)
 		if err := json.Unmarshal(v1ImageJSON, &throwAway); err != nil {
 			return localStore, err
 		}
@@ -225,7 +382,7 @@ func streamToTempStore(reader io.Reader, imageURI string) (*v1Store, error) {
 
 		if throwAway.ThrowAway {
 			log.Debugf("Skipping throw away layer: %s", layer.BlobSum.String())
-			if err := skipLayerInTar(tarReader, layer.BlobSum); err != nil {
+			if err := skipLayerInStream(stream, layer.BlobSum); err != nil {
 				return localStore, err
 			}
 			continue
@@ -239,7 +396,7 @@ func streamToTempStore(reader io.Reader, imageURI string) (*v1Store, error) {
 		}
 
 		blobSum := layer.BlobSum
-		diffID, err := downloadBlobFromTar(tarReader, blobSum, layerTempDir)
+		diffID, err := i.downloadBlobFromStream(stream, blobSum, layerTempDir)
 		if err != nil {
 			return localStore, err
 		}
@@ -251,7 +408,7 @@ func streamToTempStore(reader io.Reader, imageURI string) (*v1Store, error) {
 
 		rootFS.Append(diffID) // rootFS must contain this layer ID to produce correct chain ID
 		v1Img := image.V1Image{}
-		if i == 0 {
+		if j == 0 {
 			if err := json.Unmarshal(v1ImageJSON, &v1Img); err != nil {
 				log.Error(err)
 				return localStore, err
@@ -312,37 +469,83 @@ func streamToTempStore(reader io.Reader, imageURI string) (*v1Store, error) {
 	return localStore, nil
 }
 
-// PullImage will pull image from v2 with v1 (todo) fallback
-// unused I THINK
-func (i *Importer) PullImage() (*v1Store, error) {
-	// Validate that the remote server supports the v2 protocol
-
+// PullImage pulls the image into a local store, with the v1 protocol when the remote prefers it
+// and with v2 otherwise.  Schema2, OCI and schema1 manifests are supported, and manifest lists
+// and OCI indexes are resolved to the image for the Platform.
+func (i *Importer) PullImage(ctx context.Context) (*v1Store, error) {
 	if i.Remote.PreferredProto == "v1" {
-		return i.PullImageV1()
+		return i.PullImageV1(ctx)
+	}
+
+	rawManifest, mediaType, ref, err := i.resolveManifest(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	switch mediaType {
+	case schema2.MediaTypeManifest:
+		return i.pullImageV2ManifestV2(ctx, rawManifest, ref)
+	case ocispec.MediaTypeImageManifest:
+		return i.pullImageV2ManifestOCI(ctx, rawManifest, ref)
+	case schema1.MediaTypeSignedManifest, schema1.MediaTypeManifest:
+		return i.pullImageV2ManifestV1(ctx, rawManifest)
+	default:
+		return nil, errors.Errorf("unsupported manifest media type %q", mediaType)
 	}
+}
+
+// resolveManifest returns the image manifest of the remote, its media type and the reference to
+// verify it against.  Manifest lists and OCI indexes are resolved to the manifest for the platform.
+func (i *Importer) resolveManifest(ctx context.Context) ([]byte, string, reference.Named, error) {
+	rawManifest, mediaType, err := i.getManifest(ctx)
+	if err != nil {
+		return nil, "", nil, err
+	}
+
+	if mediaType != ocispec.MediaTypeImageIndex && mediaType != manifestlist.MediaTypeManifestList {
+		i.progress(ProgressManifestFetched, digest.FromBytes(rawManifest).String(), 0, -1)
+		return rawManifest, mediaType, i.Remote.Ref, nil
+	}
+
+	rawManifest, mediaType, err = i.resolveIndex(ctx, rawManifest, mediaType)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	i.progress(ProgressManifestFetched, digest.FromBytes(rawManifest).String(), 0, -1)
+
+	// The child manifest was verified against the index, so it is not verified against the reference again.
+	return rawManifest, mediaType, reference.TrimNamed(i.Remote.Ref), nil
+}
 
-	supported, err := i.isSupportedProtocol()
+// getManifest returns the manifest of the remote, which may be a manifest list or an OCI index,
+// and its media type
+func (i *Importer) getManifest(ctx context.Context) ([]byte, string, error) {
+	supported, err := i.isSupportedProtocol(ctx)
 	if err != nil {
-		return nil, errors.Wrap(err, "failed to get v1 store")
+		return nil, "", errors.Wrap(err, "failed to check protocol support")
 	}
 	if !supported {
-		return nil, errors.New("Docker registry v2 protocol is not supported by remote")
+		return nil, "", errors.New("Docker registry v2 protocol is not supported by remote")
 	}
 
-	// TODO: support for manifest v2
-	return i.pullImageV2ManifestV1()
+	rawManifest, contentType, err := i.GetManifestBytes(ctx, pullMediaTypes...)
+	if err != nil {
+		return nil, "", errors.Wrap(err, "failed to get manifest")
+	}
+
+	mediaType, err := manifestMediaType(rawManifest, contentType)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return rawManifest, mediaType, nil
 }
 
 // PullImage will pull image from v2 registry with manifest v1
-func (i *Importer) pullImageV2ManifestV1() (*v1Store, error) {
-	// Ugh, this isn't the right design to use here.
-	// But the token will be set from checking the /v2/ endpoint without a scope, which will cause a
-	// 401 when trying to pull.
-	i.Remote.AuthHeader = ""
-
-	verifiedManifest, err := i.GetManifestV1()
+func (i *Importer) pullImageV2ManifestV1(ctx context.Context, rawManifest []byte) (*v1Store, error) {
+	verifiedManifest, err := parseSchema1Manifest(rawManifest, i.Remote.Ref)
 	if err != nil {
-		return nil, errors.Wrap(err, "failed to check protocol support")
+		return nil, errors.Wrap(err, "failed to verify schema1 manifest")
 	}
 
 	if len(verifiedManifest.FSLayers) == 0 {
@@ -356,10 +559,9 @@ func (i *Importer) pullImageV2ManifestV1() (*v1Store, error) {
 		return nil, errors.Wrap(err, "failed to get manifest v1")
 	}
 
-	rootFS := image.NewRootFS()
 	var history []image.History
-	var parent digest.Digest
-	layerV1IDs := make([]digest.Digest, 0)
+	var blobsums []digest.Digest
+	var topV1ImageJSON []byte
 
 	// Note that we check number of layers above so it's safe to run loop with i == 0
 	for j := len(verifiedManifest.FSLayers) - 1; j >= 0; j-- {
@@ -385,58 +587,34 @@ func (i *Importer) pullImageV2ManifestV1() (*v1Store, error) {
 			continue
 		}
 
-		// Create layer.tar, json, and VERSION files for the layer in a temp folder because v1 layer ID is not known ahead of time.
-		layerTempDir, err := ioutil.TempDir(localStore.Workspace, "tmp_layer")
-		if err != nil {
-			log.Error(err)
-			return localStore, err
+		// The top layer is the only one that uses the contents of its v1Compatibility
+		blobsums = append(blobsums, layer.BlobSum)
+		if j == 0 {
+			topV1ImageJSON = v1ImageJSON
 		}
+	}
 
-		blobSum := layer.BlobSum
-		diffID, err := i.downloadBlob(blobSum, layerTempDir)
-		if err != nil {
-			return localStore, err
-		}
+	layerTempDirs, diffIDs, err := i.downloadLayers(ctx, localStore, blobsums)
+	if err != nil {
+		return localStore, err
+	}
 
-		if err = ioutil.WriteFile(filepath.Join(layerTempDir, "VERSION"), []byte("1.0"), 0644); err != nil {
-			log.Error(err)
-			return localStore, err
-		}
+	rootFS := image.NewRootFS()
+	var parent digest.Digest
+	layerV1IDs := make([]digest.Digest, 0, len(layerTempDirs))
 
-		rootFS.Append(diffID) // rootFS must contain this layer ID to produce correct chain ID
+	for j, layerTempDir := range layerTempDirs {
+		rootFS.Append(diffIDs[j]) // rootFS must contain this layer ID to produce correct chain ID
 		v1Img := image.V1Image{}
-		if j == 0 {
-			if err := json.Unmarshal(v1ImageJSON, &v1Img); err != nil {
+		if j == len(layerTempDirs)-1 && topV1ImageJSON != nil {
+			if err := json.Unmarshal(topV1ImageJSON, &v1Img); err != nil {
 				log.Error(err)
 				return localStore, err
 			}
 		}
 
-		v1ID, err := v1.CreateID(v1Img, rootFS.ChainID(), parent)
-		if err != nil {
-			log.Error(err)
-			return localStore, err
-		}
-
-		v1Img.ID = v1ID.Hex()
-		if len(parent.String()) > 0 {
-			v1Img.Parent = parent.Hex()
-		}
-		v1ImgJSON, err := json.Marshal(v1Img)
+		v1ID, err := localStore.writeLayer(layerTempDir, v1Img, rootFS.ChainID(), parent)
 		if err != nil {
-			log.Error(err)
-			return localStore, err
-		}
-		if err := ioutil.WriteFile(filepath.Join(layerTempDir, "json"), v1ImgJSON, 0644); err != nil {
-			log.Error(err)
-			return localStore, err
-		}
-
-		layerDir := filepath.Join(localStore.Workspace, v1ID.Hex())
-
-		log.Debugf("Moving %s to %s", layerTempDir, layerDir)
-		if err := os.Rename(layerTempDir, layerDir); err != nil {
-			log.Error(err)
 			return localStore, err
 		}
 
@@ -466,103 +644,115 @@ func (i *Importer) pullImageV2ManifestV1() (*v1Store, error) {
 	return localStore, nil
 }
 
-// downloadBlob will download and write the layer to the workDir, in the docker format
-func (i *Importer) downloadBlob(blobsum digest.Digest, layerDir string) (layer.DiffID, error) {
-	uri := fmt.Sprintf("https://%s/v2/%s/%s/blobs/%s", i.Remote.Hostname, i.Remote.Namespace, i.Remote.ImageName, blobsum.String())
-
-	log.Debugf("Downloading blob from %q\n", uri)
-
-	req, err := i.Remote.NewHttpRequest("GET", uri, nil)
-	if err != nil {
-		return layer.DiffID(""), errors.Wrap(err, "failed to copy tar file")
+func (i *Importer) getBlobStream(ctx context.Context, blobsum digest.Digest) (io.ReadCloser, int64, error) {
+	blobStream, expectedSize, err := i.openBlobStream(ctx, blobsum)
+	if err != nil || i.Progress == nil {
+		return blobStream, expectedSize, err
 	}
 
-	resp, err := i.Remote.Do(req)
-	if err != nil {
-		return layer.DiffID(""), err
-	}
-	defer resp.Body.Close()
+	i.progress(ProgressLayerStarted, blobsum.String(), 0, expectedSize)
+	return &progressReadCloser{
+		Reader: i.newProgressReader(blobStream, blobsum.String(), 0, expectedSize),
+		Closer: blobStream,
+	}, expectedSize, nil
+}
 
-	if resp.StatusCode != http.StatusOK {
-		err := fmt.Errorf("Unexpected status code for %s: %d", uri, resp.StatusCode)
-		log.Error(err)
-		return layer.DiffID(""), err
+// openBlobStream returns a reader for the blob from the cache or the registry, without reporting
+// progress, and its size
+func (i *Importer) openBlobStream(ctx context.Context, blobsum digest.Digest) (io.ReadCloser, int64, error) {
+	if i.Cache != nil {
+		if blobStream, size, ok := i.Cache.Open(blobsum); ok {
+			log.Debugf("Using cached blob %s", blobsum)
+			return blobStream, size, nil
+		}
 	}
 
-	gzipDigest := digest.Canonical.Digester()
-	responseReader := io.TeeReader(resp.Body, gzipDigest.Hash())
+	uri := fmt.Sprintf("%s/v2/%s/blobs/%s", i.Remote.BaseURL(), i.Remote.Repository, blobsum.String())
 
-	archive, err := gzip.NewReader(responseReader)
+	log.Debugf("Downloading blob from %q", uri)
+
+	req, err := i.Remote.NewHttpRequest(ctx, "GET", uri, nil)
 	if err != nil {
-		return layer.DiffID(""), errors.Wrap(err, "failed to create gzip reader")
+		log.Error(err)
+		return nil, 0, err
 	}
-	defer archive.Close()
 
-	target := filepath.Join(layerDir, "layer.tar")
-	writer, err := os.Create(target)
+	resp, err := i.Remote.DoWithRetry(req, maxRetries)
 	if err != nil {
-		return layer.DiffID(""), errors.Wrapf(err, "failed to create tar file %s", target)
+		return nil, 0, errors.Wrap(err, "failed to create request")
 	}
-	defer writer.Close()
 
-	tarDigest := digest.Canonical.Digester()
-	tarWriter := io.MultiWriter(writer, tarDigest.Hash())
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, 0, errors.Errorf("unexpected status code for %s: %d", uri, resp.StatusCode)
+	}
 
-	_, err = io.Copy(tarWriter, archive)
+	log.Debugf("Responded with content-length: %q", resp.Header.Get("Content-Length"))
+	expectedSize, err := strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64)
 	if err != nil {
 		log.Error(err)
-		return layer.DiffID(""), err
+		expectedSize = -1
 	}
 
-	computedBlobsum := digest.Digest(gzipDigest.Digest())
-	if blobsum.String() != computedBlobsum.String() {
-		return layer.DiffID(""), errors.Errorf("downloaded layer blobsum does not match expected blobsum: %s != %s", blobsum, computedBlobsum)
-	}
+	body := io.ReadCloser(&resumingReader{ctx: ctx, importer: i, blobsum: blobsum, body: resp.Body})
 
-	diffID := digest.Digest(tarDigest.Digest())
-	log.Debugf("Downloaded layer %s, with blobsum %s", diffID, computedBlobsum)
+	if i.Cache != nil {
+		cacheWriter, err := i.Cache.Writer(blobsum)
+		if err != nil {
+			log.Infof("Failed to cache blob %s: %v", blobsum, err)
+			return body, expectedSize, nil
+		}
+		return &cachingReadCloser{ReadCloser: body, writer: cacheWriter}, expectedSize, nil
+	}
 
-	return layer.DiffID(diffID), nil
+	return body, expectedSize, nil
 }
 
-func (i *Importer) getBlobStream(blobsum digest.Digest) (io.ReadCloser, int64, error) {
-	uri := fmt.Sprintf("https://%s/v2/%s/%s/blobs/%s", i.Remote.Hostname, i.Remote.Namespace, i.Remote.ImageName, blobsum.String())
+// getBlobSize returns the size of the blob, from the cache or with a HEAD request
+func (i *Importer) getBlobSize(ctx context.Context, blobsum digest.Digest) (int64, error) {
+	if i.Cache != nil {
+		if blobPath, _, ok := i.Cache.Get(blobsum); ok {
+			if info, err := os.Stat(blobPath); err == nil {
+				return info.Size(), nil
+			}
+		}
+	}
 
-	log.Debugf("Downloading blob from %q", uri)
+	uri := fmt.Sprintf("%s/v2/%s/blobs/%s", i.Remote.BaseURL(), i.Remote.Repository, blobsum.String())
 
-	req, err := i.Remote.NewHttpRequest("GET", uri, nil)
+	req, err := i.Remote.NewHttpRequest(ctx, "HEAD", uri, nil)
 	if err != nil {
 		log.Error(err)
-		return nil, 0, err
+		return 0, err
 	}
 
 	resp, err := i.Remote.DoWithRetry(req, maxRetries)
 	if err != nil {
-		return nil, 0, errors.Wrap(err, "failed to create request")
+		return 0, errors.Wrap(err, "failed to do request")
 	}
+	resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		resp.Body.Close()
-		return nil, 0, errors.Errorf("unexpected status code for %s: %d", uri, resp.StatusCode)
+		return 0, errors.Errorf("unexpected status code for %s: %d", uri, resp.StatusCode)
 	}
-
-	log.Debugf("Responded with content-length: %q", resp.Header.Get("Content-Length"))
-	expectedSize, err := strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64)
-	if err != nil {
-		log.Error(err)
-		expectedSize = -1
+	if resp.ContentLength < 0 {
+		return 0, errors.Errorf("no content length for %s", uri)
 	}
 
-	return resp.Body, expectedSize, nil
+	return resp.ContentLength, nil
 }
 
 // getManifest will return the remote manifest for the image.
-func (i *Importer) GetManifestV1() (*schema1.Manifest, error) {
-	rawManifest, _, err := i.GetManifestBytes(schema1.MediaTypeManifest) // schema1.MediaTypeSignedManifest
+func (i *Importer) GetManifestV1(ctx context.Context) (*schema1.Manifest, error) {
+	rawManifest, _, err := i.GetManifestBytes(ctx, schema1.MediaTypeManifest) // schema1.MediaTypeSignedManifest
 	if err != nil {
 		return nil, err
 	}
 
+	return parseSchema1Manifest(rawManifest, i.Remote.Ref)
+}
+
+func parseSchema1Manifest(rawManifest []byte, ref reference.Named) (*schema1.Manifest, error) {
 	var manifest schema1.SignedManifest
 	if err := json.Unmarshal(rawManifest, &manifest); err != nil {
 		log.Error(err)
@@ -571,7 +761,7 @@ func (i *Importer) GetManifestV1() (*schema1.Manifest, error) {
 
 	log.Debugf("manifest = %#v", manifest)
 
-	verifiedManifest, err := verifySchema1Manifest(&manifest, i.Remote.Ref)
+	verifiedManifest, err := verifySchema1Manifest(&manifest, ref)
 	if err != nil {
 		return nil, err
 	}
@@ -581,10 +771,58 @@ func (i *Importer) GetManifestV1() (*schema1.Manifest, error) {
 	return verifiedManifest, nil
 }
 
-func (i *Importer) GetManifestBytes(mediaTypes ...string) ([]byte, string, error) {
-	uri := fmt.Sprintf("https://%s/v2/%s/%s/manifests/%s", i.Remote.Hostname, i.Remote.Namespace, i.Remote.ImageName, i.Remote.Tag)
+// manifestMediaType returns the media type of a manifest.  Some registries respond with a
+// generic content type, in which case the type is detected from the manifest itself.
+func manifestMediaType(rawManifest []byte, contentType string) (string, error) {
+	if i := strings.Index(contentType, ";"); i >= 0 {
+		contentType = contentType[:i]
+	}
+	contentType = strings.TrimSpace(contentType)
+
+	switch contentType {
+	case schema1.MediaTypeManifest, schema1.MediaTypeSignedManifest, schema2.MediaTypeManifest,
+		manifestlist.MediaTypeManifestList, ocispec.MediaTypeImageManifest, ocispec.MediaTypeImageIndex:
+		return contentType, nil
+	}
+
+	var versioned manifest.Versioned
+	if err := json.Unmarshal(rawManifest, &versioned); err != nil {
+		return "", errors.Wrap(err, "failed to unmarshal manifest version")
+	}
+
+	switch {
+	case versioned.SchemaVersion == 1:
+		return schema1.MediaTypeSignedManifest, nil
+	case versioned.MediaType != "":
+		return versioned.MediaType, nil
+	}
+
+	// The mediaType field is optional in OCI manifests and indexes
+	var oci struct {
+		Config    json.RawMessage `json:"config"`
+		Manifests json.RawMessage `json:"manifests"`
+	}
+	if err := json.Unmarshal(rawManifest, &oci); err == nil && versioned.SchemaVersion == 2 {
+		switch {
+		case oci.Config != nil:
+			return ocispec.MediaTypeImageManifest, nil
+		case oci.Manifests != nil:
+			return ocispec.MediaTypeImageIndex, nil
+		}
+	}
+
+	return "", errors.Errorf("unknown manifest with content type %q and schema version %d", contentType, versioned.SchemaVersion)
+}
+
+func (i *Importer) GetManifestBytes(ctx context.Context, mediaTypes ...string) ([]byte, string, error) {
+	return i.getManifestBytes(ctx, i.Remote.ManifestReference(), mediaTypes...)
+}
+
+// getManifestBytes will return the manifest for a tag or digest, and its media type
+func (i *Importer) getManifestBytes(ctx context.Context, tagOrDigest string, mediaTypes ...string) ([]byte, string, error) {
+	uri := fmt.Sprintf("%s/v2/%s/manifests/%s", i.Remote.BaseURL(), i.Remote.Repository, tagOrDigest)
 
-	req, err := i.Remote.NewHttpRequest("GET", uri, nil)
+	req, err := i.Remote.NewHttpRequest(ctx, "GET", uri, nil)
 	if err != nil {
 		return nil, "", errors.Wrap(err, "failed to create request")
 	}
@@ -594,11 +832,14 @@ func (i *Importer) GetManifestBytes(mediaTypes ...string) ([]byte, string, error
 			schema1.MediaTypeManifest,
 			schema1.MediaTypeSignedManifest,
 			schema2.MediaTypeManifest,
+			manifestlist.MediaTypeManifestList,
+			ocispec.MediaTypeImageManifest,
+			ocispec.MediaTypeImageIndex,
 		}
 	}
 
 	for _, mediaType := range mediaTypes {
-		req.Header.Set("Accept", mediaType)
+		req.Header.Add("Accept", mediaType)
 	}
 
 	log.Debugf("Get manifest %s", uri)
@@ -628,60 +869,108 @@ func (i *Importer) GetManifestBytes(mediaTypes ...string) ([]byte, string, error
 	return body, mediaType, nil
 }
 
-func getManifestFromTar(tarReader *tar.Reader, ref reference.Named) (*schema1.Manifest, error) {
-	hdr, err := tarReader.Next()
-	if err != nil { // EOF is also an error here.  We need the manifest.
-		return nil, errors.Wrap(err, "failed to read manifest from tar stream")
+// readManifestFromStream will read the manifest, and the index it was resolved from if there is
+// one, from the start of the stream.  The media type of the manifest and the reference to verify it
+// against are returned with it.
+func readManifestFromStream(stream *streamReader, ref reference.Named) ([]byte, string, reference.Named, error) {
+	var rawIndex []byte
+	indexEntry := stream.header.Entries[0]
+	if indexEntry.Name == IndexFileName {
+		var err error
+		if rawIndex, err = stream.readFile(IndexFileName); err != nil {
+			return nil, "", nil, err
+		}
 	}
 
-	if hdr.Name != ManifestFileName {
-		return nil, errors.Errorf("expected %q but found %q", ManifestFileName, hdr.Name)
+	rawManifest, err := stream.readFile(ManifestFileName)
+	if err != nil {
+		return nil, "", nil, err
 	}
 
-	manifestBuffer := bytes.NewBuffer(nil)
-	_, err = io.CopyN(manifestBuffer, tarReader, hdr.Size)
+	mediaType, err := manifestMediaType(rawManifest, stream.header.MediaType)
 	if err != nil {
-		return nil, errors.Wrap(err, "failed to create gzip reader")
+		return nil, "", nil, err
 	}
 
-	var manifest schema1.SignedManifest
-	if err := json.Unmarshal(manifestBuffer.Bytes(), &manifest); err != nil {
-		log.Error(err)
-		return nil, err
+	if rawIndex == nil {
+		return rawManifest, mediaType, ref, nil
 	}
 
-	verifiedManifest, err := verifySchema1Manifest(&manifest, ref)
+	indexMediaType, err := manifestMediaType(rawIndex, indexEntry.MediaType)
 	if err != nil {
-		return nil, err
+		return nil, "", nil, err
+	}
+	if indexMediaType != ocispec.MediaTypeImageIndex && indexMediaType != manifestlist.MediaTypeManifestList {
+		return nil, "", nil, errors.Errorf("expected an index in %q but found %q", IndexFileName, indexMediaType)
 	}
 
-	log.Debugf("verifiedManifest = %#v", verifiedManifest)
+	index, err := verifyIndex(rawIndex, indexMediaType, ref)
+	if err != nil {
+		return nil, "", nil, errors.Wrap(err, "failed to verify index")
+	}
 
-	return verifiedManifest, nil
+	// The manifest is verified against the index, so it is not verified against the reference again.
+	for _, descriptor := range index.Manifests {
+		if verifyManifestDigest(rawManifest, descriptor.Digest) != nil {
+			continue
+		}
+		if descriptor.MediaType != mediaType {
+			return nil, "", nil, errors.Errorf("stream header lists media type %q for the manifest, but the index lists %q", mediaType, descriptor.MediaType)
+		}
+		return rawManifest, mediaType, reference.TrimNamed(ref), nil
+	}
+
+	return nil, "", nil, errors.Errorf("manifest %s is not in the index", digest.FromBytes(rawManifest))
 }
 
-// downloadBlob will download and write the layer to the workDir, in the docker format
-func downloadBlobFromTar(tarReader *tar.Reader, blobsum digest.Digest, layerDir string) (layer.DiffID, error) {
-	hdr, err := tarReader.Next()
-	if err != nil { // EOF is also an error.  We expect a certain number of layers.
-		return layer.DiffID(""), errors.Wrap(err, "failed to read layer")
+// downloadBlobFromStream will read the layer from the stream and write it to the layerDir, in the docker format
+func (i *Importer) downloadBlobFromStream(stream *streamReader, blobsum digest.Digest, layerDir string) (layer.DiffID, error) {
+	blobReader, entry, err := stream.next(blobsum.String())
+	if err != nil {
+		return layer.DiffID(""), err
 	}
 
-	log.Debugf("Expecting %s layer (%d bytes)", blobsum, hdr.Size)
+	i.progress(ProgressLayerStarted, blobsum.String(), 0, entry.Size)
 
-	if hdr.Name != blobsum.String() {
-		return layer.DiffID(""), errors.Errorf("expected layer %q, but got layer %q", blobsum, hdr.Name)
+	if entry.Reference {
+		diffID, err := i.extractReferencedLayer(blobsum, layer.DiffID(entry.DiffID), layerDir)
+		if err != nil {
+			return layer.DiffID(""), err
+		}
+		i.progress(ProgressLayerVerified, blobsum.String(), 0, entry.Size)
+		i.progress(ProgressLayerExtracted, blobsum.String(), 0, entry.Size)
+		return diffID, nil
 	}
 
+	log.Debugf("Expecting %s layer (%d bytes)", blobsum, entry.Size)
+	blobReader = i.newProgressReader(blobReader, blobsum.String(), 0, entry.Size)
+
 	gzipDigest := digest.Canonical.Digester()
-	responseReader := io.TeeReader(tarReader, gzipDigest.Hash())
+	digestWriter := io.Writer(gzipDigest.Hash())
+
+	// Blobs that arrive in the stream are added to the cache for later pulls
+	var cacheWriter *BlobCacheWriter
+	if i.Cache != nil {
+		if cacheWriter, err = i.Cache.Writer(blobsum); err != nil {
+			log.Infof("Failed to cache blob %s: %v", blobsum, err)
+		} else {
+			defer func() {
+				if cacheWriter != nil {
+					cacheWriter.Cancel()
+				}
+			}()
+			digestWriter = io.MultiWriter(digestWriter, cacheWriter)
+		}
+	}
+	responseReader := io.TeeReader(blobReader, digestWriter)
 
-	archive, err := gzip.NewReader(responseReader)
+	// OCI layers may be uncompressed
+	layerReader, err := archive.DecompressStream(responseReader)
 	if err != nil {
-		log.Errorf("Failed to create gzip reader: %v", err)
+		log.Errorf("Failed to create decompressing reader: %v", err)
 		return layer.DiffID(""), err
 	}
-	defer archive.Close()
+	defer layerReader.Close()
 
 	target := filepath.Join(layerDir, "layer.tar")
 	writer, err := os.Create(target)
@@ -694,14 +983,18 @@ func downloadBlobFromTar(tarReader *tar.Reader, blobsum digest.Digest, layerDir
 	tarDigest := digest.Canonical.Digester()
 	tarWriter := io.MultiWriter(writer, tarDigest.Hash())
 
-	// TODO: Anyway to check we read the right number of bytes from the original tar?
-	bytesExtracted, err := io.Copy(tarWriter, archive)
+	bytesExtracted, err := io.Copy(tarWriter, layerReader)
 	log.Debugf("Wrote %d bytes to layer %s", bytesExtracted, blobsum)
 	if err != nil {
 		log.Error(err)
 		return layer.DiffID(""), err
 	}
 
+	// The blobsum covers the whole blob, including anything after the end of the compressed data
+	if _, err := io.Copy(ioutil.Discard, responseReader); err != nil {
+		return layer.DiffID(""), streamReadError(err, blobsum.String())
+	}
+
 	computedBlobsum := digest.Digest(gzipDigest.Digest())
 	if blobsum.String() != computedBlobsum.String() {
 		err := fmt.Errorf("Downloaded layer blobsum does not match expected blobsum: %s != %s", blobsum, computedBlobsum)
@@ -711,34 +1004,65 @@ func downloadBlobFromTar(tarReader *tar.Reader, blobsum digest.Digest, layerDir
 
 	diffID := digest.Digest(tarDigest.Digest())
 	log.Debugf("Downloaded layer %s, with blobsum %s", diffID, computedBlobsum)
+	i.progress(ProgressLayerVerified, blobsum.String(), entry.Size, entry.Size)
+	i.progress(ProgressLayerExtracted, blobsum.String(), entry.Size, entry.Size)
+
+	if cacheWriter != nil {
+		if err := cacheWriter.Commit(layer.DiffID(diffID)); err != nil {
+			log.Infof("Failed to cache blob %s: %v", blobsum, err)
+		}
+		cacheWriter = nil
+	}
 
 	return layer.DiffID(diffID), nil
 }
 
-func skipLayerInTar(tarReader *tar.Reader, blobsum digest.Digest) error {
-	hdr, err := tarReader.Next()
-	if err != nil { // EOF is also an error.  We expect a certain number of layers.
-		return errors.Wrap(err, "failed to read layer")
+// extractReferencedLayer fills in a layer that was left out of the stream from the cache.  The
+// cached blob is found by its digest, or by the diff ID when the cache has the layer compressed
+// differently.
+func (i *Importer) extractReferencedLayer(blobsum digest.Digest, diffID layer.DiffID, layerDir string) (layer.DiffID, error) {
+	if i.Cache == nil {
+		return layer.DiffID(""), errors.Errorf("layer %s was left out of the stream, but there is no cache to fill it in from", blobsum)
 	}
 
-	if hdr.Name != blobsum.String() {
-		return errors.Errorf("expected layer %q, but got layer %q", blobsum, hdr.Name)
+	cachedBlobsum := blobsum
+	cachedPath, _, ok := i.Cache.Get(blobsum)
+	if !ok && diffID != "" {
+		cachedBlobsum, cachedPath, ok = i.Cache.GetByDiffID(diffID)
+	}
+	if !ok {
+		return layer.DiffID(""), errors.Errorf("layer %s was left out of the stream, but it is not in the cache", blobsum)
+	}
+
+	extractedDiffID, err := extractBlob(cachedBlobsum, cachedPath, layerDir)
+	if err != nil {
+		return layer.DiffID(""), errors.Wrapf(err, "failed to fill in layer %s from the cache", blobsum)
 	}
+	if diffID != "" && extractedDiffID != diffID {
+		return layer.DiffID(""), errors.Errorf("cached layer %s has diff id %s, but the stream expects %s", cachedBlobsum, extractedDiffID, diffID)
+	}
+
+	log.Debugf("Filled in layer %s from cached blob %s", extractedDiffID, cachedBlobsum)
+
+	return extractedDiffID, nil
+}
 
-	io.Copy(ioutil.Discard, tarReader)
-	return nil
+func skipLayerInStream(stream *streamReader, blobsum digest.Digest) error {
+	// The rest of the layer is read when the stream moves on to the next file
+	_, _, err := stream.next(blobsum.String())
+	return err
 }
 
 // isSupportedProtocol will communicate with the remote server and validate that it supports
 // the v2 protocol
-func (i *Importer) isSupportedProtocol() (bool, error) {
+func (i *Importer) isSupportedProtocol(ctx context.Context) (bool, error) {
 	uris := []string{
-		fmt.Sprintf("https://%s/%s/", i.Remote.Hostname, i.Remote.PreferredProto),
-		fmt.Sprintf("https://%s/%s/_ping", i.Remote.Hostname, i.Remote.PreferredProto),
+		fmt.Sprintf("%s/%s/", i.Remote.BaseURL(), i.Remote.PreferredProto),
+		fmt.Sprintf("%s/%s/_ping", i.Remote.BaseURL(), i.Remote.PreferredProto),
 	}
 
 	for _, uri := range uris {
-		req, err := i.Remote.NewHttpRequest("GET", uri, nil)
+		req, err := i.Remote.NewHttpRequest(ctx, "GET", uri, nil)
 		if err != nil {
 			log.Infof("Error pinging URL %q: %v", uri, err)
 			continue
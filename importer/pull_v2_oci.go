@@ -0,0 +1,154 @@
+package importer
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"strings"
+
+	"github.com/replicatedcom/harpoon/log"
+
+	"github.com/containerd/containerd/platforms"
+	"github.com/docker/distribution/manifest/ocischema"
+	"github.com/docker/distribution/manifest/schema2"
+	"github.com/docker/distribution/reference"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// pullImageV2ManifestOCI will pull image from v2 registry with an OCI image manifest
+func (i *Importer) pullImageV2ManifestOCI(ctx context.Context, rawManifest []byte, ref reference.Named) (*v1Store, error) {
+	manifest, err := verifyOCIManifest(rawManifest, ref)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to verify OCI manifest")
+	}
+
+	return i.pullImageFromConfig(ctx, manifest.Config, manifest.Layers)
+}
+
+// resolveIndex will return the manifest from an OCI image index or a docker manifest list that
+// matches the requested platform, and its media type
+func (i *Importer) resolveIndex(ctx context.Context, rawIndex []byte, mediaType string) ([]byte, string, error) {
+	index, err := verifyIndex(rawIndex, mediaType, i.Remote.Ref)
+	if err != nil {
+		return nil, "", errors.Wrap(err, "failed to verify index")
+	}
+
+	platform, err := i.platform()
+	if err != nil {
+		return nil, "", err
+	}
+
+	descriptor, err := selectIndexManifest(index, platforms.Only(platform))
+	if err != nil {
+		return nil, "", errors.Wrapf(err, "failed to resolve platform %s", platforms.Format(platform))
+	}
+
+	log.Debugf("Resolved %s to manifest %s for platform %s", i.Remote.Ref, descriptor.Digest, formatPlatform(descriptor.Platform))
+
+	rawManifest, _, err := i.getManifestBytes(ctx, descriptor.Digest.String(), descriptor.MediaType)
+	if err != nil {
+		return nil, "", errors.Wrapf(err, "failed to get manifest %s", descriptor.Digest)
+	}
+
+	if err := verifyManifestDigest(rawManifest, descriptor.Digest); err != nil {
+		return nil, "", err
+	}
+
+	return rawManifest, descriptor.MediaType, nil
+}
+
+// selectIndexManifest returns the image manifest in the index that best matches the platform
+func selectIndexManifest(index *ocispec.Index, matcher platforms.MatchComparer) (ocispec.Descriptor, error) {
+	var candidates []ocispec.Descriptor
+	for _, descriptor := range index.Manifests {
+		if descriptor.MediaType != ocispec.MediaTypeImageManifest && descriptor.MediaType != schema2.MediaTypeManifest {
+			continue
+		}
+
+		// An index with a single manifest does not need to describe its platform
+		if descriptor.Platform == nil {
+			if len(index.Manifests) == 1 {
+				return descriptor, nil
+			}
+			continue
+		}
+
+		if matcher.Match(*descriptor.Platform) {
+			candidates = append(candidates, descriptor)
+		}
+	}
+
+	if len(candidates) == 0 {
+		available := make([]string, 0, len(index.Manifests))
+		for _, descriptor := range index.Manifests {
+			if descriptor.Platform != nil {
+				available = append(available, formatPlatform(descriptor.Platform))
+			}
+		}
+		return ocispec.Descriptor{}, errors.Errorf("no matching manifest in index, available platforms: %s", strings.Join(available, ", "))
+	}
+
+	sort.SliceStable(candidates, func(j, k int) bool {
+		return matcher.Less(*candidates[j].Platform, *candidates[k].Platform)
+	})
+
+	return candidates[0], nil
+}
+
+func verifyOCIManifest(rawManifest []byte, ref reference.Named) (*ocischema.DeserializedManifest, error) {
+	if digested, isCanonical := ref.(reference.Canonical); isCanonical {
+		if err := verifyManifestDigest(rawManifest, digested.Digest()); err != nil {
+			return nil, err
+		}
+	}
+
+	var manifest ocischema.DeserializedManifest
+	if err := json.Unmarshal(rawManifest, &manifest); err != nil {
+		return nil, errors.Wrap(err, "failed to unmarshal manifest")
+	}
+
+	if manifest.SchemaVersion != 2 {
+		return nil, errors.Errorf("unsupported schema version %d for %q", manifest.SchemaVersion, ref.String())
+	}
+	if manifest.MediaType != "" && manifest.MediaType != ocispec.MediaTypeImageManifest {
+		return nil, errors.Errorf("unexpected media type %q for %q", manifest.MediaType, ref.String())
+	}
+	if manifest.Config.Digest == "" {
+		return nil, errors.Errorf("no config in manifest for %q", ref.String())
+	}
+	if manifest.Config.MediaType != ocispec.MediaTypeImageConfig && manifest.Config.MediaType != schema2.MediaTypeImageConfig {
+		return nil, errors.Errorf("unsupported config media type %q for %q", manifest.Config.MediaType, ref.String())
+	}
+	if len(manifest.Layers) == 0 {
+		return nil, errors.Errorf("no layers in manifest for %q", ref.String())
+	}
+
+	return &manifest, nil
+}
+
+// verifyIndex verifies an OCI image index or a docker manifest list.  Both share the same structure.
+func verifyIndex(rawIndex []byte, mediaType string, ref reference.Named) (*ocispec.Index, error) {
+	if digested, isCanonical := ref.(reference.Canonical); isCanonical {
+		if err := verifyManifestDigest(rawIndex, digested.Digest()); err != nil {
+			return nil, err
+		}
+	}
+
+	var index ocispec.Index
+	if err := json.Unmarshal(rawIndex, &index); err != nil {
+		return nil, errors.Wrap(err, "failed to unmarshal index")
+	}
+
+	if index.SchemaVersion != 2 {
+		return nil, errors.Errorf("unsupported schema version %d for %q", index.SchemaVersion, ref.String())
+	}
+	if index.MediaType != "" && index.MediaType != mediaType {
+		return nil, errors.Errorf("unexpected media type %q for %q", index.MediaType, ref.String())
+	}
+	if len(index.Manifests) == 0 {
+		return nil, errors.Errorf("no manifests in index for %q", ref.String())
+	}
+
+	return &index, nil
+}
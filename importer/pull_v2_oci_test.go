@@ -0,0 +1,195 @@
+package importer
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/containerd/containerd/platforms"
+	"github.com/docker/distribution/manifest/schema2"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPullImageOCI(t *testing.T) {
+	registry := newTestRegistry(t)
+	img := newTestImageOCI(t, ocispec.MediaTypeImageLayer, "amd64",
+		map[string]string{"etc/hostname": "base"},
+		map[string]string{"app/main": "app"},
+	)
+	registry.addImage("1.0", img)
+
+	i := &Importer{Remote: registry.remote(t, "ns/img", "1.0")}
+	localStore, err := i.PullImage(context.Background())
+	if localStore != nil {
+		defer localStore.delete()
+	}
+	require.NoError(t, err)
+
+	assertStoreImage(t, localStore, img)
+}
+
+func TestPullImageOCIIndex(t *testing.T) {
+	registry := newTestRegistry(t)
+	host := newTestImageOCI(t, ocispec.MediaTypeImageLayerGzip, runtime.GOARCH, map[string]string{"arch": runtime.GOARCH})
+	other := newTestImageOCI(t, ocispec.MediaTypeImageLayerGzip, "s390x", map[string]string{"arch": "s390x"})
+	index := newTestIndex(t, map[string]*testImage{
+		"linux/s390x":             other,
+		"linux/" + runtime.GOARCH: host,
+	})
+	registry.addIndex("1.0", index, host, other)
+
+	i := &Importer{Remote: registry.remote(t, "ns/img", "1.0")}
+	localStore, err := i.PullImage(context.Background())
+	if localStore != nil {
+		defer localStore.delete()
+	}
+	require.NoError(t, err)
+
+	assertStoreImage(t, localStore, host)
+}
+
+func TestSelectIndexManifest(t *testing.T) {
+	amd64 := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Digest:    digest.FromString("amd64"),
+		Platform:  &ocispec.Platform{OS: "linux", Architecture: "amd64"},
+	}
+	arm64 := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Digest:    digest.FromString("arm64"),
+		Platform:  &ocispec.Platform{OS: "linux", Architecture: "arm64", Variant: "v8"},
+	}
+	armv7 := ocispec.Descriptor{
+		MediaType: schema2.MediaTypeManifest,
+		Digest:    digest.FromString("armv7"),
+		Platform:  &ocispec.Platform{OS: "linux", Architecture: "arm", Variant: "v7"},
+	}
+	attestation := ocispec.Descriptor{
+		MediaType: "application/vnd.in-toto+json",
+		Digest:    digest.FromString("attestation"),
+		Platform:  &ocispec.Platform{OS: "linux", Architecture: "arm64"},
+	}
+
+	index := &ocispec.Index{Manifests: []ocispec.Descriptor{attestation, armv7, amd64, arm64}}
+
+	tests := []struct {
+		platform string
+		expect   digest.Digest
+	}{
+		{platform: "linux/amd64", expect: amd64.Digest},
+		{platform: "linux/arm64", expect: arm64.Digest},
+		{platform: "linux/arm64/v8", expect: arm64.Digest},
+		{platform: "linux/arm/v7", expect: armv7.Digest},
+		{platform: "linux/arm/v8", expect: armv7.Digest},
+		{platform: "windows/amd64"},
+		{platform: "linux/arm/v6"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.platform, func(t *testing.T) {
+			descriptor, err := selectIndexManifest(index, platforms.Only(platforms.MustParse(test.platform)))
+			if test.expect == "" {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, test.expect, descriptor.Digest)
+		})
+	}
+}
+
+func TestPullImageManifestListPlatform(t *testing.T) {
+	registry := newTestRegistry(t)
+	amd64 := newTestImageSchema2(t, map[string]string{"arch": "amd64"})
+	arm64 := newTestImage(t, schema2.MediaTypeManifest, schema2.MediaTypeImageConfig, schema2.MediaTypeLayer, "arm64", map[string]string{"arch": "arm64"})
+	list := newTestIndex(t, map[string]*testImage{
+		"linux/amd64":    amd64,
+		"linux/arm64/v8": arm64,
+	})
+	registry.addManifestList("1.0", list, amd64, arm64)
+
+	i := &Importer{Remote: registry.remote(t, "ns/img", "1.0"), Platform: "linux/arm64"}
+	localStore, err := i.PullImage(context.Background())
+	if localStore != nil {
+		defer localStore.delete()
+	}
+	require.NoError(t, err)
+
+	assertStoreImage(t, localStore, arm64)
+
+	i.Platform = "linux/ppc64le"
+	localStore, err = i.PullImage(context.Background())
+	if localStore != nil {
+		defer localStore.delete()
+	}
+	require.Error(t, err)
+}
+
+func TestPullImagePlatformMismatch(t *testing.T) {
+	registry := newTestRegistry(t)
+	img := newTestImageOCI(t, ocispec.MediaTypeImageLayerGzip, "arm64", map[string]string{"arch": "arm64"})
+	registry.addImage("1.0", img)
+
+	i := &Importer{Remote: registry.remote(t, "ns/img", "1.0"), Platform: "linux/ppc64le"}
+	localStore, err := i.PullImage(context.Background())
+	if localStore != nil {
+		defer localStore.delete()
+	}
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "does not match the requested platform linux/ppc64le")
+
+	i.Platform = "linux/arm64/v8"
+	localStore, err = i.PullImage(context.Background())
+	if localStore != nil {
+		defer localStore.delete()
+	}
+	require.NoError(t, err)
+	assertStoreImage(t, localStore, img)
+}
+
+func TestCheckConfigPlatform(t *testing.T) {
+	i := &Importer{}
+	require.NoError(t, i.checkConfigPlatform([]byte(`{"os":"plan9","architecture":"mips"}`)), "host platform mismatches are only warned about")
+	require.NoError(t, i.checkConfigPlatform([]byte(`{}`)))
+
+	i.Platform = "linux/arm/v7"
+	require.NoError(t, i.checkConfigPlatform([]byte(`{"os":"linux","architecture":"arm","variant":"v7"}`)))
+	require.NoError(t, i.checkConfigPlatform([]byte(`{"os":"linux","architecture":"arm","variant":"v5"}`)), "arm/v7 runs arm/v5 images")
+	require.Error(t, i.checkConfigPlatform([]byte(`{"os":"linux","architecture":"arm64"}`)))
+	require.Error(t, i.checkConfigPlatform([]byte(`{"os":"windows","architecture":"arm","variant":"v7"}`)))
+}
+
+// assertStoreImage checks that the store contains the config and uncompressed layers of the image
+func assertStoreImage(t *testing.T, localStore *v1Store, img *testImage) {
+	imageID := digest.FromBytes(img.Config)
+	config, err := os.ReadFile(filepath.Join(localStore.Workspace, imageID.Hex()+".json"))
+	require.NoError(t, err)
+	assert.Equal(t, img.Config, config)
+
+	assertStoreLayers(t, localStore, img.DiffIDs...)
+}
+
+// assertStoreLayers checks that the store manifest references layers with the given diff ids
+func assertStoreLayers(t *testing.T, localStore *v1Store, diffIDs ...digest.Digest) {
+	contents, err := os.ReadFile(filepath.Join(localStore.Workspace, "manifest.json"))
+	require.NoError(t, err)
+	var manifest []manifestItem
+	require.NoError(t, json.Unmarshal(contents, &manifest))
+	require.Len(t, manifest, 1)
+	require.Len(t, manifest[0].Layers, len(diffIDs))
+
+	_, err = os.Stat(filepath.Join(localStore.Workspace, manifest[0].Config))
+	require.NoError(t, err)
+
+	for j, layerPath := range manifest[0].Layers {
+		layerTar, err := os.ReadFile(filepath.Join(localStore.Workspace, layerPath))
+		require.NoError(t, err)
+		assert.Equal(t, diffIDs[j], digest.FromBytes(layerTar))
+	}
+}
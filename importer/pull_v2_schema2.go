@@ -0,0 +1,267 @@
+package importer
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"time"
+
+	"github.com/replicatedcom/harpoon/log"
+
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/manifest/schema2"
+	"github.com/docker/distribution/reference"
+	"github.com/docker/docker/image"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// pullImageV2ManifestV2 will pull image from v2 registry with manifest v2 (schema2)
+func (i *Importer) pullImageV2ManifestV2(ctx context.Context, rawManifest []byte, ref reference.Named) (*v1Store, error) {
+	manifest, err := verifySchema2Manifest(rawManifest, ref)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to verify schema2 manifest")
+	}
+
+	return i.pullImageFromConfig(ctx, manifest.Config, manifest.Layers)
+}
+
+// pullImageFromConfig will download the config and layers referenced by a schema2 or OCI manifest
+func (i *Importer) pullImageFromConfig(ctx context.Context, configDescriptor distribution.Descriptor, layers []distribution.Descriptor) (*v1Store, error) {
+	rawConfig, err := i.getConfigBlob(ctx, configDescriptor.Digest)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get image config")
+	}
+
+	img, err := newImageFromConfig(rawConfig, layers)
+	if err != nil {
+		return nil, err
+	}
+
+	localStore, err := newV1Store()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create v1 store")
+	}
+
+	blobsums := make([]digest.Digest, 0, len(layers))
+	for _, descriptor := range layers {
+		if !isSupportedLayerMediaType(descriptor.MediaType) {
+			return localStore, errors.Errorf("unsupported layer media type %q", descriptor.MediaType)
+		}
+		blobsums = append(blobsums, descriptor.Digest)
+	}
+
+	layerTempDirs, diffIDs, err := i.downloadLayers(ctx, localStore, blobsums)
+	if err != nil {
+		return localStore, err
+	}
+
+	for j, diffID := range diffIDs {
+		if diffID != img.RootFS.DiffIDs[j] {
+			return localStore, errors.Errorf("layer %s has diff id %s, but image config expects %s", blobsums[j], diffID, img.RootFS.DiffIDs[j])
+		}
+	}
+
+	if err := localStore.writeImage(rawConfig, img, layerTempDirs, i.Remote.Ref); err != nil {
+		return localStore, err
+	}
+
+	return localStore, nil
+}
+
+// streamImageFromConfig will read the config and layers referenced by a schema2 or OCI manifest
+// from the stream, in the order streamBlobs lists them
+func (i *Importer) streamImageFromConfig(stream *streamReader, configDescriptor distribution.Descriptor, layers []distribution.Descriptor, ref reference.Named) (*v1Store, error) {
+	rawConfig, err := stream.readFile(configDescriptor.Digest.String())
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read image config")
+	}
+
+	if computed := digest.FromBytes(rawConfig); computed != configDescriptor.Digest {
+		return nil, errors.Errorf("streamed config digest does not match expected digest: %s != %s", configDescriptor.Digest, computed)
+	}
+
+	img, err := newImageFromConfig(rawConfig, layers)
+	if err != nil {
+		return nil, err
+	}
+
+	localStore, err := newV1Store()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create v1 store")
+	}
+
+	layerTempDirs := make([]string, 0, len(layers))
+	for j, descriptor := range layers {
+		if !isSupportedLayerMediaType(descriptor.MediaType) {
+			return localStore, errors.Errorf("unsupported layer media type %q", descriptor.MediaType)
+		}
+
+		layerTempDir, err := ioutil.TempDir(localStore.Workspace, "tmp_layer")
+		if err != nil {
+			log.Error(err)
+			return localStore, err
+		}
+
+		diffID, err := i.downloadBlobFromStream(stream, descriptor.Digest, layerTempDir)
+		if err != nil {
+			return localStore, err
+		}
+
+		if diffID != img.RootFS.DiffIDs[j] {
+			return localStore, errors.Errorf("layer %s has diff id %s, but image config expects %s", descriptor.Digest, diffID, img.RootFS.DiffIDs[j])
+		}
+
+		layerTempDirs = append(layerTempDirs, layerTempDir)
+	}
+
+	if err := localStore.writeImage(rawConfig, img, layerTempDirs, ref); err != nil {
+		return localStore, err
+	}
+
+	return localStore, nil
+}
+
+// newImageFromConfig parses the image config and checks it has a diff id for every layer
+func newImageFromConfig(rawConfig []byte, layers []distribution.Descriptor) (*image.Image, error) {
+	img, err := image.NewFromJSON(rawConfig)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse image config")
+	}
+
+	if len(img.RootFS.DiffIDs) != len(layers) {
+		return nil, errors.Errorf("image config has %d diff ids, but manifest has %d layers", len(img.RootFS.DiffIDs), len(layers))
+	}
+
+	return img, nil
+}
+
+// writeImage will move the downloaded layers of a schema2 or OCI image into place, and write the
+// config, repositories and manifest files for it.
+func (repo *v1Store) writeImage(rawConfig []byte, img *image.Image, layerTempDirs []string, ref reference.Named) error {
+	// Layer IDs are computed the same way "docker save" computes them, so the result of
+	// loading this store is identical to pulling the image with docker.
+	var parent digest.Digest
+	layerV1IDs := make([]digest.Digest, 0, len(layerTempDirs))
+	for j, layerTempDir := range layerTempDirs {
+		v1ImgCreated := time.Unix(0, 0)
+		v1Img := image.V1Image{
+			Created: &v1ImgCreated,
+		}
+		if j == len(layerTempDirs)-1 {
+			v1Img = img.V1Image
+		}
+
+		rootFS := *img.RootFS
+		rootFS.DiffIDs = rootFS.DiffIDs[:j+1]
+
+		v1ID, err := repo.writeLayer(layerTempDir, v1Img, rootFS.ChainID(), parent)
+		if err != nil {
+			return err
+		}
+
+		layerV1IDs = append(layerV1IDs, v1ID)
+		parent = v1ID
+	}
+
+	imageID := image.ID(digest.FromBytes(rawConfig))
+
+	if err := repo.writeConfigFile(imageID, rawConfig); err != nil {
+		return err
+	}
+
+	if err := repo.writeRepositoriesFile(ref, imageID); err != nil {
+		return err
+	}
+
+	return repo.writeManifestFile(ref, imageID, layerV1IDs)
+}
+
+// getConfigBlob will download the image config blob, verify it against its digest and check its
+// platform
+func (i *Importer) getConfigBlob(ctx context.Context, configDigest digest.Digest) ([]byte, error) {
+	rawConfig, err := i.readConfigBlob(ctx, configDigest)
+	if errors.Is(err, errInvalidCachedBlob) {
+		// The invalid blob was removed from the cache, so it is downloaded this time
+		rawConfig, err = i.readConfigBlob(ctx, configDigest)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if computed := digest.FromBytes(rawConfig); computed != configDigest {
+		return nil, errors.Errorf("downloaded config digest does not match expected digest: %s != %s", configDigest, computed)
+	}
+
+	if err := i.checkConfigPlatform(rawConfig); err != nil {
+		return nil, err
+	}
+
+	return rawConfig, nil
+}
+
+func (i *Importer) readConfigBlob(ctx context.Context, configDigest digest.Digest) ([]byte, error) {
+	blobStream, _, err := i.openBlobStream(ctx, configDigest)
+	if err != nil {
+		return nil, err
+	}
+	defer blobStream.Close()
+
+	rawConfig, err := io.ReadAll(blobStream)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read config blob")
+	}
+	return rawConfig, nil
+}
+
+func isSupportedLayerMediaType(mediaType string) bool {
+	switch mediaType {
+	case schema2.MediaTypeLayer, schema2.MediaTypeUncompressedLayer,
+		ocispec.MediaTypeImageLayerGzip, ocispec.MediaTypeImageLayer:
+		return true
+	}
+	return false
+}
+
+func verifySchema2Manifest(rawManifest []byte, ref reference.Named) (*schema2.DeserializedManifest, error) {
+	if digested, isCanonical := ref.(reference.Canonical); isCanonical {
+		if err := verifyManifestDigest(rawManifest, digested.Digest()); err != nil {
+			return nil, err
+		}
+	}
+
+	var manifest schema2.DeserializedManifest
+	if err := json.Unmarshal(rawManifest, &manifest); err != nil {
+		return nil, errors.Wrap(err, "failed to unmarshal manifest")
+	}
+
+	if manifest.SchemaVersion != 2 {
+		return nil, errors.Errorf("unsupported schema version %d for %q", manifest.SchemaVersion, ref.String())
+	}
+	if manifest.Config.Digest == "" {
+		return nil, errors.Errorf("no config in manifest for %q", ref.String())
+	}
+	if len(manifest.Layers) == 0 {
+		return nil, errors.Errorf("no layers in manifest for %q", ref.String())
+	}
+
+	return &manifest, nil
+}
+
+func verifyManifestDigest(rawManifest []byte, expected digest.Digest) error {
+	if err := expected.Validate(); err != nil {
+		return errors.Wrapf(err, "invalid digest %s", expected)
+	}
+
+	verifier := expected.Verifier()
+	if _, err := verifier.Write(rawManifest); err != nil {
+		return errors.Wrap(err, "failed to write verifier")
+	}
+	if !verifier.Verified() {
+		return errors.Errorf("image verification failed for digest %s", expected)
+	}
+
+	return nil
+}
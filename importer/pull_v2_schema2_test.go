@@ -0,0 +1,122 @@
+package importer
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/docker/distribution/manifest/schema1"
+	"github.com/docker/distribution/manifest/schema2"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPullImageSchema2(t *testing.T) {
+	registry := newTestRegistry(t)
+	img := newTestImageSchema2(t,
+		map[string]string{"etc/hostname": "base"},
+		map[string]string{"app/main": "app"},
+	)
+	registry.addImage("1.0", img)
+
+	i := &Importer{Remote: registry.remote(t, "ns/img", "1.0")}
+	localStore, err := i.PullImage(context.Background())
+	if localStore != nil {
+		defer localStore.delete()
+	}
+	require.NoError(t, err)
+
+	imageID := digest.FromBytes(img.Config)
+	config, err := os.ReadFile(filepath.Join(localStore.Workspace, imageID.Hex()+".json"))
+	require.NoError(t, err)
+	assert.Equal(t, img.Config, config)
+
+	contents, err := os.ReadFile(filepath.Join(localStore.Workspace, "manifest.json"))
+	require.NoError(t, err)
+	var manifest []manifestItem
+	require.NoError(t, json.Unmarshal(contents, &manifest))
+	require.Len(t, manifest, 1)
+	assert.Equal(t, imageID.Hex()+".json", manifest[0].Config)
+	assert.Equal(t, []string{registry.Host() + "/ns/img:1.0"}, manifest[0].RepoTags)
+	require.Len(t, manifest[0].Layers, 2)
+
+	for j, layerPath := range manifest[0].Layers {
+		layerTar, err := os.ReadFile(filepath.Join(localStore.Workspace, layerPath))
+		require.NoError(t, err)
+		assert.Equal(t, img.DiffIDs[j], digest.FromBytes(layerTar))
+	}
+
+	contents, err = os.ReadFile(filepath.Join(localStore.Workspace, "repositories"))
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"`+registry.Host()+`/ns/img":{"1.0":"`+imageID.Hex()+`"}}`, string(contents))
+}
+
+func TestPullImageSchema2BadDiffID(t *testing.T) {
+	registry := newTestRegistry(t)
+	img := newTestImageSchema2(t, map[string]string{"etc/hostname": "base"})
+	other := newTestImageSchema2(t, map[string]string{"etc/hostname": "other"})
+
+	// Serve the layers of another image with the config of the first
+	var manifest, otherManifest schema2.Manifest
+	require.NoError(t, json.Unmarshal(img.Manifest, &manifest))
+	require.NoError(t, json.Unmarshal(other.Manifest, &otherManifest))
+	manifest.Layers = otherManifest.Layers
+	img.Layers = other.Layers
+	var err error
+	img.Manifest, err = json.Marshal(manifest)
+	require.NoError(t, err)
+	registry.addImage("1.0", img)
+
+	i := &Importer{Remote: registry.remote(t, "ns/img", "1.0")}
+	localStore, err := i.PullImage(context.Background())
+	if localStore != nil {
+		defer localStore.delete()
+	}
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "image config expects")
+}
+
+func TestManifestMediaType(t *testing.T) {
+	tests := []struct {
+		name        string
+		manifest    string
+		contentType string
+		expect      string
+	}{
+		{
+			name:        "schema2 content type",
+			manifest:    `{}`,
+			contentType: schema2.MediaTypeManifest,
+			expect:      schema2.MediaTypeManifest,
+		},
+		{
+			name:        "content type with parameters",
+			manifest:    `{}`,
+			contentType: schema1.MediaTypeSignedManifest + "; charset=utf-8",
+			expect:      schema1.MediaTypeSignedManifest,
+		},
+		{
+			name:        "generic schema1",
+			manifest:    `{"schemaVersion":1}`,
+			contentType: "application/json",
+			expect:      schema1.MediaTypeSignedManifest,
+		},
+		{
+			name:        "generic schema2",
+			manifest:    `{"schemaVersion":2,"mediaType":"` + schema2.MediaTypeManifest + `"}`,
+			contentType: "text/plain",
+			expect:      schema2.MediaTypeManifest,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mediaType, err := manifestMediaType([]byte(test.manifest), test.contentType)
+			require.NoError(t, err)
+			assert.Equal(t, test.expect, mediaType)
+		})
+	}
+}
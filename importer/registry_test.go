@@ -0,0 +1,476 @@
+package importer
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/replicatedcom/harpoon/remote"
+
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/manifest"
+	"github.com/docker/distribution/manifest/manifestlist"
+	"github.com/docker/distribution/manifest/schema1"
+	"github.com/docker/distribution/manifest/schema2"
+	"github.com/docker/libtrust"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+)
+
+// testRegistry is a minimal in-memory v2 registry
+type testRegistry struct {
+	*httptest.Server
+
+	mu        sync.Mutex
+	manifests map[string]testManifest
+	blobs     map[digest.Digest][]byte
+	onBlob    func()
+
+	// dropBlob is the number of blob responses that are cut off half way
+	dropBlob int
+	// unavailable is the number of requests answered with 503 Service Unavailable
+	unavailable int
+	// requests counts the requests received
+	requests int
+	// paths records the paths of the manifest and blob requests received
+	paths []string
+	// ignoreRange serves the whole blob to range requests
+	ignoreRange bool
+	// corruptRange serves zeros to range requests
+	corruptRange bool
+	// ranges records the Range headers received
+	ranges []string
+	// unauthorizedRange is the number of range requests answered with 401 and a bearer challenge,
+	// like after the token of a pull was revoked part way
+	unauthorizedRange int
+	// unsatisfiableBlob is the number of blob requests answered with 416 Range Not Satisfiable
+	unsatisfiableBlob int
+}
+
+type testManifest struct {
+	ContentType string
+	Body        []byte
+}
+
+type testImage struct {
+	Manifest   []byte
+	Config     []byte
+	Layers     [][]byte
+	DiffIDs    []digest.Digest
+	MediaType  string
+	ConfigType string
+}
+
+func newTestRegistry(t *testing.T) *testRegistry {
+	r := &testRegistry{
+		manifests: map[string]testManifest{},
+		blobs:     map[digest.Digest][]byte{},
+	}
+	r.Server = newTestServer(t, http.HandlerFunc(r.serveHTTP))
+	return r
+}
+
+// testServerCerts are the certificates of the test servers, by host, for test remotes to trust
+var testServerCerts sync.Map
+
+// newTestServer starts a TLS server.  Remotes from newTestRemote trust its certificate.
+func newTestServer(t *testing.T, handler http.Handler) *httptest.Server {
+	server := httptest.NewTLSServer(handler)
+	t.Cleanup(server.Close)
+
+	host := serverHost(server)
+	testServerCerts.Store(host, server.Certificate().Raw)
+	t.Cleanup(func() { testServerCerts.Delete(host) })
+
+	return server
+}
+
+// trustTestServers gives the remote its own trust for the test servers, mirrors included
+func trustTestServers(t *testing.T, dockerRemote *remote.DockerRemote) {
+	dockerRemote.CertsDir = newTestCertsDir(t)
+	require.NoError(t, dockerRemote.InitClient())
+}
+
+// newTestCertsDir returns a certs.d directory with the certificates of the test servers as CAs,
+// like a registry certs dir
+func newTestCertsDir(t *testing.T) string {
+	dir := t.TempDir()
+	testServerCerts.Range(func(host, cert interface{}) bool {
+		hostDir := filepath.Join(dir, host.(string))
+		require.NoError(t, os.MkdirAll(hostDir, 0755))
+		ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.([]byte)})
+		require.NoError(t, os.WriteFile(filepath.Join(hostDir, "ca.crt"), ca, 0644))
+		return true
+	})
+	return dir
+}
+
+func (r *testRegistry) Host() string {
+	return serverHost(r.Server)
+}
+
+func serverHost(server *httptest.Server) string {
+	u, _ := url.Parse(server.URL)
+	return u.Host
+}
+
+func (r *testRegistry) serveHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	r.requests++
+	if strings.Contains(req.URL.Path, "/manifests/") || strings.Contains(req.URL.Path, "/blobs/") {
+		r.paths = append(r.paths, req.URL.Path)
+	}
+	unavailable := r.unavailable > 0
+	if unavailable {
+		r.unavailable--
+	}
+	r.mu.Unlock()
+	if unavailable {
+		w.Header().Set("Retry-After", "0")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	path := req.URL.Path
+	switch {
+	case path == "/v2/":
+		w.WriteHeader(http.StatusOK)
+	case path == "/token":
+		w.Write([]byte(`{"token": "test-token"}`))
+	case strings.Contains(path, "/manifests/"):
+		r.mu.Lock()
+		m, ok := r.manifests[path[strings.LastIndex(path, "/")+1:]]
+		r.mu.Unlock()
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", m.ContentType)
+		w.Header().Set("Docker-Content-Digest", digest.FromBytes(m.Body).String())
+		w.Write(m.Body)
+	case strings.Contains(path, "/blobs/"):
+		r.mu.Lock()
+		blob, ok := r.blobs[digest.Digest(path[strings.LastIndex(path, "/")+1:])]
+		onBlob := r.onBlob
+		drop := r.dropBlob > 0
+		if drop {
+			r.dropBlob--
+		}
+		rangeHeader := req.Header.Get("Range")
+		if rangeHeader != "" {
+			r.ranges = append(r.ranges, rangeHeader)
+		}
+		unauthorized := rangeHeader != "" && r.unauthorizedRange > 0
+		if unauthorized {
+			r.unauthorizedRange--
+		}
+		unsatisfiable := !unauthorized && r.unsatisfiableBlob > 0
+		if unsatisfiable {
+			r.unsatisfiableBlob--
+		}
+		r.mu.Unlock()
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if unauthorized {
+			w.Header().Set("Www-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="test"`, r.URL))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if unsatisfiable {
+			w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		if onBlob != nil {
+			onBlob()
+		}
+		r.serveBlob(w, req, blob, drop)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (r *testRegistry) serveBlob(w http.ResponseWriter, req *http.Request, blob []byte, drop bool) {
+	if drop {
+		w.Header().Set("Content-Length", strconv.Itoa(len(blob)))
+		w.Write(blob[:len(blob)/2])
+		w.(http.Flusher).Flush()
+		panic(http.ErrAbortHandler)
+	}
+
+	if req.Header.Get("Range") != "" {
+		if r.ignoreRange {
+			w.Write(blob)
+			return
+		}
+		if r.corruptRange {
+			var start int
+			fmt.Sscanf(req.Header.Get("Range"), "bytes=%d-", &start)
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, len(blob)-1, len(blob)))
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write(make([]byte, len(blob)-start))
+			return
+		}
+	}
+
+	http.ServeContent(w, req, "", time.Time{}, bytes.NewReader(blob))
+}
+
+func (r *testRegistry) addImage(tag string, img *testImage) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.manifests[tag] = testManifest{ContentType: img.MediaType, Body: img.Manifest}
+	r.manifests[digest.FromBytes(img.Manifest).String()] = testManifest{ContentType: img.MediaType, Body: img.Manifest}
+	if img.Config != nil {
+		r.blobs[digest.FromBytes(img.Config)] = img.Config
+	}
+	for _, l := range img.Layers {
+		r.blobs[digest.FromBytes(l)] = l
+	}
+}
+
+// hangBlobs makes the blob requests after the first n hang until the test ends.  hung is called
+// when the first of them hangs.
+func (r *testRegistry) hangBlobs(t *testing.T, n int, hung func()) {
+	release := make(chan struct{})
+	t.Cleanup(func() { close(release) })
+
+	var once sync.Once
+	count := 0
+	r.onBlob = func() {
+		r.mu.Lock()
+		count++
+		hang := count > n
+		r.mu.Unlock()
+
+		if hang {
+			once.Do(hung)
+			<-release
+		}
+	}
+}
+
+// requireCancelled checks that f returns context.Canceled without waiting for the hung requests
+func requireCancelled(t *testing.T, f func() error) {
+	done := make(chan error, 1)
+	go func() {
+		done <- f()
+	}()
+
+	select {
+	case err := <-done:
+		require.ErrorIs(t, err, context.Canceled)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for cancellation")
+	}
+}
+
+func (r *testRegistry) remote(t *testing.T, repo, tag string) *remote.DockerRemote {
+	return newTestRemote(t, r.Host(), repo, tag)
+}
+
+func newTestRemote(t *testing.T, host, repo, tag string) *remote.DockerRemote {
+	dockerRemote, err := remote.ParseDockerURI("docker://" + host + "/" + repo + ":" + tag)
+	require.NoError(t, err)
+	dockerRemote.Retry = remote.RetryPolicy{InitialBackoff: time.Millisecond, MaxBackoff: 10 * time.Millisecond}
+	trustTestServers(t, dockerRemote)
+
+	return dockerRemote
+}
+
+func (r *testRegistry) addIndex(tag string, index []byte, images ...*testImage) {
+	r.addManifests(tag, ocispec.MediaTypeImageIndex, index, images...)
+}
+
+func (r *testRegistry) addManifestList(tag string, list []byte, images ...*testImage) {
+	r.addManifests(tag, manifestlist.MediaTypeManifestList, list, images...)
+}
+
+func (r *testRegistry) addManifests(tag, mediaType string, index []byte, images ...*testImage) {
+	for _, img := range images {
+		r.addImage(digest.FromBytes(img.Manifest).String(), img)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.manifests[tag] = testManifest{ContentType: mediaType, Body: index}
+	r.manifests[digest.FromBytes(index).String()] = testManifest{ContentType: mediaType, Body: index}
+}
+
+// newTestLayer returns a tar, gzipped if compress is set, containing the given files, and its diff id
+func newTestLayer(t *testing.T, compress bool, files map[string]string) ([]byte, digest.Digest) {
+	tarBuf := bytes.NewBuffer(nil)
+	tw := tar.NewWriter(tarBuf)
+	for name, contents := range files {
+		require.NoError(t, tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(contents))}))
+		_, err := tw.Write([]byte(contents))
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+
+	if !compress {
+		return tarBuf.Bytes(), digest.FromBytes(tarBuf.Bytes())
+	}
+
+	gzBuf := bytes.NewBuffer(nil)
+	gw := gzip.NewWriter(gzBuf)
+	_, err := gw.Write(tarBuf.Bytes())
+	require.NoError(t, err)
+	require.NoError(t, gw.Close())
+
+	return gzBuf.Bytes(), digest.FromBytes(tarBuf.Bytes())
+}
+
+// newTestImageSchema1 returns a signed schema1 image.  Layers are listed from the base, and empty
+// layers are recorded as throwaway.
+func newTestImageSchema1(t *testing.T, layers ...map[string]string) *testImage {
+	img := &testImage{
+		MediaType: schema1.MediaTypeSignedManifest,
+	}
+
+	m := schema1.Manifest{
+		Versioned:    schema1.SchemaVersion,
+		Name:         "ns/img",
+		Tag:          "1.0",
+		Architecture: "amd64",
+	}
+
+	parent := ""
+	for j, files := range layers {
+		blob, diffID := newTestLayer(t, true, files)
+		id := digest.FromString(fmt.Sprintf("layer-%d", j)).Hex()
+
+		compat := map[string]interface{}{
+			"id":      id,
+			"created": "2020-01-01T00:00:00Z",
+		}
+		if parent != "" {
+			compat["parent"] = parent
+		}
+		if len(files) == 0 {
+			compat["throwaway"] = true
+		} else {
+			img.DiffIDs = append(img.DiffIDs, diffID)
+		}
+		if j == len(layers)-1 {
+			compat["os"] = "linux"
+			compat["architecture"] = "amd64"
+			compat["config"] = map[string]interface{}{"Cmd": []string{"/bin/sh"}}
+		}
+		v1Compatibility, err := json.Marshal(compat)
+		require.NoError(t, err)
+
+		// The top layer comes first in schema1 manifests
+		m.FSLayers = append([]schema1.FSLayer{{BlobSum: digest.FromBytes(blob)}}, m.FSLayers...)
+		m.History = append([]schema1.History{{V1Compatibility: string(v1Compatibility)}}, m.History...)
+		img.Layers = append(img.Layers, blob)
+		parent = id
+	}
+
+	key, err := libtrust.GenerateECP256PrivateKey()
+	require.NoError(t, err)
+	signed, err := schema1.Sign(&m, key)
+	require.NoError(t, err)
+	img.Manifest, err = signed.MarshalJSON()
+	require.NoError(t, err)
+
+	return img
+}
+
+func newTestImageSchema2(t *testing.T, layers ...map[string]string) *testImage {
+	return newTestImage(t, schema2.MediaTypeManifest, schema2.MediaTypeImageConfig, schema2.MediaTypeLayer, "amd64", layers...)
+}
+
+func newTestImageOCI(t *testing.T, layerMediaType, architecture string, layers ...map[string]string) *testImage {
+	return newTestImage(t, ocispec.MediaTypeImageManifest, ocispec.MediaTypeImageConfig, layerMediaType, architecture, layers...)
+}
+
+func newTestImage(t *testing.T, mediaType, configType, layerMediaType, architecture string, layers ...map[string]string) *testImage {
+	img := &testImage{
+		MediaType:  mediaType,
+		ConfigType: configType,
+	}
+	compress := layerMediaType != ocispec.MediaTypeImageLayer && layerMediaType != schema2.MediaTypeUncompressedLayer
+	for _, files := range layers {
+		blob, diffID := newTestLayer(t, compress, files)
+		img.Layers = append(img.Layers, blob)
+		img.DiffIDs = append(img.DiffIDs, diffID)
+	}
+
+	config := map[string]interface{}{
+		"architecture": architecture,
+		"os":           "linux",
+		"created":      "2020-01-01T00:00:00Z",
+		"config":       map[string]interface{}{"Cmd": []string{"/bin/sh"}},
+		"rootfs":       map[string]interface{}{"type": "layers", "diff_ids": img.DiffIDs},
+	}
+	var err error
+	img.Config, err = json.Marshal(config)
+	require.NoError(t, err)
+
+	m := schema2.Manifest{
+		Versioned: manifest.Versioned{
+			SchemaVersion: 2,
+			MediaType:     mediaType,
+		},
+		Config: distribution.Descriptor{
+			MediaType: img.ConfigType,
+			Digest:    digest.FromBytes(img.Config),
+			Size:      int64(len(img.Config)),
+		},
+	}
+	for _, blob := range img.Layers {
+		m.Layers = append(m.Layers, distribution.Descriptor{
+			MediaType: layerMediaType,
+			Digest:    digest.FromBytes(blob),
+			Size:      int64(len(blob)),
+		})
+	}
+	img.Manifest, err = json.Marshal(m)
+	require.NoError(t, err)
+
+	return img
+}
+
+// newTestIndex returns an index without a media type, which is valid as either an OCI index or a manifest list
+func newTestIndex(t *testing.T, platforms map[string]*testImage) []byte {
+	index := ocispec.Index{}
+	index.SchemaVersion = 2
+
+	for platform, img := range platforms {
+		parts := strings.Split(platform, "/")
+		p := &ocispec.Platform{OS: parts[0], Architecture: parts[1]}
+		if len(parts) > 2 {
+			p.Variant = parts[2]
+		}
+		index.Manifests = append(index.Manifests, ocispec.Descriptor{
+			MediaType: img.MediaType,
+			Digest:    digest.FromBytes(img.Manifest),
+			Size:      int64(len(img.Manifest)),
+			Platform:  p,
+		})
+	}
+
+	contents, err := json.Marshal(index)
+	require.NoError(t, err)
+
+	return contents
+}
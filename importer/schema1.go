@@ -3,6 +3,7 @@ package importer
 import (
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
@@ -12,6 +13,9 @@ import (
 	"github.com/docker/distribution/manifest/schema1"
 	"github.com/docker/distribution/reference"
 	"github.com/docker/docker/image"
+	v1 "github.com/docker/docker/image/v1"
+	"github.com/docker/docker/layer"
+	"github.com/docker/docker/pkg/archive"
 	digest "github.com/opencontainers/go-digest"
 	"github.com/pkg/errors"
 )
@@ -29,8 +33,6 @@ type manifestItem struct {
 }
 
 func getV1Store(verifiedManifest *schema1.Manifest) (*v1Store, error) {
-	result := &v1Store{}
-
 	compat := &v1Compatibility{}
 	// first entry is the top layer
 	if err := json.Unmarshal([]byte(verifiedManifest.History[0].V1Compatibility), compat); err != nil {
@@ -44,13 +46,16 @@ func getV1Store(verifiedManifest *schema1.Manifest) (*v1Store, error) {
 		return nil, err
 	}
 
+	return newV1Store()
+}
+
+func newV1Store() (*v1Store, error) {
 	dir, err := ioutil.TempDir("", "harpoon")
 	if err != nil {
 		return nil, err
 	}
-	result.Workspace = dir
 
-	return result, nil
+	return &v1Store{Workspace: dir}, nil
 }
 
 func (repo *v1Store) delete() error {
@@ -60,6 +65,15 @@ func (repo *v1Store) delete() error {
 	return nil
 }
 
+// archive returns the workspace as a docker-save tarball
+func (repo *v1Store) archive(compression archive.Compression) (io.ReadCloser, error) {
+	reader, err := archive.TarWithOptions(repo.Workspace, &archive.TarOptions{Compression: compression})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to archive workspace")
+	}
+	return reader, nil
+}
+
 func (repo *v1Store) writeConfigFile(imageID image.ID, config []byte) error {
 	filename := filepath.Join(repo.Workspace, fmt.Sprintf("%s.json", digest.Digest(imageID).Hex()))
 	if err := ioutil.WriteFile(filename, config, 0644); err != nil {
@@ -69,12 +83,48 @@ func (repo *v1Store) writeConfigFile(imageID image.ID, config []byte) error {
 	return nil
 }
 
+// writeLayer writes the json and VERSION files next to the layer.tar in layerTempDir and
+// moves the directory to its final location, named after the computed v1 layer ID.
+func (repo *v1Store) writeLayer(layerTempDir string, v1Img image.V1Image, chainID layer.ChainID, parent digest.Digest) (digest.Digest, error) {
+	if err := ioutil.WriteFile(filepath.Join(layerTempDir, "VERSION"), []byte("1.0"), 0644); err != nil {
+		return "", errors.Wrap(err, "failed to write VERSION file")
+	}
+
+	v1ID, err := v1.CreateID(v1Img, chainID, parent)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to create v1 layer ID")
+	}
+
+	v1Img.ID = v1ID.Hex()
+	if parent != "" {
+		v1Img.Parent = parent.Hex()
+	}
+	v1ImgJSON, err := json.Marshal(v1Img)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to marshal layer json")
+	}
+	if err := ioutil.WriteFile(filepath.Join(layerTempDir, "json"), v1ImgJSON, 0644); err != nil {
+		return "", errors.Wrap(err, "failed to write layer json")
+	}
+
+	layerDir := filepath.Join(repo.Workspace, v1ID.Hex())
+
+	log.Debugf("Moving %s to %s", layerTempDir, layerDir)
+	if err := os.Rename(layerTempDir, layerDir); err != nil {
+		return "", errors.Wrap(err, "failed to move layer directory")
+	}
+
+	return v1ID, nil
+}
+
 func (repo *v1Store) writeRepositoriesFile(ref reference.Named, imageID image.ID) error {
 	filename := filepath.Join(repo.Workspace, "repositories")
 
-	tagged, ok := ref.(reference.NamedTagged)
+	tagged, ok := repoTag(ref)
 	if !ok {
-		return errors.Errorf("reference is not tagged: %T", ref)
+		// Images pulled only by digest are loaded without a tag
+		log.Debugf("Not writing repositories file for untagged reference %s", ref)
+		return nil
 	}
 
 	repos := map[string]interface{}{
@@ -104,11 +154,13 @@ func (repo *v1Store) writeManifestFile(ref reference.Named, imageID image.ID, la
 	}
 
 	manifest := manifestItem{
-		Config:   digest.Digest(imageID).Hex() + ".json",
-		RepoTags: []string{ref.String()},
-		Layers:   layers,
+		Config: digest.Digest(imageID).Hex() + ".json",
+		Layers: layers,
 		// TODO: ParentID is probbaly empty, but when is it not empty?
 	}
+	if tagged, ok := repoTag(ref); ok {
+		manifest.RepoTags = []string{tagged.String()}
+	}
 
 	contents, err := json.Marshal([]manifestItem{manifest})
 	if err != nil {
@@ -122,6 +174,22 @@ func (repo *v1Store) writeManifestFile(ref reference.Named, imageID image.ID, la
 	return nil
 }
 
+// repoTag returns the reference to tag the loaded image with.  Docker refuses to tag images with
+// digests, so only the tag of a name:tag@digest reference is kept, and there is none for name@digest.
+func repoTag(ref reference.Named) (reference.NamedTagged, bool) {
+	tagged, ok := ref.(reference.Tagged)
+	if !ok {
+		return nil, false
+	}
+
+	repoTag, err := reference.WithTag(reference.TrimNamed(ref), tagged.Tag())
+	if err != nil {
+		return nil, false
+	}
+
+	return repoTag, true
+}
+
 // Copied from docker
 func verifySchema1Manifest(signedManifest *schema1.SignedManifest, ref reference.Named) (m *schema1.Manifest, err error) {
 	if digested, isCanonical := ref.(reference.Canonical); isCanonical {
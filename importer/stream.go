@@ -0,0 +1,348 @@
+package importer
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+
+	"github.com/replicatedcom/harpoon/log"
+
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+// The layer stream format is described in format_stream.md
+const (
+	// StreamFormatVersion is the version of the layer stream written by StreamLayers.  Streams with
+	// any other version are rejected by ImportFromStream.
+	StreamFormatVersion = 1
+
+	// StreamHeaderFileName is the first file of a layer stream.  It lists the files that follow.
+	StreamHeaderFileName = "_stream.json"
+	// StreamTrailerFileName is the last file of a layer stream.  It has the digests of the files.
+	StreamTrailerFileName = "_trailer.json"
+)
+
+// streamEntry describes a file in the layer stream
+type streamEntry struct {
+	Name      string        `json:"name"`
+	MediaType string        `json:"mediaType,omitempty"`
+	Size      int64         `json:"size"`
+	Digest    digest.Digest `json:"digest,omitempty"`
+
+	// DiffID is the diff ID of a schema2 or OCI layer
+	DiffID digest.Digest `json:"diffID,omitempty"`
+	// Reference is set for a layer the receiver already holds.  It is sent empty, and the receiver
+	// fills it in from its own copy.
+	Reference bool `json:"reference,omitempty"`
+}
+
+type streamHeader struct {
+	Version int `json:"version"`
+	// MediaType is the media type of the image manifest
+	MediaType string        `json:"mediaType"`
+	Entries   []streamEntry `json:"entries"`
+}
+
+type streamTrailer struct {
+	Entries []streamEntry `json:"entries"`
+}
+
+// streamWriter writes the files listed in the header to a layer stream, in order, and the
+// trailer with their digests
+type streamWriter struct {
+	tarWriter *tar.Writer
+	header    streamHeader
+	trailer   streamTrailer
+}
+
+func newStreamWriter(writer io.Writer, header streamHeader) (*streamWriter, error) {
+	w := &streamWriter{
+		tarWriter: tar.NewWriter(writer),
+		header:    header,
+	}
+
+	rawHeader, err := json.Marshal(header)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to marshal stream header")
+	}
+	if err := writeTarFile(w.tarWriter, StreamHeaderFileName, rawHeader); err != nil {
+		return nil, errors.Wrap(err, "failed to write stream header")
+	}
+
+	return w, nil
+}
+
+// writeEntry writes the next file listed in the header
+func (w *streamWriter) writeEntry(name string, reader io.Reader) error {
+	if len(w.trailer.Entries) == len(w.header.Entries) {
+		return errors.Errorf("stream header does not list %q", name)
+	}
+
+	entry := w.header.Entries[len(w.trailer.Entries)]
+	if entry.Name != name {
+		return errors.Errorf("stream header lists %q next, not %q", entry.Name, name)
+	}
+
+	tarHeader := &tar.Header{
+		Name: entry.Name,
+		Size: entry.Size,
+	}
+	if err := w.tarWriter.WriteHeader(tarHeader); err != nil {
+		log.Error(err)
+		return err
+	}
+
+	digester := digest.Canonical.Digester()
+	written, err := io.Copy(io.MultiWriter(w.tarWriter, digester.Hash()), reader)
+	if err != nil {
+		log.Error(err)
+		return errors.Wrapf(err, "failed to write %s", name)
+	}
+	if written != entry.Size {
+		return errors.Errorf("wrote %d bytes of %s, but the stream header lists %d", written, name, entry.Size)
+	}
+
+	w.trailer.Entries = append(w.trailer.Entries, streamEntry{
+		Name:   entry.Name,
+		Size:   entry.Size,
+		Digest: digester.Digest(),
+	})
+
+	return nil
+}
+
+// close writes the trailer.  All files listed in the header must have been written.
+func (w *streamWriter) close() error {
+	if len(w.trailer.Entries) != len(w.header.Entries) {
+		return errors.Errorf("wrote %d of the %d files listed in the stream header", len(w.trailer.Entries), len(w.header.Entries))
+	}
+
+	rawTrailer, err := json.Marshal(w.trailer)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal stream trailer")
+	}
+	if err := writeTarFile(w.tarWriter, StreamTrailerFileName, rawTrailer); err != nil {
+		return errors.Wrap(err, "failed to write stream trailer")
+	}
+
+	return w.tarWriter.Close()
+}
+
+// streamReader reads the files of a layer stream and checks them against the header as they are
+// read.  The digests are checked against the trailer by close.
+type streamReader struct {
+	tarReader *tar.Reader
+	header    streamHeader
+	digests   []digest.Digest
+
+	current  io.Reader
+	digester digest.Digester
+}
+
+func newStreamReader(reader io.Reader) (*streamReader, error) {
+	r := &streamReader{
+		tarReader: tar.NewReader(reader),
+	}
+
+	hdr, err := r.tarReader.Next()
+	if err != nil { // EOF is also an error here.  We need the header.
+		return nil, errors.Wrap(err, "failed to read stream header")
+	}
+
+	if hdr.Name == ManifestFileName || hdr.Name == IndexFileName {
+		return nil, errors.Errorf("stream has no %q, it was written by an older version", StreamHeaderFileName)
+	}
+	if hdr.Name != StreamHeaderFileName {
+		return nil, errors.Errorf("expected %q but found %q", StreamHeaderFileName, hdr.Name)
+	}
+
+	rawHeader, err := io.ReadAll(r.tarReader)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read stream header")
+	}
+
+	if err := json.Unmarshal(rawHeader, &r.header); err != nil {
+		return nil, errors.Wrap(err, "failed to unmarshal stream header")
+	}
+
+	if r.header.Version != StreamFormatVersion {
+		return nil, errors.Errorf("unsupported stream format version %d, expected %d", r.header.Version, StreamFormatVersion)
+	}
+	if len(r.header.Entries) == 0 {
+		return nil, errors.New("stream header lists no files")
+	}
+
+	return r, nil
+}
+
+// next returns a reader for the next file, which is expected to be named name.  The file does not
+// need to be read to the end.
+func (r *streamReader) next(name string) (io.Reader, streamEntry, error) {
+	if err := r.finishEntry(); err != nil {
+		return nil, streamEntry{}, err
+	}
+
+	position := len(r.digests)
+	if position == len(r.header.Entries) {
+		return nil, streamEntry{}, errors.Errorf("stream header does not list %q", name)
+	}
+
+	entry := r.header.Entries[position]
+	if entry.Name != name {
+		return nil, streamEntry{}, errors.Errorf("stream header lists %q at position %d, expected %q", entry.Name, position, name)
+	}
+
+	hdr, err := r.tarReader.Next()
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return nil, streamEntry{}, errors.Errorf("stream is truncated, %q is missing", name)
+	}
+	if err != nil {
+		return nil, streamEntry{}, errors.Wrapf(err, "failed to read %s", name)
+	}
+
+	if hdr.Name != name {
+		return nil, streamEntry{}, errors.Errorf("stream is out of order, expected %q at position %d but found %q", name, position, hdr.Name)
+	}
+	if hdr.Size != entry.Size {
+		return nil, streamEntry{}, errors.Errorf("%s is %d bytes, but the stream header lists %d", name, hdr.Size, entry.Size)
+	}
+	if entry.Reference && entry.Size != 0 {
+		return nil, streamEntry{}, errors.Errorf("%s is a reference, but the stream header lists %d bytes for it", name, entry.Size)
+	}
+
+	r.digester = digest.Canonical.Digester()
+	r.current = io.TeeReader(r.tarReader, r.digester.Hash())
+
+	return r.current, entry, nil
+}
+
+// readFile returns the contents of the next file, which is expected to be named name
+func (r *streamReader) readFile(name string) ([]byte, error) {
+	reader, _, err := r.next(name)
+	if err != nil {
+		return nil, err
+	}
+
+	contents, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, streamReadError(err, name)
+	}
+
+	return contents, nil
+}
+
+// finishEntry reads the rest of the current file and records its digest
+func (r *streamReader) finishEntry() error {
+	if r.current == nil {
+		return nil
+	}
+
+	name := r.header.Entries[len(r.digests)].Name
+	if _, err := io.Copy(ioutil.Discard, r.current); err != nil {
+		return streamReadError(err, name)
+	}
+
+	r.digests = append(r.digests, r.digester.Digest())
+	r.current = nil
+
+	return nil
+}
+
+// close reads the trailer and checks the digests of the files read against it.  All files listed
+// in the header must have been read, and nothing may follow the trailer.
+func (r *streamReader) close() error {
+	if err := r.finishEntry(); err != nil {
+		return err
+	}
+
+	if len(r.digests) != len(r.header.Entries) {
+		return errors.Errorf("read %d of the %d files listed in the stream header", len(r.digests), len(r.header.Entries))
+	}
+
+	hdr, err := r.tarReader.Next()
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return errors.Errorf("stream is truncated, %q is missing", StreamTrailerFileName)
+	}
+	if err != nil {
+		return errors.Wrap(err, "failed to read stream trailer")
+	}
+
+	if hdr.Name != StreamTrailerFileName {
+		return errors.Errorf("expected %q after the files listed in the stream header but found %q", StreamTrailerFileName, hdr.Name)
+	}
+
+	rawTrailer, err := io.ReadAll(r.tarReader)
+	if err != nil {
+		return streamReadError(err, StreamTrailerFileName)
+	}
+
+	var trailer streamTrailer
+	if err := json.Unmarshal(rawTrailer, &trailer); err != nil {
+		return errors.Wrap(err, "failed to unmarshal stream trailer")
+	}
+
+	if len(trailer.Entries) != len(r.header.Entries) {
+		return errors.Errorf("stream trailer lists %d files, but the stream header lists %d", len(trailer.Entries), len(r.header.Entries))
+	}
+
+	for j, entry := range trailer.Entries {
+		expected := r.header.Entries[j]
+		if entry.Name != expected.Name || entry.Size != expected.Size {
+			return errors.Errorf("stream trailer lists %q (%d bytes) at position %d, but the stream header lists %q (%d bytes)", entry.Name, entry.Size, j, expected.Name, expected.Size)
+		}
+		if entry.Digest != r.digests[j] {
+			return errors.Errorf("%s was modified in transit: digest %s does not match %s in the stream trailer", entry.Name, r.digests[j], entry.Digest)
+		}
+	}
+
+	if hdr, err := r.tarReader.Next(); err != io.EOF {
+		if err != nil {
+			return errors.Wrap(err, "failed to read end of stream")
+		}
+		return errors.Errorf("unexpected %q after %q", hdr.Name, StreamTrailerFileName)
+	}
+
+	return nil
+}
+
+func writeTarFile(tarWriter *tar.Writer, name string, contents []byte) error {
+	tarHeader := &tar.Header{
+		Name: name,
+		Size: int64(len(contents)),
+	}
+	if err := tarWriter.WriteHeader(tarHeader); err != nil {
+		log.Error(err)
+		return err
+	}
+
+	if _, err := tarWriter.Write(contents); err != nil {
+		log.Error(err)
+		return err
+	}
+
+	return nil
+}
+
+func streamReadError(err error, name string) error {
+	if err == io.ErrUnexpectedEOF {
+		return errors.Errorf("stream is truncated in %s", name)
+	}
+	return errors.Wrapf(err, "failed to read %s", name)
+}
+
+// contextReader fails once ctx is cancelled, so an import stops reading a stream that is still
+// arriving and cleans up its workspace
+type contextReader struct {
+	ctx    context.Context
+	reader io.Reader
+}
+
+func (r *contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.reader.Read(p)
+}
@@ -0,0 +1,484 @@
+package importer
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/docker/docker/layer"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStreamImage(t *testing.T) {
+	registry := newTestRegistry(t)
+	schema2Img := newTestImageSchema2(t,
+		map[string]string{"etc/hostname": "base"},
+		map[string]string{"app/main": "app"},
+	)
+	registry.addImage("schema2", schema2Img)
+	ociImg := newTestImageOCI(t, ocispec.MediaTypeImageLayer, "amd64",
+		map[string]string{"etc/hostname": "base"},
+		map[string]string{"app/main": "oci"},
+	)
+	registry.addImage("oci", ociImg)
+	schema1Img := newTestImageSchema1(t, map[string]string{"1": "1"}, map[string]string{}, map[string]string{"2": "2"})
+	registry.addImage("schema1", schema1Img)
+	hostImg := newTestImageOCI(t, ocispec.MediaTypeImageLayerGzip, runtime.GOARCH, map[string]string{"arch": runtime.GOARCH})
+	otherImg := newTestImageOCI(t, ocispec.MediaTypeImageLayerGzip, "s390x", map[string]string{"arch": "s390x"})
+	index := newTestIndex(t, map[string]*testImage{
+		"linux/s390x":             otherImg,
+		"linux/" + runtime.GOARCH: hostImg,
+	})
+	registry.addIndex("index", index, hostImg, otherImg)
+
+	tests := []struct {
+		name string
+		tag  string
+		img  *testImage
+	}{
+		{name: "schema2", tag: "schema2", img: schema2Img},
+		{name: "oci", tag: "oci", img: ociImg},
+		{name: "index", tag: "index", img: hostImg},
+		{name: "schema1", tag: "schema1"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sender := &Importer{Remote: registry.remote(t, "ns/img", test.tag)}
+			stream, err := sender.StreamLayers(context.Background())
+			require.NoError(t, err)
+			defer stream.Close()
+
+			receiver := &Importer{}
+			localStore, err := receiver.streamToTempStore(context.Background(), stream, registry.Host()+"/ns/img:"+test.tag)
+			if localStore != nil {
+				defer localStore.delete()
+			}
+			require.NoError(t, err)
+
+			if test.img != nil {
+				assertStoreImage(t, localStore, test.img)
+			} else {
+				assertStoreLayers(t, localStore, schema1Img.DiffIDs...)
+			}
+
+			contents, err := os.ReadFile(filepath.Join(localStore.Workspace, "manifest.json"))
+			require.NoError(t, err)
+			var manifest []manifestItem
+			require.NoError(t, json.Unmarshal(contents, &manifest))
+			assert.Equal(t, []string{registry.Host() + "/ns/img:" + test.tag}, manifest[0].RepoTags)
+		})
+	}
+}
+
+func TestStreamImageMatchesPull(t *testing.T) {
+	registry := newTestRegistry(t)
+	img := newTestImageSchema2(t,
+		map[string]string{"etc/hostname": "base"},
+		map[string]string{"app/main": "app"},
+	)
+	registry.addImage("1.0", img)
+
+	i := &Importer{Remote: registry.remote(t, "ns/img", "1.0")}
+	pulledStore, err := i.PullImage(context.Background())
+	if pulledStore != nil {
+		defer pulledStore.delete()
+	}
+	require.NoError(t, err)
+
+	stream, err := i.StreamLayers(context.Background())
+	require.NoError(t, err)
+	defer stream.Close()
+
+	streamedStore, err := (&Importer{}).streamToTempStore(context.Background(), stream, registry.Host()+"/ns/img:1.0")
+	if streamedStore != nil {
+		defer streamedStore.delete()
+	}
+	require.NoError(t, err)
+
+	// The layer IDs are derived from the config, so both stores have the same layout
+	for _, name := range []string{"manifest.json", "repositories"} {
+		pulled, err := os.ReadFile(filepath.Join(pulledStore.Workspace, name))
+		require.NoError(t, err)
+		streamed, err := os.ReadFile(filepath.Join(streamedStore.Workspace, name))
+		require.NoError(t, err)
+		assert.Equal(t, string(pulled), string(streamed))
+	}
+}
+
+func TestStreamImageByIndexDigest(t *testing.T) {
+	registry := newTestRegistry(t)
+	img := newTestImageOCI(t, ocispec.MediaTypeImageLayerGzip, runtime.GOARCH, map[string]string{"arch": runtime.GOARCH})
+	index := newTestIndex(t, map[string]*testImage{"linux/" + runtime.GOARCH: img})
+	registry.addIndex("1.0", index, img)
+
+	sender := &Importer{Remote: registry.remoteByDigest(t, "ns/img", "", digest.FromBytes(index))}
+	stream, err := sender.StreamLayers(context.Background())
+	require.NoError(t, err)
+	defer stream.Close()
+
+	localStore, err := (&Importer{}).streamToTempStore(context.Background(), stream, registry.Host()+"/ns/img@"+digest.FromBytes(index).String())
+	if localStore != nil {
+		defer localStore.delete()
+	}
+	require.NoError(t, err)
+
+	assertStoreImage(t, localStore, img)
+}
+
+func TestStreamImageWrongReference(t *testing.T) {
+	registry := newTestRegistry(t)
+	img := newTestImageSchema2(t, map[string]string{"1": "1"})
+	registry.addImage("1.0", img)
+
+	sender := &Importer{Remote: registry.remote(t, "ns/img", "1.0")}
+	stream, err := sender.StreamLayers(context.Background())
+	require.NoError(t, err)
+	defer stream.Close()
+
+	// The receiver pins a different digest than the one streamed
+	localStore, err := (&Importer{}).streamToTempStore(context.Background(), stream, registry.Host()+"/ns/img@"+digest.FromString("other").String())
+	if localStore != nil {
+		defer localStore.delete()
+	}
+	require.Error(t, err)
+}
+
+type testStreamFile struct {
+	name     string
+	contents []byte
+}
+
+func readTestStream(t *testing.T, raw []byte) []testStreamFile {
+	var files []testStreamFile
+	tarReader := tar.NewReader(bytes.NewReader(raw))
+	for {
+		hdr, err := tarReader.Next()
+		if err == io.EOF {
+			return files
+		}
+		require.NoError(t, err)
+		contents, err := io.ReadAll(tarReader)
+		require.NoError(t, err)
+		files = append(files, testStreamFile{name: hdr.Name, contents: contents})
+	}
+}
+
+func writeTestStream(t *testing.T, files []testStreamFile) []byte {
+	var buf bytes.Buffer
+	tarWriter := tar.NewWriter(&buf)
+	for _, file := range files {
+		require.NoError(t, tarWriter.WriteHeader(&tar.Header{Name: file.name, Size: int64(len(file.contents))}))
+		_, err := tarWriter.Write(file.contents)
+		require.NoError(t, err)
+	}
+	require.NoError(t, tarWriter.Close())
+	return buf.Bytes()
+}
+
+// bumpSize changes the first size in the JSON without changing its length
+func bumpSize(t *testing.T, contents []byte) []byte {
+	start := bytes.Index(contents, []byte(`"size":`))
+	require.True(t, start >= 0)
+	end := start + len(`"size":`)
+	for end < len(contents) && contents[end] >= '0' && contents[end] <= '9' {
+		end++
+	}
+
+	bumped := append([]byte{}, contents...)
+	bumped[end-1] = '0' + (bumped[end-1]-'0'+1)%10
+	return bumped
+}
+
+func TestStreamImageRejected(t *testing.T) {
+	registry := newTestRegistry(t)
+	img := newTestImageSchema2(t,
+		map[string]string{"etc/hostname": "base"},
+		map[string]string{"app/main": "app"},
+	)
+	registry.addImage("1.0", img)
+
+	sender := &Importer{Remote: registry.remote(t, "ns/img", "1.0")}
+	stream, err := sender.StreamLayers(context.Background())
+	require.NoError(t, err)
+	raw, err := io.ReadAll(stream)
+	require.NoError(t, err)
+	stream.Close()
+
+	files := readTestStream(t, raw)
+	require.Len(t, files, 6)
+	require.Equal(t, StreamHeaderFileName, files[0].name)
+	require.Equal(t, ManifestFileName, files[1].name)
+	require.Equal(t, StreamTrailerFileName, files[5].name)
+
+	tests := []struct {
+		name   string
+		mutate func(files []testStreamFile) []testStreamFile
+		raw    func(raw []byte) []byte
+		expect string
+	}{
+		{
+			name:   "truncated in layer",
+			raw:    func(raw []byte) []byte { return raw[:len(raw)/2+len(raw)/4] },
+			expect: "truncated",
+		},
+		{
+			name:   "no trailer",
+			mutate: func(files []testStreamFile) []testStreamFile { return files[:5] },
+			expect: `"_trailer.json" is missing`,
+		},
+		{
+			name: "layers reordered",
+			mutate: func(files []testStreamFile) []testStreamFile {
+				files[3], files[4] = files[4], files[3]
+				return files
+			},
+			expect: "out of order",
+		},
+		{
+			name: "manifest tampered",
+			mutate: func(files []testStreamFile) []testStreamFile {
+				files[1].contents = bumpSize(t, files[1].contents)
+				return files
+			},
+			expect: "_manifest.json was modified in transit",
+		},
+		{
+			name: "trailer tampered",
+			mutate: func(files []testStreamFile) []testStreamFile {
+				var trailer streamTrailer
+				require.NoError(t, json.Unmarshal(files[5].contents, &trailer))
+				trailer.Entries[3].Digest = digest.FromString("other")
+				files[5].contents, _ = json.Marshal(trailer)
+				return files
+			},
+			expect: "was modified in transit",
+		},
+		{
+			name: "file after trailer",
+			mutate: func(files []testStreamFile) []testStreamFile {
+				return append(files, testStreamFile{name: "extra", contents: []byte("extra")})
+			},
+			expect: `unexpected "extra"`,
+		},
+		{
+			name:   "no header",
+			mutate: func(files []testStreamFile) []testStreamFile { return files[1:] },
+			expect: "written by an older version",
+		},
+		{
+			name: "unsupported version",
+			mutate: func(files []testStreamFile) []testStreamFile {
+				var header streamHeader
+				require.NoError(t, json.Unmarshal(files[0].contents, &header))
+				header.Version = StreamFormatVersion + 1
+				files[0].contents, _ = json.Marshal(header)
+				return files
+			},
+			expect: "unsupported stream format version",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			streamed := raw
+			if test.mutate != nil {
+				streamed = writeTestStream(t, test.mutate(readTestStream(t, raw)))
+			}
+			if test.raw != nil {
+				streamed = test.raw(streamed)
+			}
+
+			localStore, err := (&Importer{}).streamToTempStore(context.Background(), bytes.NewReader(streamed), registry.Host()+"/ns/img:1.0")
+			if localStore != nil {
+				defer localStore.delete()
+			}
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), test.expect)
+		})
+	}
+}
+
+func TestStreamImageSkipping(t *testing.T) {
+	registry := newTestRegistry(t)
+	base := map[string]string{"etc/hostname": "base"}
+	baseImg := newTestImageSchema2(t, base)
+	registry.addImage("base", baseImg)
+	img := newTestImageSchema2(t, base, map[string]string{"app/main": "app"})
+	registry.addImage("1.0", img)
+
+	// The receiver has pulled the base image before
+	receiver := &Importer{Remote: registry.remote(t, "ns/img", "base"), Cache: newTestBlobCache(t, 0)}
+	baseStore, err := receiver.PullImage(context.Background())
+	if baseStore != nil {
+		defer baseStore.delete()
+	}
+	require.NoError(t, err)
+
+	held, err := receiver.LocalLayers()
+	require.NoError(t, err)
+	assert.Contains(t, held, digest.FromBytes(img.Layers[0]))
+	assert.Contains(t, held, img.DiffIDs[0])
+
+	var blobRequests []string
+	registry.onBlob = func() {
+		blobRequests = append(blobRequests, "blob")
+	}
+
+	sender := &Importer{Remote: registry.remote(t, "ns/img", "1.0")}
+	stream, err := sender.StreamLayersSkipping(context.Background(), held)
+	require.NoError(t, err)
+	raw, err := io.ReadAll(stream)
+	require.NoError(t, err)
+	stream.Close()
+
+	// Only the config and the new layer are downloaded and sent
+	assert.Len(t, blobRequests, 2)
+	files := readTestStream(t, raw)
+	require.Len(t, files, 6)
+	assert.Equal(t, digest.FromBytes(img.Layers[0]).String(), files[3].name)
+	assert.Empty(t, files[3].contents)
+
+	localStore, err := receiver.streamToTempStore(context.Background(), bytes.NewReader(raw), registry.Host()+"/ns/img:1.0")
+	if localStore != nil {
+		defer localStore.delete()
+	}
+	require.NoError(t, err)
+	assertStoreImage(t, localStore, img)
+
+	// Without the layer in its cache, the receiver cannot fill it in
+	localStore, err = (&Importer{Cache: newTestBlobCache(t, 0)}).streamToTempStore(context.Background(), bytes.NewReader(raw), registry.Host()+"/ns/img:1.0")
+	if localStore != nil {
+		defer localStore.delete()
+	}
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "not in the cache")
+}
+
+func TestStreamImageSkippingByDiffID(t *testing.T) {
+	registry := newTestRegistry(t)
+	files := map[string]string{"etc/hostname": "base"}
+	img := newTestImageSchema2(t, files, map[string]string{"app/main": "app"})
+	registry.addImage("1.0", img)
+
+	// The receiver has the base layer uncompressed, so only its diff ID matches
+	uncompressed, diffID := newTestLayer(t, false, files)
+	require.Equal(t, img.DiffIDs[0], diffID)
+	blobPath := filepath.Join(t.TempDir(), "blob")
+	require.NoError(t, os.WriteFile(blobPath, uncompressed, 0644))
+	receiver := &Importer{Cache: newTestBlobCache(t, 0)}
+	require.NoError(t, receiver.Cache.Add(diffID, blobPath, layer.DiffID(diffID)))
+
+	sender := &Importer{Remote: registry.remote(t, "ns/img", "1.0")}
+	stream, err := sender.StreamLayersSkipping(context.Background(), []digest.Digest{diffID})
+	require.NoError(t, err)
+	defer stream.Close()
+
+	localStore, err := receiver.streamToTempStore(context.Background(), stream, registry.Host()+"/ns/img:1.0")
+	if localStore != nil {
+		defer localStore.delete()
+	}
+	require.NoError(t, err)
+	assertStoreImage(t, localStore, img)
+}
+
+func TestStreamLayersCancelled(t *testing.T) {
+	registry := newTestRegistry(t)
+	img := newTestImageSchema2(t, map[string]string{"1": "1"})
+	registry.addImage("1.0", img)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	registry.hangBlobs(t, 1, cancel)
+
+	sender := &Importer{Remote: registry.remote(t, "ns/img", "1.0")}
+	stream, err := sender.StreamLayers(ctx)
+	require.NoError(t, err)
+	defer stream.Close()
+
+	requireCancelled(t, func() error {
+		_, err := io.ReadAll(stream)
+		return err
+	})
+}
+
+func TestImportFromStreamCancelled(t *testing.T) {
+	registry := newTestRegistry(t)
+	img := newTestImageSchema2(t, map[string]string{"1": "1"}, map[string]string{"2": "2"})
+	registry.addImage("1.0", img)
+
+	stream, err := (&Importer{Remote: registry.remote(t, "ns/img", "1.0")}).StreamLayers(context.Background())
+	require.NoError(t, err)
+	raw, err := io.ReadAll(stream)
+	require.NoError(t, err)
+	stream.Close()
+
+	tempDir := t.TempDir()
+	t.Setenv("TMPDIR", tempDir)
+
+	// The import is cancelled half way through the stream
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	reader := io.MultiReader(io.LimitReader(bytes.NewReader(raw), int64(len(raw)/2)), &cancelReader{cancel: cancel, reader: bytes.NewReader(raw[len(raw)/2:])})
+
+	loader := &testLoader{}
+	receiver := &Importer{Loader: loader}
+	requireCancelled(t, func() error {
+		return receiver.ImportFromStream(ctx, reader, registry.Host()+"/ns/img:1.0")
+	})
+
+	assert.Empty(t, loader.files)
+
+	entries, err := os.ReadDir(tempDir)
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+// cancelReader cancels its context on the first read
+type cancelReader struct {
+	cancel context.CancelFunc
+	reader io.Reader
+}
+
+func (r *cancelReader) Read(p []byte) (int, error) {
+	r.cancel()
+	return r.reader.Read(p)
+}
+
+func TestStreamLayersResume(t *testing.T) {
+	for _, ignoreRange := range []bool{false, true} {
+		t.Run(fmt.Sprintf("range ignored %v", ignoreRange), func(t *testing.T) {
+			registry := newTestRegistry(t)
+			img := newTestImageSchema2(t, map[string]string{"1": "1"})
+			registry.addImage("1.0", img)
+
+			// The config is cut off half way
+			registry.dropBlob = 1
+			registry.ignoreRange = ignoreRange
+
+			sender := &Importer{Remote: registry.remote(t, "ns/img", "1.0")}
+			stream, err := sender.StreamLayers(context.Background())
+			require.NoError(t, err)
+			defer stream.Close()
+
+			localStore, err := (&Importer{}).streamToTempStore(context.Background(), stream, registry.Host()+"/ns/img:1.0")
+			if localStore != nil {
+				defer localStore.delete()
+			}
+			require.NoError(t, err)
+			assertStoreImage(t, localStore, img)
+
+			assert.Equal(t, []string{fmt.Sprintf("bytes=%d-", len(img.Config)/2)}, registry.ranges)
+		})
+	}
+}
@@ -2,6 +2,8 @@ package params
 
 import (
 	goflag "flag"
+	"os"
+	"path/filepath"
 
 	"github.com/blang/semver"
 )
@@ -19,7 +21,8 @@ var (
 )
 
 type Params struct {
-	DockerCertsDir string
+	DockerCertsDir string // DockerCertsDir has the CA bundles and client certificates of each registry
+	DockerCertPath string // DockerCertPath has the cert.pem, key.pem and ca.pem for a TLS DockerEndpoint
 	DockerEndpoint string
 	LogLevel       string
 	Version        semver.Version
@@ -29,10 +32,23 @@ func init() {
 	params.Version = semver.MustParse(Version)
 
 	goflag.StringVar(&params.DockerCertsDir, "docker-certificates-directory", DefaultDockerCertsDir, "docker certificate directory (relative to the host's filesystem)")
+	goflag.StringVar(&params.DockerCertPath, "docker-cert-path", DefaultDockerCertPath(), "directory with the TLS client certificate for the docker endpoint")
 	goflag.StringVar(&params.DockerEndpoint, "docker-endpoint", DefaultDockerEndpoint, "docker endpoint")
 	goflag.StringVar(&params.LogLevel, "log-level", DefaultLogLevel, "log level")
 }
 
+// DefaultDockerCertPath returns DOCKER_CERT_PATH, or ~/.docker like the docker CLI
+func DefaultDockerCertPath() string {
+	if certPath := os.Getenv("DOCKER_CERT_PATH"); certPath != "" {
+		return certPath
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".docker")
+}
+
 func Get() *Params {
 	return params
 }
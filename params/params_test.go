@@ -0,0 +1,20 @@
+package params
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDefaultDockerCertPath(t *testing.T) {
+	t.Setenv("DOCKER_CERT_PATH", "/certs")
+	assert.Equal(t, "/certs", DefaultDockerCertPath())
+
+	t.Setenv("DOCKER_CERT_PATH", "")
+	home, err := os.UserHomeDir()
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(home, ".docker"), DefaultDockerCertPath())
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/replicatedcom/harpoon/importer"
+
+	units "github.com/docker/go-units"
+)
+
+const (
+	progressBarWidth = 30
+
+	// progressRedrawInterval limits how often the bars are redrawn on a terminal
+	progressRedrawInterval = 100 * time.Millisecond
+	// progressLineInterval is how often a plain line is printed for a layer that is downloading
+	progressLineInterval = 5 * time.Second
+)
+
+// progressPrinter renders importer progress events.  On a terminal it draws a progress bar per
+// layer, redrawn in place.  Otherwise it prints a line when a layer changes state, and
+// periodically while it downloads.
+type progressPrinter struct {
+	out io.Writer
+	tty bool
+
+	layers   []*layerProgress
+	byID     map[string]*layerProgress
+	drawn    int
+	lastDraw time.Time
+}
+
+type layerProgress struct {
+	id          string
+	status      string
+	current     int64
+	total       int64
+	started     time.Time
+	lastPrinted time.Time
+}
+
+func newProgressPrinter(out io.Writer, tty bool) *progressPrinter {
+	return &progressPrinter{
+		out:  out,
+		tty:  tty,
+		byID: map[string]*layerProgress{},
+	}
+}
+
+// Handle is an importer.ProgressFunc
+func (p *progressPrinter) Handle(event importer.ProgressEvent) {
+	switch event.Type {
+	case importer.ProgressManifestFetched:
+		p.println(fmt.Sprintf("Fetched manifest %s", event.ID))
+		return
+	case importer.ProgressLoadFinished:
+		p.println("Loaded image")
+		return
+	}
+
+	layer, ok := p.byID[event.ID]
+	if !ok {
+		layer = &layerProgress{id: event.ID, total: -1}
+		p.byID[event.ID] = layer
+		p.layers = append(p.layers, layer)
+	}
+
+	status := layer.status
+	switch event.Type {
+	case importer.ProgressLayerStarted:
+		status = "Waiting"
+	case importer.ProgressLayerBytes:
+		status = "Downloading"
+		if layer.started.IsZero() {
+			layer.started = time.Now()
+		}
+		layer.current = event.Current
+	case importer.ProgressLayerVerified:
+		status = "Verified"
+	case importer.ProgressLayerExtracted:
+		status = "Extracted"
+	}
+	if event.Total >= 0 {
+		layer.total = event.Total
+	}
+
+	changed := status != layer.status
+	layer.status = status
+
+	if p.tty {
+		if changed || time.Since(p.lastDraw) >= progressRedrawInterval {
+			p.draw()
+		}
+		return
+	}
+
+	if changed || time.Since(layer.lastPrinted) >= progressLineInterval {
+		fmt.Fprintln(p.out, layer.line(false))
+		layer.lastPrinted = time.Now()
+	}
+}
+
+// Close draws the final state of the bars
+func (p *progressPrinter) Close() {
+	if p.tty {
+		p.draw()
+	}
+}
+
+// println prints a line above the bars
+func (p *progressPrinter) println(line string) {
+	if p.tty {
+		p.clear()
+	}
+	fmt.Fprintln(p.out, line)
+	if p.tty {
+		p.draw()
+	}
+}
+
+func (p *progressPrinter) clear() {
+	if p.drawn > 0 {
+		fmt.Fprintf(p.out, "\x1b[%dA\x1b[J", p.drawn)
+	}
+	p.drawn = 0
+}
+
+func (p *progressPrinter) draw() {
+	p.clear()
+	for _, layer := range p.layers {
+		fmt.Fprintf(p.out, "\x1b[2K%s\n", layer.line(true))
+	}
+	p.drawn = len(p.layers)
+	p.lastDraw = time.Now()
+}
+
+// line formats the progress of the layer, with a bar when withBar is set
+func (l *layerProgress) line(withBar bool) string {
+	line := fmt.Sprintf("%s: %-11s", shortID(l.id), l.status)
+	if l.status != "Downloading" {
+		return strings.TrimRight(line, " ")
+	}
+
+	if withBar && l.total > 0 {
+		line += " " + progressBar(l.current, l.total)
+	}
+
+	if l.total > 0 {
+		line += fmt.Sprintf(" %s/%s", units.HumanSize(float64(l.current)), units.HumanSize(float64(l.total)))
+	} else {
+		line += " " + units.HumanSize(float64(l.current))
+	}
+
+	elapsed := time.Since(l.started).Seconds()
+	if elapsed <= 0 || l.current == 0 {
+		return line
+	}
+
+	speed := float64(l.current) / elapsed
+	line += fmt.Sprintf(" %s/s", units.HumanSize(speed))
+	if l.total > l.current {
+		eta := time.Duration(float64(l.total-l.current)/speed) * time.Second
+		line += fmt.Sprintf(" ETA %s", eta.Round(time.Second))
+	}
+
+	return line
+}
+
+func progressBar(current, total int64) string {
+	filled := int(float64(progressBarWidth) * float64(current) / float64(total))
+	if filled > progressBarWidth {
+		filled = progressBarWidth
+	}
+
+	bar := strings.Repeat("=", filled)
+	if filled < progressBarWidth {
+		bar += ">" + strings.Repeat(" ", progressBarWidth-filled-1)
+	}
+	return "[" + bar + "]"
+}
+
+// shortID shortens a digest to the first 12 characters of its hex, like docker does
+func shortID(id string) string {
+	if i := strings.Index(id, ":"); i >= 0 {
+		id = id[i+1:]
+	}
+	if len(id) > 12 {
+		id = id[:12]
+	}
+	return id
+}
@@ -0,0 +1,25 @@
+package proxy
+
+import (
+	"testing"
+
+	"github.com/docker/distribution/manifest/schema2"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestManifestResponseVerify(t *testing.T) {
+	body := []byte(`{"schemaVersion":2}`)
+	dgst := digest.FromBytes(body)
+
+	m := &ManifestResponse{ManifestId: dgst.String(), ContentType: schema2.MediaTypeManifest, SignedJson: body}
+	assert.NoError(t, m.verify("latest"))
+	assert.NoError(t, m.verify(dgst.String()))
+	assert.Error(t, m.verify(digest.FromString("other").String()))
+
+	m = &ManifestResponse{ManifestId: digest.FromString("other").String(), ContentType: schema2.MediaTypeManifest, SignedJson: body}
+	assert.Error(t, m.verify("latest"))
+
+	m = &ManifestResponse{ContentType: schema2.MediaTypeManifest, SignedJson: body}
+	assert.NoError(t, m.verify("latest"))
+}
@@ -1,13 +1,21 @@
 package proxy
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"io"
+	"mime"
 	"net/http"
 	"net/textproto"
 	"strconv"
 
+	"github.com/docker/distribution/manifest/manifestlist"
+	"github.com/docker/distribution/manifest/schema1"
+	"github.com/docker/distribution/manifest/schema2"
 	"github.com/docker/distribution/reference"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/pkg/errors"
 	"github.com/replicatedcom/harpoon/log"
 	"github.com/replicatedcom/harpoon/remote"
@@ -23,6 +31,47 @@ type ManifestResponse struct {
 	SignedJson  []byte
 }
 
+// DefaultManifestMediaTypes are requested from the upstream registry when the client does not send
+// an Accept header.
+var DefaultManifestMediaTypes = []string{
+	schema2.MediaTypeManifest,
+	manifestlist.MediaTypeManifestList,
+	ocispec.MediaTypeImageManifest,
+	ocispec.MediaTypeImageIndex,
+	schema1.MediaTypeSignedManifest,
+	schema1.MediaTypeManifest,
+}
+
+// verify checks the manifest against the requested digest, or the digest reported by the registry
+// when pulling by tag.
+func (m *ManifestResponse) verify(ref string) error {
+	expected, err := digest.Parse(ref)
+	if err != nil {
+		if m.ManifestId == "" {
+			return nil
+		}
+		if expected, err = digest.Parse(m.ManifestId); err != nil {
+			return errors.Wrapf(err, "invalid Docker-Content-Digest %q", m.ManifestId)
+		}
+	}
+
+	payload := m.SignedJson
+	if mediaType, _, _ := mime.ParseMediaType(m.ContentType); mediaType == schema1.MediaTypeSignedManifest {
+		// The digest of a signed manifest does not include the signatures
+		var signed schema1.SignedManifest
+		if err := json.Unmarshal(m.SignedJson, &signed); err != nil {
+			return errors.Wrap(err, "failed to unmarshal schema1 manifest")
+		}
+		payload = signed.Canonical
+	}
+
+	if computed := expected.Algorithm().FromBytes(payload); computed != expected {
+		return errors.Errorf("manifest digest does not match expected digest: %s != %s", expected, computed)
+	}
+
+	return nil
+}
+
 type BlobResponse struct {
 	Reader        io.ReadCloser
 	ContentType   string
@@ -39,28 +88,25 @@ func (b *BlobResponse) Close() error {
 	return b.Reader.Close()
 }
 
-func (p *Proxy) GetManifestV2(namespace, imagename, ref string, accept []string) (*ManifestResponse, error) {
-	var uri string
-	// ECR repos are not given a namespace unless the following repo naming convention is followed:
-	// `my-example-namespace/my-repo`
-	if len(namespace) == 0 {
-		uri = fmt.Sprintf("https://%s/v2/%s/manifests/%s", p.Remote.Hostname, imagename, ref)
-	} else {
-		uri = fmt.Sprintf("https://%s/v2/%s/%s/manifests/%s", p.Remote.Hostname, namespace, imagename, ref)
-	}
+// GetManifestV2 gets the manifest for a tag or digest.  The repository is the full path in the
+// registry, which may have any number of components.  ECR repos, for example, often have only one.
+// The request is cancelled with ctx.
+func (p *Proxy) GetManifestV2(ctx context.Context, repository, ref string, accept []string) (*ManifestResponse, error) {
+	uri := fmt.Sprintf("%s/v2/%s/manifests/%s", p.Remote.BaseURL(), repository, ref)
 	log.Debugf("Getting manifest from %s", uri)
 
-	req, err := p.Remote.NewHttpRequest("GET", uri, nil)
+	req, err := p.Remote.NewHttpRequest(ctx, "GET", uri, nil)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to create request")
 	}
 
 	// Get manifest schema version requested from client
-	if len(accept) > 0 {
-		req.Header[textproto.CanonicalMIMEHeaderKey("Accept")] = accept
+	if len(accept) == 0 {
+		accept = DefaultManifestMediaTypes
 	}
+	req.Header[textproto.CanonicalMIMEHeaderKey("Accept")] = accept
 
-	log.Debugf("Pulling %s with accept content type: %q", imagename, accept)
+	log.Debugf("Pulling %s with accept content type: %q", repository, accept)
 
 	// We can request pull scope in case oauth implementation does not provide scope
 	// in the authorization failure.
@@ -72,7 +118,7 @@ func (p *Proxy) GetManifestV2(namespace, imagename, ref string, accept []string)
 	}
 	defer resp.Body.Close()
 
-	log.Debugf("Got %s with content type: %q", imagename, resp.Header.Get("Content-Type"))
+	log.Debugf("Got %s with content type: %q", repository, resp.Header.Get("Content-Type"))
 
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
@@ -93,11 +139,16 @@ func (p *Proxy) GetManifestV2(namespace, imagename, ref string, accept []string)
 		SignedJson:  body,
 	}
 
+	if err := result.verify(ref); err != nil {
+		return nil, errors.Wrapf(err, "failed to verify manifest for %s", repository)
+	}
+
 	return result, nil
 }
 
-func (p *Proxy) GetBlobV2(namespace, imagename, digestFull string, additionalHeaders http.Header) (*BlobResponse, error) {
-	req, err := p.makeBlobRequest("GET", namespace, imagename, digestFull, additionalHeaders)
+// GetBlobV2 gets a blob.  The request is cancelled with ctx, and so is reading the response.
+func (p *Proxy) GetBlobV2(ctx context.Context, repository, digestFull string, additionalHeaders http.Header) (*BlobResponse, error) {
+	req, err := p.makeBlobRequest(ctx, "GET", repository, digestFull, additionalHeaders)
 	if err != nil {
 		return nil, errors.Wrapf(err, "failed to make proxied blob request for %s", req.URL.String())
 	}
@@ -122,18 +173,11 @@ func (p *Proxy) GetBlobV2(namespace, imagename, digestFull string, additionalHea
 	return p.makeBlobResponse(resp, req.URL.String()), nil
 }
 
-func (p *Proxy) makeBlobRequest(httpMethod, namespace, imagename, digestFull string, additionalHeaders http.Header) (*http.Request, error) {
-	var uri string
-	// ECR repos are not given a namespace unless the following repo naming convention is followed:
-	// `my-example-namespace/my-repo`
-	if len(namespace) == 0 {
-		uri = fmt.Sprintf("https://%s/v2/%s/blobs/%s", p.Remote.Hostname, imagename, digestFull)
-	} else {
-		uri = fmt.Sprintf("https://%s/v2/%s/%s/blobs/%s", p.Remote.Hostname, namespace, imagename, digestFull)
-	}
+func (p *Proxy) makeBlobRequest(ctx context.Context, httpMethod, repository, digestFull string, additionalHeaders http.Header) (*http.Request, error) {
+	uri := fmt.Sprintf("%s/v2/%s/blobs/%s", p.Remote.BaseURL(), repository, digestFull)
 	log.Debugf("Getting blob from %s", uri)
 
-	req, err := p.Remote.NewHttpRequest(httpMethod, uri, nil)
+	req, err := p.Remote.NewHttpRequest(ctx, httpMethod, uri, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -1,13 +1,13 @@
 package proxy
 
 import (
+	"context"
 	"encoding/json"
 	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
-	"strings"
 	"testing"
 
 	"github.com/docker/distribution/manifest/schema2"
@@ -36,15 +36,14 @@ func TestPull(t *testing.T) {
 	err = dockerRemote.InitClient()
 	require.NoError(t, err)
 
-	// hack parsing
-	parts := strings.Split(os.Getenv("PRIVATE_IMAGE"), "/") // like, quay.io/replicatedcom/market-api:973f05b
-	imageParts := strings.Split(parts[2], ":")
+	repository := reference.Path(dockerRemote.Ref) // like, quay.io/replicatedcom/market-api:973f05b
+	tag := dockerRemote.Ref.(reference.Tagged).Tag()
 
 	p := &Proxy{
 		Remote: dockerRemote,
 	}
 
-	manifestResult, err := p.GetManifestV2(parts[1], imageParts[0], imageParts[1], []string{schema2.MediaTypeManifest})
+	manifestResult, err := p.GetManifestV2(context.Background(), repository, tag, []string{schema2.MediaTypeManifest})
 	require.NoError(t, err)
 	log.Printf("manifest JSON:\n%s", manifestResult.SignedJson)
 
@@ -64,7 +63,7 @@ func TestPull(t *testing.T) {
 
 	// this will download 2 layers...
 	for i := 1; i < 3; i++ {
-		blobResult, err := p.GetBlobV2(parts[1], imageParts[0], manifest.FSLayers[i].BlobSum, nil)
+		blobResult, err := p.GetBlobV2(context.Background(), repository, manifest.FSLayers[i].BlobSum, nil)
 		require.NoError(t, err)
 
 		log.Printf("blobResult:\n%#v", blobResult)
@@ -92,7 +91,7 @@ func Test_GetBlobV2(t *testing.T) {
 	err := p.Remote.InitClient()
 	assert.NoError(t, err)
 
-	resp, err := p.GetBlobV2("replicated-qa", "qa-ubuntu", "sha256:bc025862c3e8ec4a8754ea4756e33da6c41cba38330d7e324abd25c8e0b93300", nil)
+	resp, err := p.GetBlobV2(context.Background(), "replicated-qa/qa-ubuntu", "sha256:bc025862c3e8ec4a8754ea4756e33da6c41cba38330d7e324abd25c8e0b93300", nil)
 	assert.Error(t, err)
 	assert.Nil(t, resp)
 
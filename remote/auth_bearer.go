@@ -3,6 +3,7 @@
 package remote
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -31,6 +32,9 @@ const defaultClientID = "registry-client"
 // those implementations, a token must live at least this long.
 const minimumTokenLifetimeSeconds = 60
 
+// defaultTokenFetchTimeout limits token requests made with a context that has no deadline
+const defaultTokenFetchTimeout = 15 * time.Second
+
 // Private interface for time used by this package to enable tests to provide their own implementation.
 type clock interface {
 	Now() time.Time
@@ -41,6 +45,7 @@ type tokenHandler struct {
 	creds     auth.CredentialStore
 	transport http.RoundTripper
 	clock     clock
+	retry     RetryPolicy
 
 	offlineAccess bool
 	forceOAuth    bool
@@ -77,11 +82,12 @@ func NewTokenHandlerWithOptions(options auth.TokenHandlerOptions) *tokenHandler
 func (th *tokenHandler) client() *http.Client {
 	return &http.Client{
 		Transport: th.transport,
-		Timeout:   15 * time.Second,
 	}
 }
 
-func (th *tokenHandler) GetToken(params map[string]string, additionalScopes ...string) (string, error) {
+// GetToken returns a token for the scopes, fetching a new one when needed.  Token requests are
+// cancelled with ctx, and time out after defaultTokenFetchTimeout when ctx has no deadline.
+func (th *tokenHandler) GetToken(ctx context.Context, params map[string]string, additionalScopes ...string) (string, error) {
 	scopes := make([]string, 0, len(th.scopes)+len(additionalScopes))
 	for _, scope := range th.scopes {
 		scopes = append(scopes, scope.String())
@@ -94,7 +100,7 @@ func (th *tokenHandler) GetToken(params map[string]string, additionalScopes ...s
 
 	now := th.clock.Now()
 	if now.After(th.tokenExpiration) || addedScopes {
-		token, expiration, err := th.fetchToken(params, scopes)
+		token, expiration, err := th.fetchTokenWithTimeout(ctx, params, scopes)
 		if err != nil {
 			return "", err
 		}
@@ -111,6 +117,18 @@ func (th *tokenHandler) GetToken(params map[string]string, additionalScopes ...s
 	return th.tokenCache, nil
 }
 
+// fetchTokenWithTimeout fetches a token for the scopes, without caching it.  It times out after
+// defaultTokenFetchTimeout when ctx has no deadline.
+func (th *tokenHandler) fetchTokenWithTimeout(ctx context.Context, params map[string]string, scopes []string) (string, time.Time, error) {
+	if _, hasDeadline := ctx.Deadline(); !hasDeadline {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, defaultTokenFetchTimeout)
+		defer cancel()
+	}
+
+	return th.fetchToken(ctx, params, scopes)
+}
+
 type postTokenResponse struct {
 	AccessToken  string    `json:"access_token"`
 	RefreshToken string    `json:"refresh_token"`
@@ -119,7 +137,7 @@ type postTokenResponse struct {
 	Scope        string    `json:"scope"`
 }
 
-func (th *tokenHandler) fetchTokenWithOAuth(realm *url.URL, refreshToken, service string, scopes []string) (token string, expiration time.Time, err error) {
+func (th *tokenHandler) fetchTokenWithOAuth(ctx context.Context, realm *url.URL, refreshToken, service string, scopes []string) (token string, expiration time.Time, err error) {
 	form := url.Values{}
 	form.Set("scope", strings.Join(scopes, " "))
 	form.Set("service", service)
@@ -147,7 +165,13 @@ func (th *tokenHandler) fetchTokenWithOAuth(realm *url.URL, refreshToken, servic
 		return "", time.Time{}, fmt.Errorf("no supported grant type")
 	}
 
-	resp, err := th.client().PostForm(realm.String(), form)
+	req, err := http.NewRequestWithContext(ctx, "POST", realm.String(), strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := th.retry.do(req, th.client().Do)
 	if err != nil {
 		return "", time.Time{}, err
 	}
@@ -190,9 +214,9 @@ type getTokenResponse struct {
 	RefreshToken string    `json:"refresh_token"`
 }
 
-func (th *tokenHandler) fetchTokenWithBasicAuth(realm *url.URL, service string, scopes []string) (token string, expiration time.Time, err error) {
+func (th *tokenHandler) fetchTokenWithBasicAuth(ctx context.Context, realm *url.URL, service string, scopes []string) (token string, expiration time.Time, err error) {
 
-	req, err := http.NewRequest("GET", realm.String(), nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", realm.String(), nil)
 	if err != nil {
 		return "", time.Time{}, err
 	}
@@ -226,7 +250,7 @@ func (th *tokenHandler) fetchTokenWithBasicAuth(realm *url.URL, service string,
 
 	req.URL.RawQuery = reqParams.Encode()
 
-	resp, err := th.client().Do(req)
+	resp, err := th.retry.do(req, th.client().Do)
 	if err != nil {
 		return "", time.Time{}, err
 	}
@@ -272,7 +296,7 @@ func (th *tokenHandler) fetchTokenWithBasicAuth(realm *url.URL, service string,
 	return tr.Token, tr.IssuedAt.Add(time.Duration(tr.ExpiresIn) * time.Second), nil
 }
 
-func (th *tokenHandler) fetchToken(params map[string]string, scopes []string) (token string, expiration time.Time, err error) {
+func (th *tokenHandler) fetchToken(ctx context.Context, params map[string]string, scopes []string) (token string, expiration time.Time, err error) {
 	realm, ok := params["realm"]
 	if !ok {
 		return "", time.Time{}, errors.New("no realm specified for token auth challenge")
@@ -293,8 +317,8 @@ func (th *tokenHandler) fetchToken(params map[string]string, scopes []string) (t
 	}
 
 	if refreshToken != "" || th.forceOAuth {
-		return th.fetchTokenWithOAuth(realmURL, refreshToken, service, scopes)
+		return th.fetchTokenWithOAuth(ctx, realmURL, refreshToken, service, scopes)
 	}
 
-	return th.fetchTokenWithBasicAuth(realmURL, service, scopes)
+	return th.fetchTokenWithBasicAuth(ctx, realmURL, service, scopes)
 }
@@ -1,6 +1,7 @@
 package remote
 
 import (
+	"context"
 	"os"
 	"testing"
 
@@ -22,7 +23,7 @@ func TestAuth(t *testing.T) {
 
 	err = dockerRemote.InitClient()
 	require.NoError(t, err)
-	err = dockerRemote.Auth()
+	err = dockerRemote.Auth(context.Background())
 	require.NoError(t, err)
-	log.Debugf("remote info:%#v", dockerRemote)
+	log.Debugf("remote info:%#v", &dockerRemote)
 }
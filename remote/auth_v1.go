@@ -0,0 +1,90 @@
+package remote
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/replicatedcom/harpoon/log"
+)
+
+// AuthV1 performs the v1 registry handshake for the repository.  The index responds with the
+// endpoints that serve the image data and a token that is valid on those endpoints.
+func (dockerRemote *DockerRemote) AuthV1(ctx context.Context) error {
+	uri := fmt.Sprintf("%s/v1/repositories/%s/images", dockerRemote.BaseURL(), dockerRemote.Repository)
+
+	req, err := dockerRemote.NewHttpRequest(ctx, "GET", uri, nil)
+	if err != nil {
+		return errors.Wrap(err, "failed to create http request")
+	}
+
+	req.Header.Set("X-Docker-Token", "true")
+	if err := dockerRemote.loadCredentials(); err != nil {
+		return err
+	}
+	if dockerRemote.Username != "" {
+		req.SetBasicAuth(dockerRemote.Username, dockerRemote.Password)
+	}
+
+	resp, err := dockerRemote.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusUnauthorized {
+		return ErrUnauthorized
+	} else if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("unexpected status code for %s: %d", uri, resp.StatusCode)
+	}
+
+	dockerRemote.RemoteEndpoints = resp.Header.Get("X-Docker-Endpoints")
+	dockerRemote.RemoteToken = resp.Header.Get("X-Docker-Token")
+
+	// Only the name=value pairs are sent back in the Cookie header
+	cookies := []string{}
+	for _, cookie := range resp.Cookies() {
+		cookies = append(cookies, fmt.Sprintf("%s=%s", cookie.Name, cookie.Value))
+	}
+	dockerRemote.RemoteCookie = strings.Join(cookies, "; ")
+
+	log.Debugf("v1 handshake with %s returned endpoints %q", dockerRemote.Hostname, dockerRemote.RemoteEndpoints)
+
+	return nil
+}
+
+// GetEndpointsV1 returns the hosts serving v1 image data, falling back to the index itself.
+func (dockerRemote *DockerRemote) GetEndpointsV1() []string {
+	endpoints := []string{}
+	for _, endpoint := range strings.Split(dockerRemote.RemoteEndpoints, ",") {
+		endpoint = strings.TrimSpace(endpoint)
+		if endpoint != "" {
+			endpoints = append(endpoints, endpoint)
+		}
+	}
+	if len(endpoints) == 0 {
+		endpoints = append(endpoints, dockerRemote.Hostname)
+	}
+	return endpoints
+}
+
+// NewHttpRequestV1 creates a request carrying the token and cookie from the v1 handshake.
+func (dockerRemote *DockerRemote) NewHttpRequestV1(ctx context.Context, method, uri string) (*http.Request, error) {
+	req, err := dockerRemote.NewHttpRequest(ctx, method, uri, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if dockerRemote.RemoteToken != "" {
+		req.Header.Set("Authorization", fmt.Sprintf("Token %s", dockerRemote.RemoteToken))
+	} else if dockerRemote.Username != "" {
+		req.SetBasicAuth(dockerRemote.Username, dockerRemote.Password)
+	}
+	if dockerRemote.RemoteCookie != "" {
+		req.Header.Set("Cookie", dockerRemote.RemoteCookie)
+	}
+
+	return req, nil
+}
@@ -1,20 +1,22 @@
 package remote
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
 	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ecr"
 	"github.com/docker/distribution/registry/api/errcode"
+	"github.com/docker/distribution/registry/client"
 	"github.com/docker/distribution/registry/client/auth"
 	"github.com/docker/distribution/registry/client/transport"
-	dockerregistrytypes "github.com/docker/docker/api/types/registry"
 	"github.com/docker/docker/registry"
 	"github.com/pkg/errors"
 	"github.com/replicatedcom/harpoon/log"
@@ -24,10 +26,10 @@ var (
 	ErrUnauthorized = errors.New("Unauthorized")
 )
 
-func (dockerRemote *DockerRemote) Auth(additionalScope ...string) error {
-	uri := fmt.Sprintf("https://%s/v2/", dockerRemote.Hostname)
+func (dockerRemote *DockerRemote) Auth(ctx context.Context, additionalScope ...string) error {
+	uri := fmt.Sprintf("%s/v2/", dockerRemote.BaseURL())
 
-	req, err := dockerRemote.NewHttpRequest("GET", uri, nil)
+	req, err := dockerRemote.NewHttpRequest(ctx, "GET", uri, nil)
 	if err != nil {
 		return errors.Wrap(err, "failed to create http request")
 	}
@@ -53,72 +55,151 @@ func (dockerRemote *DockerRemote) Auth(additionalScope ...string) error {
 }
 
 // resolveAuth will return a new JWT token from the resources in the authenticateHeader string
-func (dockerRemote *DockerRemote) resolveAuth(authenticateHeader string, additionalScope ...string) error {
+func (dockerRemote *DockerRemote) resolveAuth(ctx context.Context, authenticateHeader string, additionalScope ...string) error {
 	switch {
 	case strings.HasPrefix(authenticateHeader, "Bearer "):
-		return dockerRemote.resolveBearerAuth(authenticateHeader, additionalScope...)
+		return dockerRemote.resolveBearerAuth(ctx, authenticateHeader, additionalScope...)
 	case strings.HasPrefix(authenticateHeader, "Basic "):
-		return dockerRemote.resolveBasicAuth(authenticateHeader, additionalScope...)
+		return dockerRemote.resolveBasicAuth(ctx, authenticateHeader, additionalScope...)
 	default:
 		return fmt.Errorf("unsupported authentication type: %s", authenticateHeader)
 	}
 }
 
-func (dockerRemote *DockerRemote) resolveBearerAuth(authenticateHeader string, additionalScope ...string) error {
+// resolveBearerAuth remembers the bearer challenge of the registry, and fetches a new token for the
+// scopes of the request that was refused.  Later requests get their tokens from the store before
+// they are sent.
+func (dockerRemote *DockerRemote) resolveBearerAuth(ctx context.Context, authenticateHeader string, scopes ...string) error {
 	authenticateHeader = strings.TrimPrefix(authenticateHeader, "Bearer ")
 
-	realm, service, scope := parseAuthenticateHeader(authenticateHeader)
+	realm, service, _ := parseAuthenticateHeader(authenticateHeader)
+	c := bearerChallenge{Realm: realm, Service: service}
+
+	dockerRemote.Tokens.setChallenge(dockerRemote.Hostname, c)
+	dockerRemote.mu.Lock()
+	dockerRemote.ServiceHostname = service
+	dockerRemote.mu.Unlock()
+
+	// The token that was sent, if any, was refused
+	identity := dockerRemote.tokenIdentity()
+	dockerRemote.Tokens.forget(c, identity, scopes)
+
+	_, err := dockerRemote.Tokens.token(ctx, c, identity, scopes, func(ctx context.Context) (string, time.Time, error) {
+		return dockerRemote.fetchBearerToken(ctx, c, scopes)
+	})
+	return err
+}
+
+// setBearerToken authorizes the request with a token for its scopes, once the registry has sent a
+// bearer challenge.  Until then, requests are sent without a token.
+func (dockerRemote *DockerRemote) setBearerToken(req *http.Request, additionalScope ...string) error {
+	c, ok := dockerRemote.Tokens.challenge(dockerRemote.Hostname)
+	if !ok {
+		return nil
+	}
+
+	// The credentials are part of the key of the token
+	if err := dockerRemote.loadCredentials(); err != nil {
+		return err
+	}
+
+	scopes := requestScopes(req, additionalScope)
+	token, err := dockerRemote.Tokens.token(req.Context(), c, dockerRemote.tokenIdentity(), scopes, func(ctx context.Context) (string, time.Time, error) {
+		return dockerRemote.fetchBearerToken(ctx, c, scopes)
+	})
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+	return nil
+}
+
+// fetchBearerToken gets a token for the scopes from the auth server of the challenge, with the
+// credentials of the remote
+func (dockerRemote *DockerRemote) fetchBearerToken(ctx context.Context, c bearerChallenge, scopes []string) (string, time.Time, error) {
+	if err := dockerRemote.loadCredentials(); err != nil {
+		return "", time.Time{}, err
+	}
 
 	params := map[string]string{
-		"realm":   realm,
-		"service": service,
+		"realm":   c.Realm,
+		"service": c.Service,
 	}
 
 	modifiers := registry.Headers("Replicated", nil)
-	authTransport := transport.NewTransport(nil, modifiers...)
-
-	credentialAuthConfig := &dockerregistrytypes.AuthConfig{
-		Username:      dockerRemote.Username,
-		Password:      dockerRemote.Password,
-		ServerAddress: dockerRemote.Hostname,
-		// TODO: what is dockerRemote.Token?
+	// Token servers are reached with the certificates of the registry, like docker does
+	authTransport := transport.NewTransport(dockerRemote.client.RoundTripper(), modifiers...)
+
+	creds := &tokenCredentialStore{
+		username:      dockerRemote.Username,
+		password:      dockerRemote.Password,
+		identityToken: dockerRemote.IdentityToken,
+		path:          dockerRemote.RefreshTokenFile,
+	}
+	if dockerRemote.Token != "" {
+		// A token the registry did not accept as is may be a refresh token
+		creds.identityToken = dockerRemote.Token
 	}
-	creds := registry.NewStaticCredentialStore(credentialAuthConfig)
 	th := NewTokenHandlerWithOptions(auth.TokenHandlerOptions{
 		Transport:   authTransport,
 		Credentials: creds,
+		// Ask for a refresh token when there is a file to keep it in
+		OfflineAccess: creds.identityToken == "" && creds.persistent(),
 	})
+	th.retry = dockerRemote.Retry
 
-	if scope != "" {
-		additionalScope = append([]string{scope}, additionalScope...)
+	token, expiration, err := th.fetchTokenWithTimeout(ctx, params, scopes)
+	if err != nil && creds.storedToken != "" && isRefusedGrantErr(err) {
+		log.Debugf("Stored refresh token for %s was refused, authenticating with the password", dockerRemote.Hostname)
+		creds.forgetStoredToken()
+		token, expiration, err = th.fetchTokenWithTimeout(ctx, params, scopes)
 	}
-	additionalScope = uniqueStringSlice(additionalScope)
-
-	token, err := th.GetToken(params, additionalScope...)
 	if err != nil {
 		if isUnauthorizedErr(err) {
-			return ErrUnauthorized
+			return "", time.Time{}, ErrUnauthorized
 		}
 		log.Errorf("Failed to get token for hostname %s and username %s: %v", dockerRemote.Hostname, dockerRemote.Username, err)
-		return err
+		return "", time.Time{}, err
 	}
 
-	dockerRemote.ServiceHostname = service
-	dockerRemote.AuthHeader = fmt.Sprintf("Bearer %s", token)
+	return token, expiration, nil
+}
 
-	return nil
+// requestScopes returns the scope to pull the repository of the request, if it is for a manifest
+// or a blob, and the additional scopes
+func requestScopes(req *http.Request, additionalScope []string) []string {
+	scopes := []string{}
+	if scope := requestScope(req.URL.Path); scope != "" {
+		scopes = append(scopes, scope)
+	}
+	for _, scope := range additionalScope {
+		if scope != "" {
+			scopes = append(scopes, scope)
+		}
+	}
+	return uniqueStringSlice(scopes)
+}
+
+// isRefusedGrantErr reports whether the auth server refused the credentials or refresh token, like
+// with 401 or an OAuth2 invalid_grant error, rather than failing to respond
+func isRefusedGrantErr(err error) bool {
+	var responseErr *client.UnexpectedHTTPResponseError
+	return isUnauthorizedErr(err) || errors.As(err, &responseErr)
 }
 
 func isUnauthorizedErr(err error) bool {
-	if err, ok := err.(errcode.Errors); ok && err.Len() > 0 {
-		if err, ok := err[0].(errcode.Error); ok && err.Code == errcode.ErrorCodeUnauthorized {
-			return true
-		}
+	if errs, ok := err.(errcode.Errors); ok && errs.Len() > 0 {
+		err = errs[0]
+	}
+	// Auth servers that respond 401 without an error body give a single error
+	if err, ok := err.(errcode.Error); ok && err.Code == errcode.ErrorCodeUnauthorized {
+		return true
 	}
 	return false
 }
 
-func (dockerRemote *DockerRemote) resolveBasicAuth(authenticateHeader string, additionalScope ...string) error {
+func (dockerRemote *DockerRemote) resolveBasicAuth(ctx context.Context, authenticateHeader string, additionalScope ...string) error {
 	// Logging on info level for troubleshooting
 	log.Infof("Resolving basic auth header: %s", authenticateHeader)
 
@@ -127,10 +208,10 @@ func (dockerRemote *DockerRemote) resolveBasicAuth(authenticateHeader string, ad
 		v.Set("scope", additionalScope[0])
 	}
 
-	uri := fmt.Sprintf("https://%s?%s", dockerRemote.Hostname, v.Encode())
+	uri := fmt.Sprintf("%s?%s", dockerRemote.BaseURL(), v.Encode())
 
 	log.Debugf("auth uri = %s", uri)
-	req, err := dockerRemote.NewHttpRequest("GET", uri, nil)
+	req, err := dockerRemote.NewHttpRequest(ctx, "GET", uri, nil)
 	if err != nil {
 		return errors.Wrap(err, "failed to parse ECR endpoint")
 	}
@@ -159,12 +240,12 @@ func (dockerRemote *DockerRemote) resolveBasicAuth(authenticateHeader string, ad
 	// TODO: github responds with `{"status": "ok", "message": "Hello, world! This is the GitHub Package Registry."}`
 	// so not sure what to do with response until there is a registry that uses it.
 
-	dockerRemote.AuthHeader = req.Header.Get("Authorization")
+	dockerRemote.Tokens.setAuthHeader(dockerRemote.Hostname, dockerRemote.tokenIdentity(), req.Header.Get("Authorization"))
 
 	return nil
 }
 
-func (dockerRemote *DockerRemote) resolveECRAuth(ecrEndpoint string) error {
+func (dockerRemote *DockerRemote) resolveECRAuth(ctx context.Context, ecrEndpoint string) error {
 	registry, zone, err := parseECREndpoint(ecrEndpoint)
 	if err != nil {
 		return errors.Wrap(err, "failed to parse ECR endpoint")
@@ -172,7 +253,7 @@ func (dockerRemote *DockerRemote) resolveECRAuth(ecrEndpoint string) error {
 
 	ecrService := getECRService(dockerRemote.Username, dockerRemote.Password, zone)
 
-	ecrToken, err := ecrService.GetAuthorizationToken(&ecr.GetAuthorizationTokenInput{
+	ecrToken, err := ecrService.GetAuthorizationTokenWithContext(ctx, &ecr.GetAuthorizationTokenInput{
 		RegistryIds: []*string{
 			&registry,
 		},
@@ -188,7 +269,7 @@ func (dockerRemote *DockerRemote) resolveECRAuth(ecrEndpoint string) error {
 
 	token := *ecrToken.AuthorizationData[0].AuthorizationToken
 
-	dockerRemote.AuthHeader = fmt.Sprintf("Basic %s", token)
+	dockerRemote.Tokens.setAuthHeader(dockerRemote.Hostname, dockerRemote.tokenIdentity(), fmt.Sprintf("Basic %s", token))
 	return nil
 }
 
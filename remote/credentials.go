@@ -0,0 +1,264 @@
+package remote
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/replicatedcom/harpoon/log"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// dockerHubServerAddress is the key docker uses for Docker Hub in config.json and credential helpers
+	dockerHubServerAddress = "https://index.docker.io/v1/"
+
+	// credentialsNotFound is printed by credential helpers that have nothing stored for a registry
+	credentialsNotFound = "credentials not found in native keychain"
+
+	// identityTokenUsername is the username credential helpers return with an identity token
+	identityTokenUsername = "<token>"
+)
+
+// Credentials authenticate to a registry with a username and password, or with an identity token,
+// which is used as an OAuth refresh token.
+type Credentials struct {
+	Username      string
+	Password      string
+	IdentityToken string
+}
+
+// IsEmpty reports whether no credentials were found
+func (c Credentials) IsEmpty() bool {
+	return c.Username == "" && c.Password == "" && c.IdentityToken == ""
+}
+
+// dockerConfig is the part of a docker config.json, or of a Kubernetes .dockerconfigjson pull
+// secret, that holds credentials
+type dockerConfig struct {
+	Auths       map[string]dockerAuthEntry `json:"auths"`
+	CredHelpers map[string]string          `json:"credHelpers"`
+	CredsStore  string                     `json:"credsStore"`
+}
+
+type dockerAuthEntry struct {
+	Auth          string `json:"auth"`
+	Username      string `json:"username"`
+	Password      string `json:"password"`
+	IdentityToken string `json:"identitytoken"`
+}
+
+// ResolveCredentials looks up the credentials for the registry at hostname, like docker does.
+// The sources are tried in order, and the first that has credentials for the registry wins:
+//
+//	the DOCKER_AUTH_CONFIG environment variable, with the contents of a config.json
+//	the pull secret files, in the Kubernetes .dockerconfigjson or legacy .dockercfg format
+//	config.json in DOCKER_CONFIG, or in ~/.docker, with its credHelpers, credsStore and auths
+//
+// Empty credentials are returned when none of them have an entry for the registry.
+func ResolveCredentials(hostname string, pullSecrets ...string) (Credentials, error) {
+	if value := os.Getenv("DOCKER_AUTH_CONFIG"); value != "" {
+		config, err := parseDockerConfig([]byte(value))
+		if err != nil {
+			return Credentials{}, errors.Wrap(err, "failed to parse DOCKER_AUTH_CONFIG")
+		}
+		creds, err := config.credentials(hostname)
+		if err != nil || !creds.IsEmpty() {
+			return creds, err
+		}
+	}
+
+	for _, filename := range pullSecrets {
+		config, err := readDockerConfig(filename)
+		if err != nil {
+			return Credentials{}, err
+		}
+		creds, err := config.credentials(hostname)
+		if err != nil || !creds.IsEmpty() {
+			return creds, err
+		}
+	}
+
+	filename := dockerConfigFile()
+	if filename == "" {
+		return Credentials{}, nil
+	}
+	if _, err := os.Stat(filename); os.IsNotExist(err) {
+		return Credentials{}, nil
+	}
+
+	config, err := readDockerConfig(filename)
+	if err != nil {
+		return Credentials{}, err
+	}
+	return config.credentials(hostname)
+}
+
+// dockerConfigFile returns the path of the docker client config.json
+func dockerConfigFile() string {
+	if dir := os.Getenv("DOCKER_CONFIG"); dir != "" {
+		return filepath.Join(dir, "config.json")
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".docker", "config.json")
+}
+
+func readDockerConfig(filename string) (*dockerConfig, error) {
+	contents, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read %s", filename)
+	}
+
+	config, err := parseDockerConfig(contents)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to parse %s", filename)
+	}
+	return config, nil
+}
+
+// parseDockerConfig parses a config.json or .dockerconfigjson, or a legacy .dockercfg, which is
+// only the map of auths
+func parseDockerConfig(contents []byte) (*dockerConfig, error) {
+	config := &dockerConfig{}
+	if err := json.Unmarshal(contents, config); err != nil {
+		return nil, err
+	}
+
+	if config.Auths == nil && config.CredHelpers == nil && config.CredsStore == "" {
+		if err := json.Unmarshal(contents, &config.Auths); err != nil {
+			return nil, err
+		}
+	}
+
+	return config, nil
+}
+
+// credentials returns the credentials for hostname.  A credential helper for the registry is
+// preferred, then the credentials store, then the auths entry.
+func (config *dockerConfig) credentials(hostname string) (Credentials, error) {
+	host := normalizeRegistryHost(hostname)
+
+	for key, helper := range config.CredHelpers {
+		if normalizeRegistryHost(key) == host {
+			return helperCredentials(helper, serverAddress(hostname))
+		}
+	}
+
+	var entry *dockerAuthEntry
+	entryKey := ""
+	for key, e := range config.Auths {
+		if normalizeRegistryHost(key) == host {
+			e := e
+			entry, entryKey = &e, key
+			break
+		}
+	}
+
+	if config.CredsStore != "" {
+		address := serverAddress(hostname)
+		if entryKey != "" {
+			address = entryKey
+		}
+		creds, err := helperCredentials(config.CredsStore, address)
+		if err != nil || !creds.IsEmpty() {
+			return creds, err
+		}
+	}
+
+	if entry == nil {
+		return Credentials{}, nil
+	}
+	return entry.credentials()
+}
+
+func (entry *dockerAuthEntry) credentials() (Credentials, error) {
+	creds := Credentials{
+		Username:      entry.Username,
+		Password:      entry.Password,
+		IdentityToken: entry.IdentityToken,
+	}
+
+	if entry.Auth != "" {
+		decoded, err := base64.StdEncoding.DecodeString(entry.Auth)
+		if err != nil {
+			return Credentials{}, errors.Wrap(err, "failed to decode auth")
+		}
+		parts := strings.SplitN(string(decoded), ":", 2)
+		if len(parts) != 2 {
+			return Credentials{}, errors.New("invalid auth, expected username:password")
+		}
+		creds.Username, creds.Password = parts[0], parts[1]
+	}
+
+	return creds, nil
+}
+
+// helperCredentials runs docker-credential-<helper> get for the server address
+func helperCredentials(helper, address string) (Credentials, error) {
+	name := "docker-credential-" + helper
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(name, "get")
+	cmd.Stdin = strings.NewReader(address)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		if errors.Is(err, exec.ErrNotFound) {
+			log.Infof("Credential helper %s is not installed, ignoring it", name)
+			return Credentials{}, nil
+		}
+		if strings.Contains(stdout.String(), credentialsNotFound) {
+			return Credentials{}, nil
+		}
+		return Credentials{}, errors.Wrapf(err, "failed to get credentials for %s from %s: %s",
+			address, name, strings.TrimSpace(stdout.String()+stderr.String()))
+	}
+
+	var resp struct {
+		Username string
+		Secret   string
+	}
+	if err := json.Unmarshal(stdout.Bytes(), &resp); err != nil {
+		return Credentials{}, errors.Wrapf(err, "failed to parse credentials from %s", name)
+	}
+
+	if resp.Username == identityTokenUsername {
+		return Credentials{IdentityToken: resp.Secret}, nil
+	}
+	return Credentials{Username: resp.Username, Password: resp.Secret}, nil
+}
+
+// serverAddress returns the address docker stores the credentials for hostname under
+func serverAddress(hostname string) string {
+	if normalizeRegistryHost(hostname) == DefaultHostname {
+		return dockerHubServerAddress
+	}
+	return hostname
+}
+
+// normalizeRegistryHost reduces a config.json key, which may be a URL, to the registry host.
+// The Docker Hub aliases are all reduced to DefaultHostname.
+func normalizeRegistryHost(key string) string {
+	host := strings.ToLower(key)
+	host = strings.TrimPrefix(host, "https://")
+	host = strings.TrimPrefix(host, "http://")
+	if i := strings.Index(host, "/"); i >= 0 {
+		host = host[:i]
+	}
+
+	switch host {
+	case dockerHubDomain, "registry-1.docker.io", DefaultHostname:
+		return DefaultHostname
+	}
+	return host
+}
@@ -0,0 +1,207 @@
+package remote
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeDockerConfig writes config.json with the contents to a new DOCKER_CONFIG directory
+func writeDockerConfig(t *testing.T, contents string) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "config.json"), []byte(contents), 0600))
+	t.Setenv("DOCKER_CONFIG", dir)
+	t.Setenv("DOCKER_AUTH_CONFIG", "")
+}
+
+// installCredentialHelper puts docker-credential-<name> on the PATH.  It returns the credentials
+// for registry.example.com, an identity token for Docker Hub, and nothing for other registries.
+func installCredentialHelper(t *testing.T, name string) {
+	dir := t.TempDir()
+	script := `#!/bin/sh
+read address
+case "$address" in
+registry.example.com) echo '{"ServerURL":"registry.example.com","Username":"helper","Secret":"helper-secret"}' ;;
+https://index.docker.io/v1/) echo '{"ServerURL":"https://index.docker.io/v1/","Username":"<token>","Secret":"refresh"}' ;;
+*) echo 'credentials not found in native keychain'; exit 1 ;;
+esac
+`
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "docker-credential-"+name), []byte(script), 0755))
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+func basicAuth(username, password string) string {
+	return base64.StdEncoding.EncodeToString([]byte(username + ":" + password))
+}
+
+func TestResolveCredentialsAuths(t *testing.T) {
+	writeDockerConfig(t, fmt.Sprintf(`{
+		"auths": {
+			"https://index.docker.io/v1/": {"auth": %q},
+			"registry.example.com:5000": {"username": "user", "password": "pass"},
+			"https://quay.io/v2/": {"identitytoken": "quay-token"}
+		}
+	}`, basicAuth("hub", "hub:secret")))
+
+	tests := []struct {
+		hostname string
+		expect   Credentials
+	}{
+		{hostname: DefaultHostname, expect: Credentials{Username: "hub", Password: "hub:secret"}},
+		{hostname: "docker.io", expect: Credentials{Username: "hub", Password: "hub:secret"}},
+		{hostname: "registry.example.com:5000", expect: Credentials{Username: "user", Password: "pass"}},
+		{hostname: "Quay.io", expect: Credentials{IdentityToken: "quay-token"}},
+		{hostname: "registry.example.com", expect: Credentials{}},
+	}
+
+	for _, test := range tests {
+		creds, err := ResolveCredentials(test.hostname)
+		require.NoError(t, err, test.hostname)
+		assert.Equal(t, test.expect, creds, test.hostname)
+	}
+}
+
+func TestResolveCredentialsHelpers(t *testing.T) {
+	installCredentialHelper(t, "test")
+	writeDockerConfig(t, fmt.Sprintf(`{
+		"auths": {
+			"other.example.com": {"auth": %q}
+		},
+		"credHelpers": {
+			"registry.example.com": "test",
+			"unknown.example.com": "test"
+		},
+		"credsStore": "test"
+	}`, basicAuth("other", "pass")))
+
+	tests := []struct {
+		hostname string
+		expect   Credentials
+	}{
+		{hostname: "registry.example.com", expect: Credentials{Username: "helper", Password: "helper-secret"}},
+		{hostname: "unknown.example.com", expect: Credentials{}},
+		// The store has an identity token for Docker Hub
+		{hostname: DefaultHostname, expect: Credentials{IdentityToken: "refresh"}},
+		// The store has nothing, so the auths entry is used
+		{hostname: "other.example.com", expect: Credentials{Username: "other", Password: "pass"}},
+	}
+
+	for _, test := range tests {
+		creds, err := ResolveCredentials(test.hostname)
+		require.NoError(t, err, test.hostname)
+		assert.Equal(t, test.expect, creds, test.hostname)
+	}
+}
+
+func TestResolveCredentialsMissingHelper(t *testing.T) {
+	writeDockerConfig(t, fmt.Sprintf(`{
+		"auths": {"registry.example.com": {"auth": %q}},
+		"credsStore": "not-installed"
+	}`, basicAuth("user", "pass")))
+
+	creds, err := ResolveCredentials("registry.example.com")
+	require.NoError(t, err)
+	assert.Equal(t, Credentials{Username: "user", Password: "pass"}, creds)
+}
+
+func TestResolveCredentialsOrder(t *testing.T) {
+	writeDockerConfig(t, fmt.Sprintf(`{"auths": {
+		"env.example.com": {"auth": %q},
+		"secret.example.com": {"auth": %q},
+		"config.example.com": {"auth": %q}
+	}}`, basicAuth("config", "1"), basicAuth("config", "2"), basicAuth("config", "3")))
+
+	dir := t.TempDir()
+	secret := filepath.Join(dir, ".dockerconfigjson")
+	require.NoError(t, os.WriteFile(secret, []byte(fmt.Sprintf(`{"auths": {
+		"env.example.com": {"auth": %q},
+		"secret.example.com": {"auth": %q}
+	}}`, basicAuth("secret", "1"), basicAuth("secret", "2"))), 0600))
+
+	// Legacy .dockercfg secrets are only the map of auths
+	legacy := filepath.Join(dir, ".dockercfg")
+	require.NoError(t, os.WriteFile(legacy, []byte(fmt.Sprintf(`{
+		"legacy.example.com": {"auth": %q}
+	}`, basicAuth("legacy", "1"))), 0600))
+
+	t.Setenv("DOCKER_AUTH_CONFIG", fmt.Sprintf(`{"auths": {"env.example.com": {"auth": %q}}}`, basicAuth("env", "1")))
+
+	tests := []struct {
+		hostname string
+		expect   Credentials
+	}{
+		{hostname: "env.example.com", expect: Credentials{Username: "env", Password: "1"}},
+		{hostname: "secret.example.com", expect: Credentials{Username: "secret", Password: "2"}},
+		{hostname: "legacy.example.com", expect: Credentials{Username: "legacy", Password: "1"}},
+		{hostname: "config.example.com", expect: Credentials{Username: "config", Password: "3"}},
+	}
+
+	for _, test := range tests {
+		creds, err := ResolveCredentials(test.hostname, secret, legacy)
+		require.NoError(t, err, test.hostname)
+		assert.Equal(t, test.expect, creds, test.hostname)
+	}
+}
+
+func TestResolveCredentialsNoConfig(t *testing.T) {
+	t.Setenv("DOCKER_CONFIG", t.TempDir())
+	t.Setenv("DOCKER_AUTH_CONFIG", "")
+
+	creds, err := ResolveCredentials("registry.example.com")
+	require.NoError(t, err)
+	assert.True(t, creds.IsEmpty())
+
+	_, err = ResolveCredentials("registry.example.com", filepath.Join(t.TempDir(), "missing"))
+	require.Error(t, err)
+
+	t.Setenv("DOCKER_AUTH_CONFIG", "{")
+	_, err = ResolveCredentials("registry.example.com")
+	require.Error(t, err)
+}
+
+func TestDoResolvesCredentials(t *testing.T) {
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/token":
+			username, password, ok := req.BasicAuth()
+			if !ok || username != "user" || password != "pass" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			w.Write([]byte(`{"token": "registry-token"}`))
+		default:
+			if req.Header.Get("Authorization") != "Bearer registry-token" {
+				w.Header().Set("Www-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="test"`, server.URL))
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			w.Write([]byte("ok"))
+		}
+	}))
+	defer server.Close()
+
+	host := strings.TrimPrefix(server.URL, "http://")
+	writeDockerConfig(t, fmt.Sprintf(`{"auths": {%q: {"auth": %q}}}`, host, basicAuth("user", "pass")))
+
+	dockerRemote, err := ParseDockerURI("docker://" + host + "/ns/img")
+	require.NoError(t, err)
+
+	req, err := dockerRemote.NewHttpRequest(context.Background(), "GET", server.URL+"/v2/", nil)
+	require.NoError(t, err)
+	resp, err := dockerRemote.DoWithRetry(req, 2)
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "user", dockerRemote.Username)
+}
@@ -0,0 +1,156 @@
+package remote
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/replicatedcom/harpoon/log"
+
+	"github.com/pkg/errors"
+)
+
+// ValidateInsecureRegistries checks that every entry is a host, a host:port, or a CIDR
+func ValidateInsecureRegistries(entries []string) error {
+	for _, entry := range entries {
+		if strings.Contains(entry, "/") {
+			if _, _, err := net.ParseCIDR(entry); err != nil {
+				return errors.Wrapf(err, "invalid insecure registry %q", entry)
+			}
+			continue
+		}
+		if entry == "" || strings.Contains(entry, "://") {
+			return errors.Errorf("invalid insecure registry %q, expected a host[:port] or a CIDR", entry)
+		}
+	}
+	return nil
+}
+
+// IsInsecure reports whether the registry may be reached over plain http, or over https without
+// verifying its certificate.  Like docker, registries on loopback addresses are always insecure,
+// as well as those listed in InsecureRegistries by host, host:port, or a CIDR of their address.
+func (remote *DockerRemote) IsInsecure() bool {
+	return isInsecureRegistry(remote.Hostname, remote.InsecureRegistries)
+}
+
+func isInsecureRegistry(hostname string, entries []string) bool {
+	host := hostname
+	if h, _, err := net.SplitHostPort(hostname); err == nil {
+		host = h
+	}
+
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+		return true
+	}
+
+	var networks []*net.IPNet
+	for _, entry := range entries {
+		if _, network, err := net.ParseCIDR(entry); err == nil {
+			networks = append(networks, network)
+		} else if strings.EqualFold(entry, hostname) || strings.EqualFold(entry, host) {
+			return true
+		}
+	}
+	if len(networks) == 0 {
+		return false
+	}
+
+	ips := []net.IP{net.ParseIP(host)}
+	if ips[0] == nil {
+		var err error
+		if ips, err = net.LookupIP(host); err != nil {
+			log.Debugf("Failed to resolve %s to match insecure registries: %v", host, err)
+			return false
+		}
+	}
+
+	for _, ip := range ips {
+		for _, network := range networks {
+			if network.Contains(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Scheme returns the scheme of the registry URLs.  It is https, unless the registry is insecure
+// and could not be reached over https.
+func (remote *DockerRemote) Scheme() string {
+	if scheme := remote.knownScheme(); scheme != "" {
+		return scheme
+	}
+	return "https"
+}
+
+// knownScheme returns the scheme the registry was reached with, or "" until send has found it
+func (remote *DockerRemote) knownScheme() string {
+	remote.mu.Lock()
+	defer remote.mu.Unlock()
+
+	return remote.scheme
+}
+
+func (remote *DockerRemote) setScheme(scheme string) {
+	remote.mu.Lock()
+	defer remote.mu.Unlock()
+
+	remote.scheme = scheme
+}
+
+// BaseURL returns the URL of the registry, like https://registry.example.com
+func (remote *DockerRemote) BaseURL() string {
+	return remote.Scheme() + "://" + remote.Hostname
+}
+
+// send sends the request to the registry with the Retry policy.  Until the scheme of an insecure
+// registry is known, every attempt is sent over https, and then over http if that fails, like
+// docker does.  The scheme that works is used from then on.
+func (remote *DockerRemote) send(req *http.Request) (*http.Response, error) {
+	if req.URL.Host != remote.Hostname {
+		return remote.Retry.do(req, remote.client.Do)
+	}
+	if scheme := remote.knownScheme(); scheme != "" {
+		req.URL.Scheme = scheme
+		return remote.Retry.do(req, remote.client.Do)
+	}
+	if req.URL.Scheme != "https" || !remote.IsInsecure() {
+		return remote.Retry.do(req, remote.client.Do)
+	}
+
+	return remote.Retry.do(req, remote.sendWithFallback)
+}
+
+func (remote *DockerRemote) sendWithFallback(req *http.Request) (*http.Response, error) {
+	resp, err := remote.client.Do(req)
+	if err == nil {
+		remote.setScheme("https")
+		return resp, nil
+	}
+	if req.Context().Err() != nil {
+		return nil, err
+	}
+
+	httpReq := req.Clone(req.Context())
+	httpReq.URL.Scheme = "http"
+	if req.GetBody != nil {
+		body, bodyErr := req.GetBody()
+		if bodyErr != nil {
+			return nil, errors.Wrap(bodyErr, "failed to rewind request body")
+		}
+		httpReq.Body = body
+	}
+
+	resp, httpErr := remote.client.Do(httpReq)
+	if httpErr != nil {
+		log.Debugf("Insecure registry %s is not reachable over http either: %v", remote.Hostname, httpErr)
+		return nil, err
+	}
+
+	log.Infof("Insecure registry %s is not reachable over https, using http: %v", remote.Hostname, err)
+	remote.setScheme("http")
+	return resp, nil
+}
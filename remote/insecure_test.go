@@ -0,0 +1,97 @@
+package remote
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIsInsecureRegistry(t *testing.T) {
+	entries := []string{"registry:5000", "ci-registry", "10.0.0.0/8"}
+
+	tests := []struct {
+		hostname string
+		insecure bool
+	}{
+		{hostname: "localhost:5000", insecure: true},
+		{hostname: "127.0.0.1:5000", insecure: true},
+		{hostname: "[::1]:5000", insecure: true},
+		{hostname: "registry:5000", insecure: true},
+		{hostname: "registry:5001", insecure: false},
+		{hostname: "ci-registry:5000", insecure: true},
+		{hostname: "CI-Registry", insecure: true},
+		{hostname: "10.1.2.3:5000", insecure: true},
+		{hostname: "192.168.1.1:5000", insecure: false},
+		{hostname: "registry.example.com", insecure: false},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.insecure, isInsecureRegistry(test.hostname, entries), test.hostname)
+	}
+
+	assert.False(t, isInsecureRegistry("10.1.2.3", nil))
+}
+
+func TestValidateInsecureRegistries(t *testing.T) {
+	require.NoError(t, ValidateInsecureRegistries([]string{"registry:5000", "10.0.0.0/8", "fd00::/8"}))
+	require.Error(t, ValidateInsecureRegistries([]string{"10.0.0.0/33"}))
+	require.Error(t, ValidateInsecureRegistries([]string{"http://registry:5000"}))
+	require.Error(t, ValidateInsecureRegistries([]string{""}))
+}
+
+// newInsecureTestRemote returns a remote for the server that has the scheme stripped from its URL
+func newInsecureTestRemote(t *testing.T, server *httptest.Server) *DockerRemote {
+	host := strings.TrimPrefix(strings.TrimPrefix(server.URL, "http://"), "https://")
+	dockerRemote, err := ParseDockerURI("docker://" + host + "/ns/img")
+	require.NoError(t, err)
+	return dockerRemote
+}
+
+func TestDoFallsBackToHTTP(t *testing.T) {
+	var schemes []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		schemes = append(schemes, "http")
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	dockerRemote := newInsecureTestRemote(t, server)
+	assert.Equal(t, "https", dockerRemote.Scheme())
+
+	for j := 0; j < 2; j++ {
+		req, err := dockerRemote.NewHttpRequest(context.Background(), "GET", dockerRemote.BaseURL()+"/v2/", nil)
+		require.NoError(t, err)
+		resp, err := dockerRemote.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+
+	assert.Equal(t, "http", dockerRemote.Scheme())
+	assert.Equal(t, server.URL, dockerRemote.BaseURL())
+	assert.Equal(t, []string{"http", "http"}, schemes)
+}
+
+func TestDoSkipsVerifyForInsecure(t *testing.T) {
+	// The certificate of the server is not trusted
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	dockerRemote := newInsecureTestRemote(t, server)
+
+	req, err := dockerRemote.NewHttpRequest(context.Background(), "GET", dockerRemote.BaseURL()+"/v2/", nil)
+	require.NoError(t, err)
+	resp, err := dockerRemote.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "https", dockerRemote.Scheme())
+}
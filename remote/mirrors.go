@@ -0,0 +1,202 @@
+package remote
+
+import (
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/replicatedcom/harpoon/log"
+
+	"github.com/pkg/errors"
+)
+
+// mirrorsMu guards the creation of the mirror remotes of every remote
+var mirrorsMu sync.Mutex
+
+// mirror is a registry mirror endpoint.  Mirrors that cannot be reached are skipped from then on.
+type mirror struct {
+	remote *DockerRemote
+	down   atomic.Bool
+}
+
+// ParseRegistryMirrors parses mirror settings like [<registry>=]<endpoint> into the ordered mirror
+// endpoints of each registry.  Settings without a registry are for Docker Hub, like the
+// registry-mirrors of docker.
+func ParseRegistryMirrors(settings []string) (map[string][]string, error) {
+	mirrors := map[string][]string{}
+	for _, setting := range settings {
+		registry, endpoint := DefaultHostname, setting
+		if i := strings.Index(setting, "="); i >= 0 {
+			registry, endpoint = setting[:i], setting[i+1:]
+		}
+
+		if registry == "" {
+			return nil, errors.Errorf("invalid registry mirror %q, the registry is empty", setting)
+		}
+		if _, _, err := parseMirrorEndpoint(endpoint); err != nil {
+			return nil, err
+		}
+
+		registry = normalizeRegistryHost(registry)
+		mirrors[registry] = append(mirrors[registry], endpoint)
+	}
+	return mirrors, nil
+}
+
+// MirrorsFor returns the mirror endpoints for the registry at hostname.  The keys of mirrors are
+// registry hostnames, and Docker Hub can be given as docker.io or index.docker.io.
+func MirrorsFor(mirrors map[string][]string, hostname string) []string {
+	host := normalizeRegistryHost(hostname)
+
+	registries := make([]string, 0, len(mirrors))
+	for registry := range mirrors {
+		if normalizeRegistryHost(registry) == host {
+			registries = append(registries, registry)
+		}
+	}
+	sort.Strings(registries)
+
+	var endpoints []string
+	for _, registry := range registries {
+		endpoints = append(endpoints, mirrors[registry]...)
+	}
+	return endpoints
+}
+
+// parseMirrorEndpoint splits a mirror endpoint, which is a URL without a path or a host[:port],
+// into the scheme and host.  The scheme defaults to https.
+func parseMirrorEndpoint(endpoint string) (string, string, error) {
+	if !strings.Contains(endpoint, "://") {
+		endpoint = "https://" + endpoint
+	}
+
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", "", errors.Wrapf(err, "invalid registry mirror %q", endpoint)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return "", "", errors.Errorf("invalid registry mirror %q, the scheme must be http or https", endpoint)
+	}
+	if u.Host == "" || strings.Trim(u.Path, "/") != "" || u.RawQuery != "" {
+		return "", "", errors.Errorf("invalid registry mirror %q, expected a host[:port] without a path", endpoint)
+	}
+
+	return u.Scheme, u.Host, nil
+}
+
+// isMirroredPath reports whether the request is for a manifest or a blob, which mirrors serve
+func isMirroredPath(path string) bool {
+	return strings.Contains(path, "/manifests/") || strings.Contains(path, "/blobs/")
+}
+
+// mirrorEndpoints creates the remotes for the Mirrors the first time they are needed.  Mirrors
+// connect with their own certificates, and look up their own credentials.
+func (remote *DockerRemote) mirrorEndpoints() ([]*mirror, error) {
+	mirrorsMu.Lock()
+	defer mirrorsMu.Unlock()
+
+	if remote.mirrors != nil {
+		return remote.mirrors, nil
+	}
+
+	mirrors := make([]*mirror, 0, len(remote.Mirrors))
+	for _, endpoint := range remote.Mirrors {
+		scheme, host, err := parseMirrorEndpoint(endpoint)
+		if err != nil {
+			return nil, err
+		}
+
+		mirrorRemote := &DockerRemote{
+			Hostname:           host,
+			Repository:         remote.Repository,
+			Tag:                remote.Tag,
+			Digest:             remote.Digest,
+			Ref:                remote.Ref,
+			PreferredProto:     remote.PreferredProto,
+			CertsDir:           remote.CertsDir,
+			InsecureRegistries: remote.InsecureRegistries,
+			Retry:              remote.Retry,
+			PullSecrets:        remote.PullSecrets,
+			RefreshTokenFile:   remote.RefreshTokenFile,
+			Tokens:             remote.Tokens,
+			scheme:             scheme,
+		}
+		if err := mirrorRemote.InitClient(); err != nil {
+			return nil, errors.Wrapf(err, "failed to init client for mirror %s", endpoint)
+		}
+
+		mirrors = append(mirrors, &mirror{remote: mirrorRemote})
+	}
+
+	remote.mirrors = mirrors
+	return mirrors, nil
+}
+
+// doWithMirrors sends a manifest or blob request to the mirrors in order, and then to the
+// registry.  The next endpoint is tried when a mirror responds with 404 or 5xx, refuses the
+// request with 401 or 403 after authenticating, or fails.  Only mirrors that cannot be reached are
+// not tried again.
+func (remote *DockerRemote) doWithMirrors(req *http.Request, numAttempts int, additionalScope ...string) (*http.Response, error) {
+	mirrors, err := remote.mirrorEndpoints()
+	if err != nil {
+		return nil, err
+	}
+
+	// An endpoint may not have served the earlier requests of the pull, so it has not necessarily
+	// authenticated yet.  Every endpoint gets to, even for requests sent with Do.
+	if numAttempts < 2 {
+		numAttempts = 2
+	}
+
+	for _, m := range mirrors {
+		if m.down.Load() {
+			continue
+		}
+
+		mirrorReq := req.Clone(req.Context())
+		mirrorReq.URL.Scheme = m.remote.Scheme()
+		mirrorReq.URL.Host = m.remote.Hostname
+		mirrorReq.Host = m.remote.Hostname
+
+		resp, err := m.remote.doWithAuth(mirrorReq, numAttempts, additionalScope...)
+		if err != nil {
+			if req.Context().Err() != nil {
+				return nil, err
+			}
+			var connErr connectionError
+			if errors.As(err, &connErr) {
+				log.Infof("Mirror %s failed, not using it for the rest of the pull: %v", m.remote.Hostname, err)
+				m.down.Store(true)
+			} else {
+				log.Infof("Failed to authenticate to mirror %s for %s, trying the next endpoint: %v", m.remote.Hostname, req.URL.Path, err)
+			}
+			continue
+		}
+
+		switch resp.StatusCode {
+		case http.StatusUnauthorized, http.StatusForbidden:
+			log.Infof("Mirror %s refused %s with %d, trying the next endpoint", m.remote.Hostname, req.URL.Path, resp.StatusCode)
+			resp.Body.Close()
+			continue
+		}
+		if resp.StatusCode == http.StatusNotFound || resp.StatusCode >= http.StatusInternalServerError {
+			log.Infof("Mirror %s returned %d for %s, trying the next endpoint", m.remote.Hostname, resp.StatusCode, req.URL.Path)
+			resp.Body.Close()
+			continue
+		}
+
+		log.Infof("Serving %s from mirror %s", req.URL.Path, m.remote.Hostname)
+		return resp, nil
+	}
+
+	resp, err := remote.doWithAuth(req, numAttempts, additionalScope...)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Infof("Serving %s from %s", req.URL.Path, remote.Hostname)
+	return resp, nil
+}
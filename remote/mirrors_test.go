@@ -0,0 +1,118 @@
+package remote
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRegistryMirrors(t *testing.T) {
+	mirrors, err := ParseRegistryMirrors([]string{
+		"https://hub-mirror.example.com",
+		"docker.io=mirror:5000",
+		"quay.io=http://quay-mirror:5000/",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, map[string][]string{
+		DefaultHostname: {"https://hub-mirror.example.com", "mirror:5000"},
+		"quay.io":       {"http://quay-mirror:5000/"},
+	}, mirrors)
+
+	assert.Equal(t, []string{"https://hub-mirror.example.com", "mirror:5000"}, MirrorsFor(mirrors, DefaultHostname))
+	assert.Equal(t, []string{"http://quay-mirror:5000/"}, MirrorsFor(mirrors, "Quay.io"))
+	assert.Empty(t, MirrorsFor(mirrors, "registry.example.com"))
+
+	for _, setting := range []string{"=mirror", "ftp://mirror", "https://mirror/path", "quay.io="} {
+		_, err := ParseRegistryMirrors([]string{setting})
+		assert.Error(t, err, setting)
+	}
+}
+
+// recordingServer responds with status to manifest and blob requests, and records their paths
+func recordingServer(t *testing.T, status int) (*httptest.Server, func() []string) {
+	var mu sync.Mutex
+	var paths []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		paths = append(paths, req.URL.Path)
+		mu.Unlock()
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(server.Close)
+
+	return server, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), paths...)
+	}
+}
+
+func TestDoWithMirrors(t *testing.T) {
+	upstream, upstreamPaths := recordingServer(t, http.StatusOK)
+	failing, failingPaths := recordingServer(t, http.StatusBadGateway)
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	dockerRemote, err := ParseDockerURI("docker://" + strings.TrimPrefix(upstream.URL, "http://") + "/ns/img")
+	require.NoError(t, err)
+	dockerRemote.Retry = RetryPolicy{MaxAttempts: 2, InitialBackoff: time.Millisecond}
+	dockerRemote.Mirrors = []string{down.URL, failing.URL}
+
+	get := func(path string) {
+		req, err := dockerRemote.NewHttpRequest(context.Background(), "GET", dockerRemote.BaseURL()+path, nil)
+		require.NoError(t, err)
+		resp, err := dockerRemote.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+
+	get("/v2/")
+	get("/v2/ns/img/manifests/latest")
+	get("/v2/ns/img/blobs/sha256:abc")
+
+	// The mirror that is down is not tried again, and only manifests and blobs are mirrored
+	require.Len(t, dockerRemote.mirrors, 2)
+	assert.True(t, dockerRemote.mirrors[0].down.Load())
+	assert.False(t, dockerRemote.mirrors[1].down.Load())
+	assert.Equal(t, []string{
+		"/v2/ns/img/manifests/latest", "/v2/ns/img/manifests/latest",
+		"/v2/ns/img/blobs/sha256:abc", "/v2/ns/img/blobs/sha256:abc",
+	}, failingPaths())
+	assert.Equal(t, []string{"/v2/", "/v2/ns/img/manifests/latest", "/v2/ns/img/blobs/sha256:abc"}, upstreamPaths())
+}
+
+func TestDoWithMirrorsRefused(t *testing.T) {
+	upstream, upstreamPaths := recordingServer(t, http.StatusOK)
+	unauthorized, unauthorizedPaths := recordingServer(t, http.StatusUnauthorized)
+	forbidden, forbiddenPaths := recordingServer(t, http.StatusForbidden)
+
+	dockerRemote, err := ParseDockerURI("docker://" + strings.TrimPrefix(upstream.URL, "http://") + "/ns/img")
+	require.NoError(t, err)
+	dockerRemote.Username = "user"
+	dockerRemote.Mirrors = []string{unauthorized.URL, forbidden.URL}
+
+	for j := 0; j < 2; j++ {
+		req, err := dockerRemote.NewHttpRequest(context.Background(), "GET", dockerRemote.BaseURL()+"/v2/ns/img/manifests/latest", nil)
+		require.NoError(t, err)
+		resp, err := dockerRemote.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+
+	// Mirrors that refuse a request are still tried for the next ones
+	require.Len(t, dockerRemote.mirrors, 2)
+	assert.False(t, dockerRemote.mirrors[0].down.Load())
+	assert.False(t, dockerRemote.mirrors[1].down.Load())
+	assert.Len(t, unauthorizedPaths(), 2)
+	assert.Len(t, forbiddenPaths(), 2)
+	assert.Len(t, upstreamPaths(), 2)
+}
@@ -0,0 +1,226 @@
+package remote
+
+import (
+	"encoding/json"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/replicatedcom/harpoon/log"
+
+	"github.com/pkg/errors"
+)
+
+// refreshTokensMu guards the refresh token files of every remote
+var refreshTokensMu sync.Mutex
+
+// refreshTokenFile is the content of a refresh token file
+type refreshTokenFile struct {
+	RefreshTokens []refreshTokenEntry `json:"refreshTokens"`
+}
+
+// refreshTokenEntry is the refresh token an auth server gave to a user.  A token is only used for
+// the user it was given to, so it is not used after the credentials change.
+type refreshTokenEntry struct {
+	Realm        string `json:"realm"`
+	Service      string `json:"service"`
+	Username     string `json:"username"`
+	RefreshToken string `json:"refreshToken"`
+}
+
+// DefaultRefreshTokenFile returns harpoon/refresh-tokens.json in the user's config directory, or ""
+// when there is none
+func DefaultRefreshTokenFile() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "harpoon", "refresh-tokens.json")
+}
+
+// loadRefreshToken returns the refresh token for the realm, service and user in the file at path,
+// or "" when there is none
+func loadRefreshToken(path, realm, service, username string) (string, error) {
+	refreshTokensMu.Lock()
+	defer refreshTokensMu.Unlock()
+
+	file, err := readRefreshTokenFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	for _, entry := range file.RefreshTokens {
+		if entry.Realm == realm && entry.Service == service && entry.Username == username {
+			return entry.RefreshToken, nil
+		}
+	}
+	return "", nil
+}
+
+// storeRefreshToken replaces the refresh token for the realm, service and user in the file at path
+func storeRefreshToken(path, realm, service, username, refreshToken string) error {
+	return updateRefreshTokens(path, func(entries []refreshTokenEntry) []refreshTokenEntry {
+		entries = removeRefreshToken(entries, func(entry refreshTokenEntry) bool {
+			return entry.Realm == realm && entry.Service == service && entry.Username == username
+		})
+		return append(entries, refreshTokenEntry{
+			Realm:        realm,
+			Service:      service,
+			Username:     username,
+			RefreshToken: refreshToken,
+		})
+	})
+}
+
+// deleteRefreshToken deletes refreshToken from the file at path, unless it was replaced already
+func deleteRefreshToken(path, realm, service, username, refreshToken string) error {
+	return updateRefreshTokens(path, func(entries []refreshTokenEntry) []refreshTokenEntry {
+		return removeRefreshToken(entries, func(entry refreshTokenEntry) bool {
+			return entry.Realm == realm && entry.Service == service && entry.Username == username && entry.RefreshToken == refreshToken
+		})
+	})
+}
+
+func updateRefreshTokens(path string, update func([]refreshTokenEntry) []refreshTokenEntry) error {
+	refreshTokensMu.Lock()
+	defer refreshTokensMu.Unlock()
+
+	file, err := readRefreshTokenFile(path)
+	if err != nil {
+		return err
+	}
+
+	file.RefreshTokens = update(file.RefreshTokens)
+	return writeRefreshTokenFile(path, file)
+}
+
+func removeRefreshToken(entries []refreshTokenEntry, match func(refreshTokenEntry) bool) []refreshTokenEntry {
+	kept := []refreshTokenEntry{}
+	for _, entry := range entries {
+		if !match(entry) {
+			kept = append(kept, entry)
+		}
+	}
+	return kept
+}
+
+func readRefreshTokenFile(path string) (*refreshTokenFile, error) {
+	file := &refreshTokenFile{}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return file, nil
+	} else if err != nil {
+		return nil, errors.Wrap(err, "failed to read refresh tokens")
+	}
+
+	if err := json.Unmarshal(data, file); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse refresh tokens in %s", path)
+	}
+	return file, nil
+}
+
+// writeRefreshTokenFile replaces the file at path, which only the user can read, so that other
+// processes never read a partial file
+func writeRefreshTokenFile(path string, file *refreshTokenFile) error {
+	data, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal refresh tokens")
+	}
+
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return errors.Wrap(err, "failed to create refresh tokens directory")
+	}
+
+	tmp, err := os.CreateTemp(dir, ".refresh-tokens-*")
+	if err != nil {
+		return errors.Wrap(err, "failed to create refresh tokens file")
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := tmp.Chmod(0600); err != nil {
+		tmp.Close()
+		return errors.Wrap(err, "failed to set refresh tokens file permissions")
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return errors.Wrap(err, "failed to write refresh tokens")
+	}
+	if err := tmp.Close(); err != nil {
+		return errors.Wrap(err, "failed to write refresh tokens")
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return errors.Wrap(err, "failed to replace refresh tokens file")
+	}
+	return nil
+}
+
+// tokenCredentialStore gives the token handler the credentials of a remote.  Without an identity
+// token, refresh tokens are read from and saved to the refresh token file, when there is one.
+type tokenCredentialStore struct {
+	username      string
+	password      string
+	identityToken string
+	path          string
+
+	// storedToken is the refresh token that was read from the file, for storedRealm and storedService
+	storedToken   string
+	storedRealm   string
+	storedService string
+}
+
+// Basic implements auth.CredentialStore
+func (s *tokenCredentialStore) Basic(*url.URL) (string, string) {
+	return s.username, s.password
+}
+
+// RefreshToken implements auth.CredentialStore
+func (s *tokenCredentialStore) RefreshToken(realm *url.URL, service string) string {
+	if s.identityToken != "" {
+		return s.identityToken
+	}
+	if !s.persistent() {
+		return ""
+	}
+
+	token, err := loadRefreshToken(s.path, realm.String(), service, s.username)
+	if err != nil {
+		log.Infof("Not using stored refresh token: %v", err)
+		return ""
+	}
+	s.storedToken, s.storedRealm, s.storedService = token, realm.String(), service
+	return token
+}
+
+// SetRefreshToken implements auth.CredentialStore
+func (s *tokenCredentialStore) SetRefreshToken(realm *url.URL, service, token string) {
+	if s.identityToken != "" || !s.persistent() {
+		return
+	}
+
+	if err := storeRefreshToken(s.path, realm.String(), service, s.username, token); err != nil {
+		log.Infof("Failed to store refresh token: %v", err)
+	}
+}
+
+// forgetStoredToken deletes the refresh token that was read from the file, after the auth server
+// refused it
+func (s *tokenCredentialStore) forgetStoredToken() {
+	if s.storedToken == "" {
+		return
+	}
+
+	if err := deleteRefreshToken(s.path, s.storedRealm, s.storedService, s.username, s.storedToken); err != nil {
+		log.Infof("Failed to delete refresh token: %v", err)
+	}
+	s.storedToken = ""
+}
+
+// persistent reports whether refresh tokens are kept in a file.  Refresh tokens are given for
+// credentials, so there are none without a username.
+func (s *tokenCredentialStore) persistent() bool {
+	return s.path != "" && s.username != ""
+}
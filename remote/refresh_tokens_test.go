@@ -0,0 +1,164 @@
+package remote
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRefreshTokenFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "harpoon", "refresh-tokens.json")
+
+	token, err := loadRefreshToken(path, "https://auth.example.com/token", "registry", "user")
+	require.NoError(t, err)
+	assert.Empty(t, token)
+
+	require.NoError(t, storeRefreshToken(path, "https://auth.example.com/token", "registry", "user", "refresh-1"))
+	require.NoError(t, storeRefreshToken(path, "https://auth.example.com/token", "registry", "other", "refresh-other"))
+	require.NoError(t, storeRefreshToken(path, "https://auth.example.com/token", "registry", "user", "refresh-2"))
+
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	token, err = loadRefreshToken(path, "https://auth.example.com/token", "registry", "user")
+	require.NoError(t, err)
+	assert.Equal(t, "refresh-2", token)
+
+	token, err = loadRefreshToken(path, "https://auth.example.com/token", "other-registry", "user")
+	require.NoError(t, err)
+	assert.Empty(t, token)
+
+	// A token that was replaced already is not deleted
+	require.NoError(t, deleteRefreshToken(path, "https://auth.example.com/token", "registry", "user", "refresh-1"))
+	token, err = loadRefreshToken(path, "https://auth.example.com/token", "registry", "user")
+	require.NoError(t, err)
+	assert.Equal(t, "refresh-2", token)
+
+	require.NoError(t, deleteRefreshToken(path, "https://auth.example.com/token", "registry", "user", "refresh-2"))
+	token, err = loadRefreshToken(path, "https://auth.example.com/token", "registry", "user")
+	require.NoError(t, err)
+	assert.Empty(t, token)
+
+	token, err = loadRefreshToken(path, "https://auth.example.com/token", "registry", "other")
+	require.NoError(t, err)
+	assert.Equal(t, "refresh-other", token)
+}
+
+// newRefreshTokenTestServer is a registry whose auth server gives refresh tokens for user:pass, and
+// accepts the last one it gave.  It returns the grant of each token request.
+func newRefreshTokenTestServer(t *testing.T) (*httptest.Server, func() []string) {
+	var mu sync.Mutex
+	var grants []string
+	var refreshToken string
+	var issued int
+
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if req.URL.Path != "/token" {
+			if req.Header.Get("Authorization") != "Bearer access-token" {
+				w.Header().Set("Www-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="test"`, server.URL))
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			w.Write([]byte("ok"))
+			return
+		}
+
+		if req.Method == "POST" {
+			grants = append(grants, req.FormValue("grant_type"))
+			if req.FormValue("refresh_token") != refreshToken {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(`{"error":"invalid_grant"}`))
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"access_token": "access-token"})
+			return
+		}
+
+		grants = append(grants, "basic")
+		username, password, _ := req.BasicAuth()
+		if username != "user" || password != "pass" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		response := map[string]interface{}{"token": "access-token"}
+		if req.URL.Query().Get("offline_token") == "true" {
+			issued++
+			refreshToken = fmt.Sprintf("refresh-%d", issued)
+			response["refresh_token"] = refreshToken
+		}
+		json.NewEncoder(w).Encode(response)
+	}))
+	t.Cleanup(server.Close)
+
+	return server, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), grants...)
+	}
+}
+
+// pullManifest requests a manifest with a new remote, like a new process would
+func pullManifest(t *testing.T, server *httptest.Server, refreshTokenFile string) {
+	dockerRemote, err := ParseDockerURI("docker://" + strings.TrimPrefix(server.URL, "http://") + "/ns/img")
+	require.NoError(t, err)
+	dockerRemote.Username = "user"
+	dockerRemote.Password = "pass"
+	dockerRemote.RefreshTokenFile = refreshTokenFile
+
+	req, err := dockerRemote.NewHttpRequest(context.Background(), "GET", server.URL+"/v2/ns/img/manifests/latest", nil)
+	require.NoError(t, err)
+	resp, err := dockerRemote.DoWithRetry(req, 3)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestDoPersistsRefreshTokens(t *testing.T) {
+	server, grants := newRefreshTokenTestServer(t)
+	path := filepath.Join(t.TempDir(), "refresh-tokens.json")
+
+	pullManifest(t, server, path)
+	pullManifest(t, server, path)
+	assert.Equal(t, []string{"basic", "refresh_token"}, grants())
+
+	token, err := loadRefreshToken(path, server.URL+"/token", "test", "user")
+	require.NoError(t, err)
+	assert.Equal(t, "refresh-1", token)
+}
+
+func TestDoReplacesRefusedRefreshToken(t *testing.T) {
+	server, grants := newRefreshTokenTestServer(t)
+	path := filepath.Join(t.TempDir(), "refresh-tokens.json")
+	require.NoError(t, storeRefreshToken(path, server.URL+"/token", "test", "user", "revoked"))
+
+	pullManifest(t, server, path)
+	assert.Equal(t, []string{"refresh_token", "basic"}, grants())
+
+	token, err := loadRefreshToken(path, server.URL+"/token", "test", "user")
+	require.NoError(t, err)
+	assert.Equal(t, "refresh-1", token)
+}
+
+func TestDoWithoutRefreshTokenFile(t *testing.T) {
+	server, grants := newRefreshTokenTestServer(t)
+
+	pullManifest(t, server, "")
+	pullManifest(t, server, "")
+	assert.Equal(t, []string{"basic", "basic"}, grants())
+}
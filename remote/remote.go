@@ -1,16 +1,21 @@
 package remote
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
 	"strings"
+	"sync"
 
 	"github.com/replicatedcom/harpoon/log"
+	"github.com/replicatedcom/harpoon/params"
 	"github.com/replicatedcom/harpoon/requests"
 
 	"github.com/docker/distribution/reference"
+	digest "github.com/opencontainers/go-digest"
 	"github.com/pkg/errors"
 )
 
@@ -20,122 +25,289 @@ const (
 
 // DockerRemote represents a parsed docker:// image uri.
 type DockerRemote struct {
-	Hostname  string
-	Namespace string
-	ImageName string
-	Tag       string
-	Ref       reference.Named
+	Hostname   string
+	Repository string // Repository is the path of the repository in the registry, like library/nginx
+	Tag        string
+	Digest     digest.Digest // Digest is set when the image is pinned by digest, with or without a tag
+	Ref        reference.Named
 
 	PreferredProto string
 
-	Username string
-	Password string
-	Token    string
+	// CertsDir has a directory per registry host[:port] with CA bundles and client certificates,
+	// like /etc/docker/certs.d.  *.crt files are CA bundles trusted in addition to the system
+	// roots, and *.cert files are client certificates with the key in the *.key file of the same
+	// name.  It defaults to params.DockerCertsDir, and is read by InitClient.
+	CertsDir string
+
+	// InsecureRegistries are the hosts, host:ports and CIDRs of registries that may be reached
+	// over plain http, or over https without verifying their certificate.  A CIDR matches the
+	// addresses the registry hostname resolves to, and loopback registries are always insecure.
+	// Like docker, https is tried first, and http is used when it cannot be reached.  See
+	// IsInsecure.
+	InsecureRegistries []string
+
+	// Mirrors are endpoints, like https://mirror.example.com or mirror:5000, that are tried in
+	// order before the registry for manifests and blobs.  The next endpoint is used when a mirror
+	// responds with 404 or 5xx, refuses authentication, or cannot be reached, and mirrors that
+	// cannot be reached are skipped for the rest of the pull.  Mirrors use their own credentials
+	// and certificates.  See MirrorsFor.
+	Mirrors []string
+
+	// Retry is the policy for requests that fail with a network error or a transient response
+	Retry RetryPolicy
+
+	// Username and Password authenticate to the registry.  When neither is set, they are looked up
+	// with ResolveCredentials the first time the registry asks for authentication.
+	Username      string
+	Password      string
+	IdentityToken string // IdentityToken is an OAuth refresh token, from docker login or a credential helper
+
+	// Token is a bearer token, or an OAuth2 identity/refresh token, that authenticates to the
+	// registry instead of the credentials.  It is sent as is until the registry refuses it, and is
+	// then exchanged for access tokens at the realm the registry points to.  The v1 protocol does
+	// not use it.
+	Token string
+
+	// PullSecrets are Kubernetes .dockerconfigjson files to look up credentials in
+	PullSecrets []string
+
+	// RefreshTokenFile keeps the OAuth2 refresh tokens that auth servers give for the Username, so
+	// later pulls, and later processes, get tokens without sending the password again.  A refresh
+	// token that is refused is deleted, and the password is sent instead.  Only the user can read
+	// the file.  Refresh tokens are not kept when it is empty.  See DefaultRefreshTokenFile.
+	RefreshTokenFile string
+
+	// Tokens caches the bearer tokens for the registry.  It may be shared by remotes, and is
+	// created by InitClient when it is nil.
+	Tokens *TokenStore
 
 	RegistryReader  io.Reader
 	ServiceHostname string // ServiceHostname is the endpoint we are told to connect to by the initial call to the registry.
-	AuthHeader      string // AuthHeader is the header to use for auth, generated by the remote server.
+	AuthHeader      string // AuthHeader is sent instead of resolving auth when set.  Resolved basic, ECR and bearer auth is in Tokens.
 
 	RemoteEndpoints string // Data from "X-Docker-Endpoints" header
 	RemoteToken     string // Data from "X-Docker-Token" header
 	RemoteCookie    string // Data from "Set-Cookie" header
 
 	client *requests.HttpClient
+
+	// credentialsOnce resolves the credentials the first time they are needed, and credentialsErr
+	// is the error it gave
+	credentialsOnce sync.Once
+	credentialsErr  error
+
+	// mu guards tokenRefused and scheme, which requests in flight read and set
+	mu sync.Mutex
+
+	// tokenRefused is set when the registry did not accept Token as a bearer token
+	tokenRefused bool
+
+	// scheme is the scheme the registry is reached with, once send has found it
+	scheme string
+
+	mirrors []*mirror
 }
 
 const (
 	DefaultHostname  = "index.docker.io"
 	DefaultNamespace = "library"
 	DefaultTag       = "latest"
+	DefaultProto     = "v2"
+
+	// dockerHubDomain is the domain reference.ParseNormalizedNamed gives Docker Hub images
+	dockerHubDomain = "docker.io"
 )
 
 // ParseDockerURI will accept a docker:// image uri and return a DockerRemote or error object.
 func ParseDockerURI(imageURI string) (*DockerRemote, error) {
+	dockerRemote, err := ParseImageURI(imageURI)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := dockerRemote.InitClient(); err != nil {
+		log.Error(err)
+		return nil, err
+	}
+
+	return dockerRemote, nil
+}
+
+// ParseImageURI parses a docker:// image uri like ParseDockerURI, but does not create the http
+// client.  Callers set the options of the remote and then call InitClient.
+func ParseImageURI(imageURI string) (*DockerRemote, error) {
 	if !strings.HasPrefix(imageURI, "docker://") {
 		return nil, errors.New("invalid image uri - expected docker:// prefix")
 	}
 
 	imageURI = strings.TrimPrefix(imageURI, "docker://")
 
-	// The format can vary.  There may be a host and there may be a namespace.  Both are optional.
-	// But it's not currently possible to have a host without a namespace.
-	// So, valid options are:
+	// The format can vary.  The host, with or without a port, is optional and the repository path
+	// can have any number of components.  So, valid options include:
 	//
-	//  host/namespace/image:tag
-	//  host/namespace/image
-	//  namespace/image:tag
-	//  namespace/image
-	//  image:tag
 	//  image
+	//  namespace/image:tag
+	//  host/namespace/image:tag
+	//  host:port/group/subgroup/image:tag
+	//
+	// Any of them may be followed by a digest: image@sha256:..., image:tag@sha256:...
+	// Images without a host are on Docker Hub, where single component names are in the library namespace.
 
-	imageURIAndTag := strings.Split(imageURI, ":")
-	imageURIParts := strings.Split(imageURIAndTag[0], "/")
+	named, err := reference.ParseNormalizedNamed(imageURI)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse normalized name")
+	}
 
 	dockerRemote := DockerRemote{
-		Hostname:  DefaultHostname,
-		Namespace: DefaultNamespace,
-		Tag:       DefaultTag,
-	}
-
-	if len(imageURIParts) == 3 {
-		dockerRemote.Hostname = imageURIParts[0]
-		dockerRemote.Namespace = imageURIParts[1]
-		dockerRemote.ImageName = imageURIParts[2]
-	} else if len(imageURIParts) == 2 {
-		dockerRemote.Namespace = imageURIParts[0]
-		dockerRemote.ImageName = imageURIParts[1]
-	} else if len(imageURIParts) == 1 {
-		dockerRemote.ImageName = imageURIParts[0]
-	} else {
-		return nil, errors.New("invalid image uri - expected less than 3 separators (/)")
+		Hostname:         reference.Domain(named),
+		Repository:       reference.Path(named),
+		PreferredProto:   DefaultProto,
+		CertsDir:         params.Get().DockerCertsDir,
+		RefreshTokenFile: DefaultRefreshTokenFile(),
 	}
 
-	if len(imageURIAndTag) == 2 {
-		dockerRemote.Tag = imageURIAndTag[1]
+	if dockerRemote.Hostname == dockerHubDomain {
+		dockerRemote.Hostname = DefaultHostname
 	}
 
-	named, err := reference.ParseNormalizedNamed(imageURI)
-	if err != nil {
-		return nil, errors.Wrap(err, "failed to parse normalized name")
+	if tagged, isTagged := named.(reference.Tagged); isTagged {
+		dockerRemote.Tag = tagged.Tag()
 	}
-	dockerRemote.Ref = named
 
-	if err := dockerRemote.InitClient(); err != nil {
-		log.Error(err)
-		return nil, err
+	if canonical, isCanonical := named.(reference.Canonical); isCanonical {
+		dockerRemote.Digest = canonical.Digest()
+	} else if dockerRemote.Tag == "" {
+		named = reference.TagNameOnly(named)
+		dockerRemote.Tag = DefaultTag
 	}
+	dockerRemote.Ref = named
 
 	return &dockerRemote, nil
 }
 
+// InitClient creates the http client for the registry.  It connects with the CA bundles and client
+// certificates for the host in CertsDir, when there are any, and does not verify the certificates
+// of insecure registries.
 func (remote *DockerRemote) InitClient() error {
-	client, err := requests.GetHttpClient(os.Getenv("HTTP_PROXY"))
+	tlsConfig, err := registryTLSConfig(remote.CertsDir, remote.Hostname)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+
+	if tlsConfig != nil {
+		log.Debugf("Using certificates from %s for %s", remote.CertsDir, remote.Hostname)
+	}
+
+	if remote.IsInsecure() {
+		if tlsConfig == nil {
+			tlsConfig = &tls.Config{}
+		}
+		tlsConfig.InsecureSkipVerify = true
+	}
+
+	var client *requests.HttpClient
+	if tlsConfig != nil {
+		client, err = requests.GetHttpClientWithTLS(os.Getenv("HTTP_PROXY"), tlsConfig)
+	} else {
+		client, err = requests.GetHttpClient(os.Getenv("HTTP_PROXY"))
+	}
 	if err != nil {
 		log.Error(err)
 		return errors.Wrap(err, "failed to init http client")
 	}
 
 	remote.client = client
+	if remote.Tokens == nil {
+		remote.Tokens = NewTokenStore()
+	}
 	return nil
 }
 
-func (remote *DockerRemote) GetDisplayName() string {
-	name := remote.ImageName
-	if remote.Namespace != DefaultNamespace {
-		name = fmt.Sprintf("%s/%s", remote.Namespace, name)
+// ManifestReference returns the digest or the tag to fetch the manifest with.  The digest is
+// preferred when both are set, because it pins the content.
+func (remote *DockerRemote) ManifestReference() string {
+	if remote.Digest != "" {
+		return remote.Digest.String()
 	}
-	if remote.Hostname != DefaultHostname {
+	return remote.Tag
+}
+
+func (remote *DockerRemote) GetDisplayName() string {
+	name := remote.Repository
+	if remote.Hostname == DefaultHostname {
+		name = strings.TrimPrefix(name, DefaultNamespace+"/")
+	} else {
 		name = fmt.Sprintf("%s/%s", remote.Hostname, name)
 	}
 	return name
 }
 
+// loadCredentials resolves the credentials for the registry, unless they were set on the remote.
+// They are only looked up once, by the first request that needs them, and the credential fields
+// are not changed after that, so requests in flight read them once this returns.
+func (remote *DockerRemote) loadCredentials() error {
+	remote.credentialsOnce.Do(func() {
+		remote.credentialsErr = remote.resolveCredentials()
+	})
+	return remote.credentialsErr
+}
+
+func (remote *DockerRemote) resolveCredentials() error {
+	if remote.Username != "" || remote.Password != "" || remote.IdentityToken != "" || remote.Token != "" {
+		return nil
+	}
+
+	creds, err := ResolveCredentials(remote.Hostname, remote.PullSecrets...)
+	if err != nil {
+		return errors.Wrapf(err, "failed to resolve credentials for %s", remote.Hostname)
+	}
+	if !creds.IsEmpty() {
+		log.Debugf("Using stored credentials for %s", remote.Hostname)
+	}
+
+	remote.Username = creds.Username
+	remote.Password = creds.Password
+	remote.IdentityToken = creds.IdentityToken
+
+	return nil
+}
+
+// isTokenRefused reports whether the registry refused Token as a bearer token
+func (remote *DockerRemote) isTokenRefused() bool {
+	remote.mu.Lock()
+	defer remote.mu.Unlock()
+
+	return remote.tokenRefused
+}
+
+func (remote *DockerRemote) refuseToken() {
+	remote.mu.Lock()
+	defer remote.mu.Unlock()
+
+	remote.tokenRefused = true
+}
+
+// storedAuthHeader returns the basic or ECR auth header that was resolved for the registry and the
+// credentials of the remote, if any
+func (remote *DockerRemote) storedAuthHeader() (string, error) {
+	if !remote.Tokens.hasAuthHeaders(remote.Hostname) {
+		return "", nil
+	}
+	if err := remote.loadCredentials(); err != nil {
+		return "", err
+	}
+	return remote.Tokens.authHeader(remote.Hostname, remote.tokenIdentity()), nil
+}
+
 // func (remote *DockerRemote) GetHttpClient() *requests.HttpClient {
 // 	return remote.client
 // }
 
-func (remote *DockerRemote) NewHttpRequest(method, uri string, body io.Reader) (*http.Request, error) {
-	req, err := remote.client.NewRequest(method, uri, body)
+// NewHttpRequest creates a request to the registry.  The request, and any authentication it
+// triggers in DoWithRetry, is cancelled with ctx.
+func (remote *DockerRemote) NewHttpRequest(ctx context.Context, method, uri string, body io.Reader) (*http.Request, error) {
+	req, err := remote.client.NewRequestWithContext(ctx, method, uri, body)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to create request")
 	}
@@ -147,19 +319,42 @@ func (remote *DockerRemote) Do(req *http.Request) (*http.Response, error) {
 	return remote.DoWithRetry(req, 1)
 }
 
-// DoRequest will actually make the request, and will authenticate with the v2 auth server, if needed
+// DoRequest will actually make the request, and will authenticate with the v2 auth server, if needed.
+// Token requests use the context of req, so they are cancelled along with it.  Network errors and
+// transient responses are retried with the Retry policy, separately from numAttempts.  Manifest
+// and blob requests are sent to the Mirrors first.
 func (remote *DockerRemote) DoWithRetry(req *http.Request, numAttempts int, additionalScope ...string) (*http.Response, error) {
+	if len(remote.Mirrors) > 0 && req.URL.Host == remote.Hostname && isMirroredPath(req.URL.Path) {
+		return remote.doWithMirrors(req, numAttempts, additionalScope...)
+	}
+	return remote.doWithAuth(req, numAttempts, additionalScope...)
+}
+
+func (remote *DockerRemote) doWithAuth(req *http.Request, numAttempts int, additionalScope ...string) (*http.Response, error) {
 	if numAttempts == 0 {
 		return nil, errors.New("too many retries")
 	}
 
+	authHeader, err := remote.storedAuthHeader()
+	if err != nil {
+		return nil, err
+	}
+
+	sentToken := false
 	if remote.AuthHeader != "" {
 		req.Header.Set("Authorization", remote.AuthHeader)
+	} else if authHeader != "" {
+		req.Header.Set("Authorization", authHeader)
+	} else if remote.Token != "" && !remote.isTokenRefused() {
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", remote.Token))
+		sentToken = true
+	} else if err := remote.setBearerToken(req, additionalScope...); err != nil {
+		return nil, err
 	}
 
-	resp, err := remote.client.Do(req)
+	resp, err := remote.send(req)
 	if err != nil {
-		return nil, errors.Wrap(err, "failed to do request")
+		return nil, connectionError{errors.Wrap(err, "failed to do request")}
 	}
 
 	// We need to authenticate after attempting a request in order
@@ -169,24 +364,47 @@ func (remote *DockerRemote) DoWithRetry(req *http.Request, numAttempts int, addi
 
 		log.Debugf("Got unauthorized for url %s, retrying...", req.URL.String())
 
+		if sentToken {
+			log.Debugf("The token was refused as a bearer token, exchanging it for an access token")
+			remote.refuseToken()
+		}
+
+		if err := remote.loadCredentials(); err != nil {
+			return nil, err
+		}
+
 		isAWS := isValidAWSEndpoint(req.Host)
 		if err != nil {
 			log.Error(err)
 		}
 		if isAWS {
-			if err := remote.resolveECRAuth(req.Host); err != nil {
+			if err := remote.resolveECRAuth(req.Context(), req.Host); err != nil {
 				return nil, err
 			}
-			return remote.DoWithRetry(req, numAttempts-1)
+			return remote.doWithAuth(req, numAttempts-1)
 		}
 
-		// We need bearer auth and try again...
-		if err := remote.resolveAuth(resp.Header.Get("Www-Authenticate"), additionalScope...); err != nil {
+		// We need bearer auth and try again, with the scope the registry asked for
+		authenticateHeader := resp.Header.Get("Www-Authenticate")
+		if _, _, scope := parseAuthenticateHeader(strings.TrimPrefix(authenticateHeader, "Bearer ")); scope != "" {
+			additionalScope = append(additionalScope, scope)
+		}
+		if err := remote.resolveAuth(req.Context(), authenticateHeader, requestScopes(req, additionalScope)...); err != nil {
 			return nil, err
 		}
 
-		return remote.DoWithRetry(req, numAttempts-1)
+		return remote.doWithAuth(req, numAttempts-1, additionalScope...)
 	}
 
 	return resp, nil
 }
+
+// connectionError is the error of a request that got no response from the registry, unlike the
+// errors of authenticating to it
+type connectionError struct {
+	error
+}
+
+func (e connectionError) Unwrap() error {
+	return e.error
+}
@@ -1,6 +1,7 @@
 package remote
 
 import (
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -12,8 +13,7 @@ func TestParseLibraryNoTag(t *testing.T) {
 	require.NoError(t, err)
 
 	assert.Equal(t, DefaultHostname, dockerRemote.Hostname)
-	assert.Equal(t, DefaultNamespace, dockerRemote.Namespace)
-	assert.Equal(t, "img", dockerRemote.ImageName)
+	assert.Equal(t, "library/img", dockerRemote.Repository)
 	assert.Equal(t, DefaultTag, dockerRemote.Tag)
 }
 
@@ -22,8 +22,7 @@ func TestParseLibraryTag(t *testing.T) {
 	require.NoError(t, err)
 
 	assert.Equal(t, DefaultHostname, dockerRemote.Hostname)
-	assert.Equal(t, DefaultNamespace, dockerRemote.Namespace)
-	assert.Equal(t, "img", dockerRemote.ImageName)
+	assert.Equal(t, "library/img", dockerRemote.Repository)
 	assert.Equal(t, "tag", dockerRemote.Tag)
 }
 
@@ -32,8 +31,7 @@ func TestParseNamespaceNoTag(t *testing.T) {
 	require.NoError(t, err)
 
 	assert.Equal(t, DefaultHostname, dockerRemote.Hostname)
-	assert.Equal(t, "ns", dockerRemote.Namespace)
-	assert.Equal(t, "img", dockerRemote.ImageName)
+	assert.Equal(t, "ns/img", dockerRemote.Repository)
 	assert.Equal(t, DefaultTag, dockerRemote.Tag)
 }
 
@@ -42,8 +40,7 @@ func TestParseNamespaceTag(t *testing.T) {
 	require.NoError(t, err)
 
 	assert.Equal(t, DefaultHostname, dockerRemote.Hostname)
-	assert.Equal(t, "ns", dockerRemote.Namespace)
-	assert.Equal(t, "img", dockerRemote.ImageName)
+	assert.Equal(t, "ns/img", dockerRemote.Repository)
 	assert.Equal(t, "tag", dockerRemote.Tag)
 }
 
@@ -52,8 +49,7 @@ func TestParseNotHubNoTag(t *testing.T) {
 	require.NoError(t, err)
 
 	assert.Equal(t, "hostname.com", dockerRemote.Hostname)
-	assert.Equal(t, "ns", dockerRemote.Namespace)
-	assert.Equal(t, "img", dockerRemote.ImageName)
+	assert.Equal(t, "ns/img", dockerRemote.Repository)
 	assert.Equal(t, DefaultTag, dockerRemote.Tag)
 }
 
@@ -62,7 +58,98 @@ func TestParseNotHubTag(t *testing.T) {
 	require.NoError(t, err)
 
 	assert.Equal(t, "hostname.com", dockerRemote.Hostname)
-	assert.Equal(t, "ns", dockerRemote.Namespace)
-	assert.Equal(t, "img", dockerRemote.ImageName)
+	assert.Equal(t, "ns/img", dockerRemote.Repository)
 	assert.Equal(t, "tag", dockerRemote.Tag)
 }
+
+func TestParseDigest(t *testing.T) {
+	dgst := "sha256:" + strings.Repeat("a", 64)
+	dockerRemote, err := ParseDockerURI("docker://hostname.com/ns/img@" + dgst)
+	require.NoError(t, err)
+
+	assert.Equal(t, "hostname.com", dockerRemote.Hostname)
+	assert.Equal(t, "ns/img", dockerRemote.Repository)
+	assert.Equal(t, "", dockerRemote.Tag)
+	assert.Equal(t, dgst, dockerRemote.Digest.String())
+	assert.Equal(t, dgst, dockerRemote.ManifestReference())
+	assert.Equal(t, "hostname.com/ns/img@"+dgst, dockerRemote.Ref.String())
+}
+
+func TestParseTagAndDigest(t *testing.T) {
+	dgst := "sha256:" + strings.Repeat("a", 64)
+	dockerRemote, err := ParseDockerURI("docker://img:tag@" + dgst)
+	require.NoError(t, err)
+
+	assert.Equal(t, "library/img", dockerRemote.Repository)
+	assert.Equal(t, "tag", dockerRemote.Tag)
+	assert.Equal(t, dgst, dockerRemote.Digest.String())
+	assert.Equal(t, dgst, dockerRemote.ManifestReference())
+	assert.Equal(t, "docker.io/library/img:tag@"+dgst, dockerRemote.Ref.String())
+}
+
+func TestParseDefaultTagReference(t *testing.T) {
+	dockerRemote, err := ParseDockerURI("docker://img")
+	require.NoError(t, err)
+
+	assert.Equal(t, DefaultTag, dockerRemote.ManifestReference())
+	assert.Equal(t, "docker.io/library/img:latest", dockerRemote.Ref.String())
+}
+
+func TestParsePort(t *testing.T) {
+	dockerRemote, err := ParseDockerURI("docker://localhost:5000/team/app:1.0")
+	require.NoError(t, err)
+
+	assert.Equal(t, "localhost:5000", dockerRemote.Hostname)
+	assert.Equal(t, "team/app", dockerRemote.Repository)
+	assert.Equal(t, "1.0", dockerRemote.Tag)
+	assert.Equal(t, "localhost:5000/team/app:1.0", dockerRemote.Ref.String())
+}
+
+func TestParsePortNoTag(t *testing.T) {
+	dockerRemote, err := ParseDockerURI("docker://localhost:5000/app")
+	require.NoError(t, err)
+
+	assert.Equal(t, "localhost:5000", dockerRemote.Hostname)
+	assert.Equal(t, "app", dockerRemote.Repository)
+	assert.Equal(t, DefaultTag, dockerRemote.Tag)
+}
+
+func TestParseDeepPath(t *testing.T) {
+	dockerRemote, err := ParseDockerURI("docker://registry.example.com/group/subgroup/project/app:tag")
+	require.NoError(t, err)
+
+	assert.Equal(t, "registry.example.com", dockerRemote.Hostname)
+	assert.Equal(t, "group/subgroup/project/app", dockerRemote.Repository)
+	assert.Equal(t, "tag", dockerRemote.Tag)
+	assert.Equal(t, "registry.example.com/group/subgroup/project/app", dockerRemote.GetDisplayName())
+}
+
+func TestParseDisplayName(t *testing.T) {
+	dockerRemote, err := ParseDockerURI("docker://img")
+	require.NoError(t, err)
+	assert.Equal(t, "img", dockerRemote.GetDisplayName())
+
+	dockerRemote, err = ParseDockerURI("docker://ns/img")
+	require.NoError(t, err)
+	assert.Equal(t, "ns/img", dockerRemote.GetDisplayName())
+}
+
+func TestParseInvalid(t *testing.T) {
+	_, err := ParseDockerURI("img")
+	require.Error(t, err)
+
+	_, err = ParseDockerURI("docker://Host/IMG")
+	require.Error(t, err)
+}
+
+func TestParseImageURIWithoutClient(t *testing.T) {
+	dockerRemote, err := ParseImageURI("docker://localhost:5000/team/app:1.0")
+	require.NoError(t, err)
+	assert.Equal(t, "localhost:5000", dockerRemote.Hostname)
+	assert.Nil(t, dockerRemote.client)
+	assert.Nil(t, dockerRemote.Tokens)
+
+	require.NoError(t, dockerRemote.InitClient())
+	assert.NotNil(t, dockerRemote.client)
+	assert.NotNil(t, dockerRemote.Tokens)
+}
@@ -0,0 +1,182 @@
+package remote
+
+import (
+	"context"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/replicatedcom/harpoon/log"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	DefaultMaxAttempts    = 5
+	DefaultInitialBackoff = 500 * time.Millisecond
+	DefaultMaxBackoff     = 30 * time.Second
+)
+
+// RetryPolicy controls how requests to the registry are retried after network errors and
+// transient responses: 408, 429, 500, 502, 503 and 504.  The zero value uses the defaults.
+type RetryPolicy struct {
+	// MaxAttempts is the number of times a request is sent, including the first.  1 disables
+	// retries.
+	MaxAttempts int
+
+	// InitialBackoff is the wait before the first retry.  It doubles with every retry, up to
+	// MaxBackoff, and the actual wait is jittered between half and all of it.  A Retry-After
+	// header from the registry is used instead when there is one, up to MaxBackoff.
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+}
+
+// Attempts returns the number of times a request is sent, including the first
+func (p RetryPolicy) Attempts() int {
+	if p.MaxAttempts <= 0 {
+		return DefaultMaxAttempts
+	}
+	return p.MaxAttempts
+}
+
+// Backoff returns the wait before the retry, counting from 1, with jitter
+func (p RetryPolicy) Backoff(retry int) time.Duration {
+	initial, max := p.InitialBackoff, p.maxBackoff()
+	if initial <= 0 {
+		initial = DefaultInitialBackoff
+	}
+
+	backoff := initial
+	for j := 1; j < retry && backoff < max; j++ {
+		backoff *= 2
+	}
+	if backoff > max {
+		backoff = max
+	}
+
+	return backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+}
+
+func (p RetryPolicy) maxBackoff() time.Duration {
+	if p.MaxBackoff <= 0 {
+		return DefaultMaxBackoff
+	}
+	return p.MaxBackoff
+}
+
+// Wait sleeps before the retry, counting from 1.  The Retry-After header of resp is honoured when
+// it is set, but not past MaxBackoff, so a registry cannot stall the pull for hours.  It returns
+// early with the error of ctx when ctx is cancelled.
+func (p RetryPolicy) Wait(ctx context.Context, retry int, resp *http.Response) error {
+	wait := p.Backoff(retry)
+	if after, ok := retryAfter(resp); ok {
+		wait = after
+		if max := p.maxBackoff(); wait > max {
+			log.Debugf("Waiting %s instead of the %s the registry asked for", max, wait)
+			wait = max
+		}
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// do sends the request with send until the response is not transient, or the attempts run out.
+// The last response or error is returned.
+func (p RetryPolicy) do(req *http.Request, send func(*http.Request) (*http.Response, error)) (*http.Response, error) {
+	ctx := req.Context()
+
+	for attempt := 1; ; attempt++ {
+		attemptReq := req
+		if attempt > 1 && req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, errors.Wrap(err, "failed to rewind request body")
+			}
+			attemptReq = req.Clone(ctx)
+			attemptReq.Body = body
+		}
+
+		resp, err := send(attemptReq)
+
+		canResend := req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+		if attempt >= p.Attempts() || !canResend || ctx.Err() != nil || !isTransient(resp, err) {
+			return resp, err
+		}
+
+		if err != nil {
+			log.Infof("Request to %s failed, retrying (attempt %d of %d): %v", req.URL, attempt+1, p.Attempts(), err)
+		} else {
+			log.Infof("Request to %s returned %d, retrying (attempt %d of %d)", req.URL, resp.StatusCode, attempt+1, p.Attempts())
+			io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+			resp.Body.Close()
+		}
+
+		if err := p.Wait(ctx, attempt, resp); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// isTransient reports whether a request that got resp or err may succeed when it is sent again.
+// Connections that fail or break are retried, but unknown hosts and invalid requests are not.
+func isTransient(resp *http.Response, err error) bool {
+	if err != nil {
+		if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+			return false
+		}
+
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) {
+			return !dnsErr.IsNotFound
+		}
+
+		var opErr *net.OpError
+		var netErr net.Error
+		return errors.As(err, &opErr) || (errors.As(err, &netErr) && netErr.Timeout()) ||
+			errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+	}
+
+	switch resp.StatusCode {
+	case http.StatusRequestTimeout, http.StatusTooManyRequests, http.StatusInternalServerError,
+		http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// retryAfter parses the Retry-After header of resp, which is either a number of seconds or a date
+func retryAfter(resp *http.Response) (time.Duration, bool) {
+	if resp == nil {
+		return 0, false
+	}
+
+	value := resp.Header.Get("Retry-After")
+	if value == "" {
+		return 0, false
+	}
+
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+
+	if date, err := http.ParseTime(value); err == nil {
+		wait := time.Until(date)
+		if wait < 0 {
+			wait = 0
+		}
+		return wait, true
+	}
+
+	return 0, false
+}
@@ -0,0 +1,221 @@
+package remote
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newRetryTestServer answers the first len(statuses) requests with the statuses, and 200 after
+// that.  It returns a remote that retries quickly and a function that counts the requests.
+func newRetryTestServer(t *testing.T, header http.Header, statuses ...int) (*DockerRemote, string, func() int) {
+	var mu sync.Mutex
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		requests++
+		if requests <= len(statuses) {
+			for key, values := range header {
+				w.Header()[key] = values
+			}
+			w.WriteHeader(statuses[requests-1])
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	t.Cleanup(server.Close)
+
+	dockerRemote, err := ParseDockerURI("docker://" + strings.TrimPrefix(server.URL, "http://") + "/ns/img")
+	require.NoError(t, err)
+	dockerRemote.Retry = RetryPolicy{InitialBackoff: time.Millisecond, MaxBackoff: 10 * time.Millisecond}
+
+	return dockerRemote, server.URL, func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return requests
+	}
+}
+
+func TestDoRetriesTransient(t *testing.T) {
+	dockerRemote, uri, requests := newRetryTestServer(t, nil, http.StatusServiceUnavailable, http.StatusBadGateway, http.StatusTooManyRequests)
+
+	req, err := dockerRemote.NewHttpRequest(context.Background(), "GET", uri, nil)
+	require.NoError(t, err)
+	resp, err := dockerRemote.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, 4, requests())
+}
+
+func TestDoGivesUp(t *testing.T) {
+	dockerRemote, uri, requests := newRetryTestServer(t, nil, http.StatusServiceUnavailable, http.StatusServiceUnavailable, http.StatusServiceUnavailable)
+	dockerRemote.Retry.MaxAttempts = 2
+
+	req, err := dockerRemote.NewHttpRequest(context.Background(), "GET", uri, nil)
+	require.NoError(t, err)
+	resp, err := dockerRemote.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	assert.Equal(t, 2, requests())
+}
+
+func TestDoDoesNotRetryPermanent(t *testing.T) {
+	dockerRemote, uri, requests := newRetryTestServer(t, nil, http.StatusNotFound)
+
+	req, err := dockerRemote.NewHttpRequest(context.Background(), "GET", uri, nil)
+	require.NoError(t, err)
+	resp, err := dockerRemote.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	assert.Equal(t, 1, requests())
+}
+
+func TestDoRetriesNetworkErrors(t *testing.T) {
+	// Nothing listens on the port once the server is closed
+	server := httptest.NewServer(http.NotFoundHandler())
+	uri := server.URL
+	server.Close()
+
+	policy := RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond}
+
+	var attempts int
+	req, err := http.NewRequest("GET", uri, nil)
+	require.NoError(t, err)
+	_, err = policy.do(req, func(req *http.Request) (*http.Response, error) {
+		attempts++
+		return http.DefaultClient.Do(req)
+	})
+	require.Error(t, err)
+	assert.Equal(t, 3, attempts)
+}
+
+func TestDoHonoursRetryAfter(t *testing.T) {
+	header := http.Header{"Retry-After": []string{"1"}}
+	dockerRemote, uri, requests := newRetryTestServer(t, header, http.StatusTooManyRequests)
+	dockerRemote.Retry.MaxBackoff = 2 * time.Second
+
+	start := time.Now()
+	req, err := dockerRemote.NewHttpRequest(context.Background(), "GET", uri, nil)
+	require.NoError(t, err)
+	resp, err := dockerRemote.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, 2, requests())
+	assert.True(t, time.Since(start) >= time.Second)
+}
+
+func TestWaitCapsRetryAfter(t *testing.T) {
+	resp := &http.Response{Header: http.Header{"Retry-After": []string{"86400"}}}
+	policy := RetryPolicy{MaxBackoff: 20 * time.Millisecond}
+
+	start := time.Now()
+	require.NoError(t, policy.Wait(context.Background(), 1, resp))
+	assert.True(t, time.Since(start) < time.Second)
+}
+
+func TestDoRetryCancelled(t *testing.T) {
+	header := http.Header{"Retry-After": []string{"60"}}
+	dockerRemote, uri, _ := newRetryTestServer(t, header, http.StatusServiceUnavailable)
+	dockerRemote.Retry.MaxBackoff = time.Minute
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	req, err := dockerRemote.NewHttpRequest(ctx, "GET", uri, nil)
+	require.NoError(t, err)
+	_, err = dockerRemote.Do(req)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestDoRetriesRequestBody(t *testing.T) {
+	var bodies []string
+	var mu sync.Mutex
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		body := make([]byte, 4)
+		n, _ := req.Body.Read(body)
+		bodies = append(bodies, string(body[:n]))
+		if len(bodies) == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+	defer server.Close()
+
+	policy := RetryPolicy{InitialBackoff: time.Millisecond}
+	req, err := http.NewRequest("POST", server.URL, strings.NewReader("form"))
+	require.NoError(t, err)
+	resp, err := policy.do(req, http.DefaultClient.Do)
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, []string{"form", "form"}, bodies)
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	policy := RetryPolicy{InitialBackoff: 100 * time.Millisecond, MaxBackoff: time.Second}
+
+	tests := []struct {
+		retry int
+		max   time.Duration
+	}{
+		{retry: 1, max: 100 * time.Millisecond},
+		{retry: 2, max: 200 * time.Millisecond},
+		{retry: 3, max: 400 * time.Millisecond},
+		{retry: 5, max: time.Second},
+		{retry: 50, max: time.Second},
+	}
+
+	for _, test := range tests {
+		for j := 0; j < 20; j++ {
+			backoff := policy.Backoff(test.retry)
+			assert.True(t, backoff >= test.max/2 && backoff <= test.max, "retry %d waited %s", test.retry, backoff)
+		}
+	}
+
+	assert.Equal(t, DefaultMaxAttempts, RetryPolicy{}.Attempts())
+}
+
+func TestRetryAfter(t *testing.T) {
+	tests := []struct {
+		value string
+		ok    bool
+		min   time.Duration
+		max   time.Duration
+	}{
+		{value: "", ok: false},
+		{value: "3", ok: true, min: 3 * time.Second, max: 3 * time.Second},
+		{value: "soon", ok: false},
+		{value: time.Now().Add(10 * time.Second).UTC().Format(http.TimeFormat), ok: true, min: 8 * time.Second, max: 10 * time.Second},
+		{value: time.Now().Add(-time.Minute).UTC().Format(http.TimeFormat), ok: true},
+	}
+
+	for _, test := range tests {
+		resp := &http.Response{Header: http.Header{}}
+		if test.value != "" {
+			resp.Header.Set("Retry-After", test.value)
+		}
+
+		wait, ok := retryAfter(resp)
+		assert.Equal(t, test.ok, ok, test.value)
+		assert.True(t, wait >= test.min && wait <= test.max, "%q waited %s", test.value, wait)
+	}
+}
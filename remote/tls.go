@@ -0,0 +1,31 @@
+package remote
+
+import (
+	"crypto/tls"
+	"path/filepath"
+
+	"github.com/docker/docker/registry"
+	"github.com/pkg/errors"
+)
+
+// registryTLSConfig loads the TLS configuration for the registry at hostname from
+// <certsDir>/<hostname>/, like docker does.  *.crt files are CA bundles that are trusted on top of
+// the system roots, and *.cert and *.key pairs are client certificates.  nil is returned when the
+// directory does not exist or has no certificates.
+func registryTLSConfig(certsDir, hostname string) (*tls.Config, error) {
+	if certsDir == "" || hostname == "" {
+		return nil, nil
+	}
+
+	dir := filepath.Join(certsDir, hostname)
+
+	tlsConfig := &tls.Config{}
+	if err := registry.ReadCertsDirectory(tlsConfig, dir); err != nil {
+		return nil, errors.Wrapf(err, "failed to read certificates from %s", dir)
+	}
+
+	if tlsConfig.RootCAs == nil && len(tlsConfig.Certificates) == 0 {
+		return nil, nil
+	}
+	return tlsConfig, nil
+}
@@ -0,0 +1,128 @@
+package remote
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newClientCertificate creates a self-signed client certificate, and returns it and its key in PEM
+func newClientCertificate(t *testing.T) (*x509.Certificate, []byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "harpoon"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		IsCA:         true,
+
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	return cert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+// newMutualTLSServer starts a server with a private CA that requires the client certificate
+func newMutualTLSServer(t *testing.T, clientCert *x509.Certificate) *httptest.Server {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(req.TLS.PeerCertificates[0].Subject.CommonName))
+	}))
+
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientCert)
+	server.TLS = &tls.Config{
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		ClientCAs:  clientCAs,
+	}
+	server.StartTLS()
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+func TestInitClientCertsDir(t *testing.T) {
+	clientCert, certPEM, keyPEM := newClientCertificate(t)
+	server := newMutualTLSServer(t, clientCert)
+	host := strings.TrimPrefix(server.URL, "https://")
+
+	certsDir := t.TempDir()
+	hostDir := filepath.Join(certsDir, host)
+	require.NoError(t, os.MkdirAll(hostDir, 0755))
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	require.NoError(t, os.WriteFile(filepath.Join(hostDir, "ca.crt"), caPEM, 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(hostDir, "client.cert"), certPEM, 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(hostDir, "client.key"), keyPEM, 0600))
+
+	get := func(certsDir string) (string, error) {
+		dockerRemote := &DockerRemote{Hostname: host, CertsDir: certsDir}
+		if err := dockerRemote.InitClient(); err != nil {
+			return "", err
+		}
+
+		req, err := dockerRemote.NewHttpRequest(context.Background(), "GET", server.URL, nil)
+		require.NoError(t, err)
+		resp, err := dockerRemote.Do(req)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+
+		body := make([]byte, 64)
+		n, _ := resp.Body.Read(body)
+		return string(body[:n]), nil
+	}
+
+	name, err := get(certsDir)
+	require.NoError(t, err)
+	assert.Equal(t, "harpoon", name)
+
+	// Without the directory there is no client certificate.  Loopback registries are insecure, so
+	// the client falls back to http, which the server refuses.
+	name, err = get(t.TempDir())
+	require.NoError(t, err)
+	assert.NotEqual(t, "harpoon", name)
+
+	// A client certificate without its key is an error, like in docker
+	require.NoError(t, os.Remove(filepath.Join(hostDir, "client.key")))
+	_, err = get(certsDir)
+	require.Error(t, err)
+}
+
+func TestRegistryTLSConfigEmpty(t *testing.T) {
+	certsDir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(certsDir, "registry.example.com"), 0755))
+
+	for _, hostname := range []string{"registry.example.com", "other.example.com:5000"} {
+		tlsConfig, err := registryTLSConfig(certsDir, hostname)
+		require.NoError(t, err)
+		assert.Nil(t, tlsConfig, hostname)
+	}
+}
@@ -0,0 +1,228 @@
+package remote
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// tokenExpiryLeeway is how long before they expire that tokens are fetched again, so they do not
+// expire in flight
+const tokenExpiryLeeway = 10 * time.Second
+
+// TokenStore caches bearer tokens by realm, service, credentials and set of scopes until they expire.  It also
+// remembers the bearer challenge of each registry, so requests to a registry that asked for a token
+// once get one before they are sent, and the basic or ECR auth header of each registry and
+// credentials.  It is safe for concurrent use, and may be shared by remotes, like the ones of a
+// proxy serving many clients.
+type TokenStore struct {
+	mu          sync.Mutex
+	challenges  map[string]bearerChallenge
+	tokens      map[string]*tokenEntry
+	authHeaders map[string]map[string]string // authHeaders are by host, and then by credentials identity
+	clock       clock
+}
+
+// bearerChallenge is where a registry sends clients for tokens, from its Www-Authenticate header
+type bearerChallenge struct {
+	Realm   string
+	Service string
+}
+
+// tokenEntry is a token that is cached, or being fetched until ready is closed
+type tokenEntry struct {
+	ready      chan struct{}
+	token      string
+	expiration time.Time
+	err        error
+}
+
+// NewTokenStore creates an empty token store
+func NewTokenStore() *TokenStore {
+	return &TokenStore{
+		challenges:  map[string]bearerChallenge{},
+		tokens:      map[string]*tokenEntry{},
+		authHeaders: map[string]map[string]string{},
+		clock:       realClock{},
+	}
+}
+
+// challenge returns the bearer challenge the registry at host sent last
+func (s *TokenStore) challenge(host string) (bearerChallenge, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c, ok := s.challenges[host]
+	return c, ok
+}
+
+func (s *TokenStore) setChallenge(host string, c bearerChallenge) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.challenges[host] = c
+}
+
+// hasAuthHeaders reports whether a basic or ECR auth header was resolved for the registry at host,
+// for any credentials
+func (s *TokenStore) hasAuthHeaders(host string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.authHeaders[host]) > 0
+}
+
+// authHeader returns the basic or ECR auth header of the registry at host for the credentials
+// identity, or ""
+func (s *TokenStore) authHeader(host, identity string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.authHeaders[host][identity]
+}
+
+func (s *TokenStore) setAuthHeader(host, identity, header string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.authHeaders[host] == nil {
+		s.authHeaders[host] = map[string]string{}
+	}
+	s.authHeaders[host][identity] = header
+}
+
+// token returns the cached token for the credentials identity and the scopes, or fetches one.
+// Callers that need a token that is being fetched wait for it, instead of fetching it again.
+// Errors are not cached.
+func (s *TokenStore) token(ctx context.Context, c bearerChallenge, identity string, scopes []string, fetch func(context.Context) (string, time.Time, error)) (string, error) {
+	key := tokenKey(c, identity, scopes)
+
+	for {
+		s.mu.Lock()
+		entry, ok := s.tokens[key]
+		if !ok {
+			break
+		}
+
+		select {
+		case <-entry.ready:
+			if entry.err == nil && s.clock.Now().Before(entry.expiration.Add(-tokenExpiryLeeway)) {
+				s.mu.Unlock()
+				return entry.token, nil
+			}
+			delete(s.tokens, key)
+			s.mu.Unlock()
+			continue
+		default:
+		}
+		s.mu.Unlock()
+
+		select {
+		case <-entry.ready:
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+
+		// The fetch of another caller may have been cancelled, which does not mean this one is
+		if entry.err == nil {
+			return entry.token, nil
+		}
+		if !errors.Is(entry.err, context.Canceled) && !errors.Is(entry.err, context.DeadlineExceeded) {
+			return "", entry.err
+		}
+	}
+
+	entry := &tokenEntry{ready: make(chan struct{})}
+	s.pruneLocked()
+	s.tokens[key] = entry
+	s.mu.Unlock()
+
+	entry.token, entry.expiration, entry.err = fetch(ctx)
+	if entry.err != nil {
+		s.forgetEntry(key, entry)
+	}
+	close(entry.ready)
+
+	return entry.token, entry.err
+}
+
+// forget drops the cached token for the scopes, after the registry refused it
+func (s *TokenStore) forget(c bearerChallenge, identity string, scopes []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := tokenKey(c, identity, scopes)
+	if entry, ok := s.tokens[key]; ok {
+		select {
+		case <-entry.ready:
+			delete(s.tokens, key)
+		default:
+			// A new token is being fetched already
+		}
+	}
+}
+
+func (s *TokenStore) forgetEntry(key string, entry *tokenEntry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.tokens[key] == entry {
+		delete(s.tokens, key)
+	}
+}
+
+// pruneLocked drops the tokens that expired.  s.mu must be held.
+func (s *TokenStore) pruneLocked() {
+	now := s.clock.Now()
+	for key, entry := range s.tokens {
+		select {
+		case <-entry.ready:
+			if !now.Before(entry.expiration) {
+				delete(s.tokens, key)
+			}
+		default:
+		}
+	}
+}
+
+// tokenKey identifies a token by the challenge, the credentials it was fetched with and the set of
+// scopes, in any order
+func tokenKey(c bearerChallenge, identity string, scopes []string) string {
+	scopes = uniqueStringSlice(scopes)
+	sort.Strings(scopes)
+	return strings.Join([]string{c.Realm, c.Service, identity, strings.Join(scopes, " ")}, "\x00")
+}
+
+// tokenIdentity identifies the credentials of the remote, so that remotes that share a store,
+// like mirrors or the remotes of different clients, never get the tokens of other credentials.
+// The secrets are hashed, so they are not kept in the store.
+func (remote *DockerRemote) tokenIdentity() string {
+	h := sha256.New()
+	for _, secret := range []string{remote.Password, remote.IdentityToken, remote.Token} {
+		h.Write([]byte(secret))
+		h.Write([]byte{0})
+	}
+	return remote.Username + "\x00" + hex.EncodeToString(h.Sum(nil))
+}
+
+// requestScope returns the scope to pull the repository of a manifest or blob request, or "" for
+// other requests
+func requestScope(path string) string {
+	if !strings.HasPrefix(path, "/v2/") {
+		return ""
+	}
+	path = strings.TrimPrefix(path, "/v2/")
+
+	for _, kind := range []string{"/manifests/", "/blobs/"} {
+		if i := strings.LastIndex(path, kind); i > 0 {
+			return "repository:" + path[:i] + ":pull"
+		}
+	}
+	return ""
+}
@@ -0,0 +1,425 @@
+package remote
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *testClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *testClock) Add(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// countingFetch returns a fetch that counts its calls, and returns a token that expires in an hour
+func countingFetch(clock clock, fetches *int32) func(context.Context) (string, time.Time, error) {
+	return func(context.Context) (string, time.Time, error) {
+		n := atomic.AddInt32(fetches, 1)
+		time.Sleep(10 * time.Millisecond)
+		return fmt.Sprintf("token-%d", n), clock.Now().Add(time.Hour), nil
+	}
+}
+
+func TestTokenStoreConcurrent(t *testing.T) {
+	store := NewTokenStore()
+	c := bearerChallenge{Realm: "https://auth.example.com/token", Service: "registry"}
+
+	var fetches int32
+	var wg sync.WaitGroup
+	for j := 0; j < 20; j++ {
+		wg.Add(1)
+		go func(j int) {
+			defer wg.Done()
+
+			// The order of the scopes does not matter
+			scopes := []string{"repository:a:pull", "repository:b:pull"}
+			if j%2 == 0 {
+				scopes = []string{"repository:b:pull", "repository:a:pull", "repository:a:pull"}
+			}
+			token, err := store.token(context.Background(), c, "", scopes, countingFetch(store.clock, &fetches))
+			assert.NoError(t, err)
+			assert.Equal(t, "token-1", token)
+		}(j)
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), fetches)
+
+	token, err := store.token(context.Background(), c, "", []string{"repository:a:pull"}, countingFetch(store.clock, &fetches))
+	require.NoError(t, err)
+	assert.Equal(t, "token-2", token)
+
+	other := bearerChallenge{Realm: "https://auth.example.com/token", Service: "other"}
+	token, err = store.token(context.Background(), other, "", []string{"repository:a:pull"}, countingFetch(store.clock, &fetches))
+	require.NoError(t, err)
+	assert.Equal(t, "token-3", token)
+}
+
+func TestTokenStoreExpiry(t *testing.T) {
+	clock := &testClock{now: time.Now()}
+	store := NewTokenStore()
+	store.clock = clock
+	c := bearerChallenge{Realm: "https://auth.example.com/token"}
+	scopes := []string{"repository:a:pull"}
+
+	var fetches int32
+	token, err := store.token(context.Background(), c, "", scopes, countingFetch(clock, &fetches))
+	require.NoError(t, err)
+	assert.Equal(t, "token-1", token)
+
+	clock.Add(time.Hour - 2*tokenExpiryLeeway)
+	token, err = store.token(context.Background(), c, "", scopes, countingFetch(clock, &fetches))
+	require.NoError(t, err)
+	assert.Equal(t, "token-1", token)
+
+	// Tokens are fetched again shortly before they expire
+	clock.Add(tokenExpiryLeeway)
+	token, err = store.token(context.Background(), c, "", scopes, countingFetch(clock, &fetches))
+	require.NoError(t, err)
+	assert.Equal(t, "token-2", token)
+
+	store.forget(c, "", scopes)
+	token, err = store.token(context.Background(), c, "", scopes, countingFetch(clock, &fetches))
+	require.NoError(t, err)
+	assert.Equal(t, "token-3", token)
+}
+
+func TestTokenStoreErrors(t *testing.T) {
+	store := NewTokenStore()
+	c := bearerChallenge{Realm: "https://auth.example.com/token"}
+	scopes := []string{"repository:a:pull"}
+
+	_, err := store.token(context.Background(), c, "", scopes, func(context.Context) (string, time.Time, error) {
+		return "", time.Time{}, ErrUnauthorized
+	})
+	require.ErrorIs(t, err, ErrUnauthorized)
+
+	// Errors are not cached
+	var fetches int32
+	token, err := store.token(context.Background(), c, "", scopes, countingFetch(store.clock, &fetches))
+	require.NoError(t, err)
+	assert.Equal(t, "token-1", token)
+}
+
+func TestTokenStoreCancelledFetch(t *testing.T) {
+	store := NewTokenStore()
+	c := bearerChallenge{Realm: "https://auth.example.com/token"}
+	scopes := []string{"repository:a:pull"}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	fetching := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, err := store.token(ctx, c, "", scopes, func(ctx context.Context) (string, time.Time, error) {
+			close(fetching)
+			<-ctx.Done()
+			return "", time.Time{}, ctx.Err()
+		})
+		assert.ErrorIs(t, err, context.Canceled)
+	}()
+	<-fetching
+
+	// The waiter fetches the token itself when the fetch it waited for is cancelled
+	var fetches int32
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+	token, err := store.token(context.Background(), c, "", scopes, countingFetch(store.clock, &fetches))
+	require.NoError(t, err)
+	assert.Equal(t, "token-1", token)
+	<-done
+}
+
+func TestRequestScope(t *testing.T) {
+	assert.Equal(t, "repository:library/nginx:pull", requestScope("/v2/library/nginx/manifests/latest"))
+	assert.Equal(t, "repository:group/sub/app:pull", requestScope("/v2/group/sub/app/blobs/sha256:abc"))
+	assert.Equal(t, "", requestScope("/v2/"))
+	assert.Equal(t, "", requestScope("/v2/_catalog"))
+}
+
+const (
+	testBearerToken  = "ci-bearer-token"
+	testRefreshToken = "ci-refresh-token"
+)
+
+// newTokenTestServer is a registry that requires a token for the repository of each manifest and
+// blob request, or testBearerToken.  Its auth server exchanges testRefreshToken for tokens.  It
+// returns the number of 401 responses and of token requests.
+func newTokenTestServer(t *testing.T) (*httptest.Server, *int32, *int32) {
+	var unauthorized, tokens int32
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/token" && req.Method == "POST" {
+			// The refresh token grant
+			atomic.AddInt32(&tokens, 1)
+			if req.FormValue("grant_type") != "refresh_token" || req.FormValue("refresh_token") != testRefreshToken {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"access_token": "token-for " + req.FormValue("scope"),
+				"expires_in":   300,
+			})
+			return
+		}
+		if req.URL.Path == "/token" {
+			atomic.AddInt32(&tokens, 1)
+			scopes := req.URL.Query()["scope"]
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"token":      "token-for " + strings.Join(scopes, " "),
+				"expires_in": 300,
+			})
+			return
+		}
+
+		scope := requestScope(req.URL.Path)
+		auth := req.Header.Get("Authorization")
+		if auth != "Bearer token-for "+scope && auth != "Bearer "+testBearerToken {
+			atomic.AddInt32(&unauthorized, 1)
+			w.Header().Set("Www-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="test",scope="%s"`, server.URL, scope))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	t.Cleanup(server.Close)
+
+	return server, &unauthorized, &tokens
+}
+
+func TestDoReusesTokens(t *testing.T) {
+	server, unauthorized, tokens := newTokenTestServer(t)
+
+	dockerRemote, err := ParseDockerURI("docker://" + strings.TrimPrefix(server.URL, "http://") + "/ns/a")
+	require.NoError(t, err)
+	dockerRemote.Username = "user"
+
+	get := func(path string) error {
+		req, err := dockerRemote.NewHttpRequest(context.Background(), "GET", server.URL+path, nil)
+		require.NoError(t, err)
+		resp, err := dockerRemote.DoWithRetry(req, 3)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return errors.New(resp.Status)
+		}
+		return nil
+	}
+
+	require.NoError(t, get("/v2/ns/a/manifests/latest"))
+	require.NoError(t, get("/v2/ns/a/blobs/sha256:abc"))
+	assert.Equal(t, int32(1), atomic.LoadInt32(unauthorized))
+	assert.Equal(t, int32(1), atomic.LoadInt32(tokens))
+
+	// A new repository gets its token before the request is sent
+	require.NoError(t, get("/v2/ns/b/manifests/latest"))
+	assert.Equal(t, int32(1), atomic.LoadInt32(unauthorized))
+	assert.Equal(t, int32(2), atomic.LoadInt32(tokens))
+
+	// Concurrent requests share the token
+	var wg sync.WaitGroup
+	for j := 0; j < 20; j++ {
+		wg.Add(1)
+		go func(j int) {
+			defer wg.Done()
+			assert.NoError(t, get(fmt.Sprintf("/v2/ns/c/blobs/sha256:%d", j)))
+		}(j)
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), atomic.LoadInt32(unauthorized))
+	assert.Equal(t, int32(3), atomic.LoadInt32(tokens))
+
+	// Remotes that share the store share the tokens of the same credentials
+	other, err := ParseDockerURI("docker://" + strings.TrimPrefix(server.URL, "http://") + "/ns/b")
+	require.NoError(t, err)
+	other.Username = "user"
+	other.Tokens = dockerRemote.Tokens
+	dockerRemote = other
+	require.NoError(t, get("/v2/ns/b/blobs/sha256:abc"))
+	assert.Equal(t, int32(1), atomic.LoadInt32(unauthorized))
+	assert.Equal(t, int32(3), atomic.LoadInt32(tokens))
+}
+
+func TestDoWithToken(t *testing.T) {
+	tests := []struct {
+		name         string
+		token        string
+		unauthorized int32
+		tokens       int32
+	}{
+		{name: "bearer token", token: testBearerToken, unauthorized: 0, tokens: 0},
+		{name: "refresh token", token: testRefreshToken, unauthorized: 1, tokens: 2},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server, unauthorized, tokens := newTokenTestServer(t)
+
+			dockerRemote, err := ParseDockerURI("docker://" + strings.TrimPrefix(server.URL, "http://") + "/ns/a")
+			require.NoError(t, err)
+			dockerRemote.Token = test.token
+
+			for _, path := range []string{"/v2/ns/a/manifests/latest", "/v2/ns/a/blobs/sha256:abc", "/v2/ns/b/manifests/latest"} {
+				req, err := dockerRemote.NewHttpRequest(context.Background(), "GET", server.URL+path, nil)
+				require.NoError(t, err)
+				resp, err := dockerRemote.DoWithRetry(req, 3)
+				require.NoError(t, err)
+				resp.Body.Close()
+				assert.Equal(t, http.StatusOK, resp.StatusCode, path)
+			}
+
+			assert.Equal(t, test.unauthorized, atomic.LoadInt32(unauthorized))
+			assert.Equal(t, test.tokens, atomic.LoadInt32(tokens))
+		})
+	}
+}
+
+func TestDoWithInvalidToken(t *testing.T) {
+	server, _, _ := newTokenTestServer(t)
+
+	dockerRemote, err := ParseDockerURI("docker://" + strings.TrimPrefix(server.URL, "http://") + "/ns/a")
+	require.NoError(t, err)
+	dockerRemote.Token = "expired"
+
+	req, err := dockerRemote.NewHttpRequest(context.Background(), "GET", server.URL+"/v2/ns/a/manifests/latest", nil)
+	require.NoError(t, err)
+	_, err = dockerRemote.DoWithRetry(req, 3)
+	require.ErrorIs(t, err, ErrUnauthorized)
+}
+
+func TestDoSeparatesTokensByCredentials(t *testing.T) {
+	var mu sync.Mutex
+	var lastAuth string
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/token" {
+			username, password, _ := req.BasicAuth()
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"token":      fmt.Sprintf("token-for-%s-%s", username, password),
+				"expires_in": 300,
+			})
+			return
+		}
+
+		auth := req.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "Bearer token-for-") {
+			w.Header().Set("Www-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="test"`, server.URL))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		mu.Lock()
+		lastAuth = auth
+		mu.Unlock()
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	store := NewTokenStore()
+	get := func(username, password string) string {
+		dockerRemote, err := ParseDockerURI("docker://" + strings.TrimPrefix(server.URL, "http://") + "/ns/a")
+		require.NoError(t, err)
+		dockerRemote.Username = username
+		dockerRemote.Password = password
+		dockerRemote.RefreshTokenFile = ""
+		dockerRemote.Tokens = store
+
+		req, err := dockerRemote.NewHttpRequest(context.Background(), "GET", server.URL+"/v2/ns/a/manifests/latest", nil)
+		require.NoError(t, err)
+		resp, err := dockerRemote.DoWithRetry(req, 3)
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+
+		mu.Lock()
+		defer mu.Unlock()
+		return lastAuth
+	}
+
+	// Remotes that share the store only get the tokens of their own credentials
+	assert.Equal(t, "Bearer token-for-alice-pw1", get("alice", "pw1"))
+	assert.Equal(t, "Bearer token-for-bob-pw2", get("bob", "pw2"))
+	assert.Equal(t, "Bearer token-for-alice-pw3", get("alice", "pw3"))
+	assert.Equal(t, "Bearer token-for-alice-pw1", get("alice", "pw1"))
+}
+
+// TestDoConcurrentFirstRequests sends the first requests of a remote from many goroutines, like a
+// proxy serving many clients, so that resolving the scheme, the credentials and the auth of the
+// registry races with the requests that use them.  Run it with -race.
+func TestDoConcurrentFirstRequests(t *testing.T) {
+	basicServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if username, password, ok := req.BasicAuth(); !ok || username != "user" || password != "pass" {
+			w.Header().Set("Www-Authenticate", `Basic realm="test"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	t.Cleanup(basicServer.Close)
+	bearerServer, _, _ := newTokenTestServer(t)
+
+	tests := []struct {
+		name   string
+		server *httptest.Server
+		token  string
+	}{
+		{name: "basic", server: basicServer},
+		{name: "bearer", server: bearerServer},
+		{name: "refused token", server: bearerServer, token: testRefreshToken},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			host := strings.TrimPrefix(test.server.URL, "http://")
+			t.Setenv("DOCKER_CONFIG", t.TempDir())
+			t.Setenv("DOCKER_AUTH_CONFIG", fmt.Sprintf(`{"auths": {%q: {"auth": %q}}}`, host, basicAuth("user", "pass")))
+
+			// The registry is insecure, so the first requests also find out that it is plain http
+			dockerRemote := newInsecureTestRemote(t, test.server)
+			dockerRemote.Token = test.token
+
+			var wg sync.WaitGroup
+			for j := 0; j < 20; j++ {
+				wg.Add(1)
+				go func(j int) {
+					defer wg.Done()
+					req, err := dockerRemote.NewHttpRequest(context.Background(), "GET", fmt.Sprintf("%s/v2/ns/img/blobs/sha256:%d", dockerRemote.BaseURL(), j), nil)
+					if !assert.NoError(t, err) {
+						return
+					}
+					resp, err := dockerRemote.DoWithRetry(req, 3)
+					if !assert.NoError(t, err) {
+						return
+					}
+					resp.Body.Close()
+					assert.Equal(t, http.StatusOK, resp.StatusCode)
+				}(j)
+			}
+			wg.Wait()
+		})
+	}
+}
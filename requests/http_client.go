@@ -1,6 +1,8 @@
 package requests
 
 import (
+	"context"
+	"crypto/tls"
 	"io"
 	"net/http"
 	"net/url"
@@ -32,13 +34,25 @@ func GetHttpClient(proxyParam string) (*HttpClient, error) {
 		globalTransport = t
 	}
 
+	return newHttpClient(globalTransport), nil
+}
+
+// GetHttpClientWithTLS returns a client that connects with tlsConfig.  It does not share the
+// global transport, but uses the proxy the same way.
+func GetHttpClientWithTLS(proxyParam string, tlsConfig *tls.Config) (*HttpClient, error) {
+	t := NewTlsConfigTransport(tlsConfig)
+	setProxy(t, proxyParam)
+	return newHttpClient(t), nil
+}
+
+func newHttpClient(t Transport) *HttpClient {
 	c := &HttpClient{
 		Header: make(http.Header),
 	}
 	c.Header.Set("User-Agent", "Harpoon-Client/0_1")
 
-	c.Transport = globalTransport
-	return c, nil
+	c.Transport = t
+	return c
 }
 
 func newTransport(pemFilename, proxyAddress string) (*TcpTransport, error) {
@@ -53,19 +67,25 @@ func newTransport(pemFilename, proxyAddress string) (*TcpTransport, error) {
 		}
 	}
 
-	if proxyAddress != "" {
-		t.Client.Transport.(*http.Transport).Proxy = func(req *http.Request) (*url.URL, error) {
-			// Honor NO_PROXY environment variable
-			if !UseProxy(canonicalAddr(req.URL)) {
-				return nil, nil
-			}
-			return url.Parse(proxyAddress)
-		}
-	}
+	setProxy(t, proxyAddress)
 
 	return t, nil
 }
 
+func setProxy(t *TcpTransport, proxyAddress string) {
+	if proxyAddress == "" {
+		return
+	}
+
+	t.Client.Transport.(*http.Transport).Proxy = func(req *http.Request) (*url.URL, error) {
+		// Honor NO_PROXY environment variable
+		if !UseProxy(canonicalAddr(req.URL)) {
+			return nil, nil
+		}
+		return url.Parse(proxyAddress)
+	}
+}
+
 func (c *HttpClient) Get(url string) (*http.Response, error) {
 	req, err := c.NewRequest("GET", url, nil)
 	if err != nil {
@@ -96,7 +116,12 @@ func (c *HttpClient) PostForm(url string, data url.Values) (*http.Response, erro
 }
 
 func (c *HttpClient) NewRequest(method, urlStr string, body io.Reader) (*http.Request, error) {
-	req, err := http.NewRequest(method, urlStr, body)
+	return c.NewRequestWithContext(context.Background(), method, urlStr, body)
+}
+
+// NewRequestWithContext creates a request with the client headers that is cancelled with ctx
+func (c *HttpClient) NewRequestWithContext(ctx context.Context, method, urlStr string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, urlStr, body)
 	if err != nil {
 		return nil, err
 	}
@@ -112,6 +137,15 @@ func (c *HttpClient) Do(req *http.Request) (*http.Response, error) {
 	return c.GetTransport().doRequest(req)
 }
 
+// RoundTripper returns the http.RoundTripper of the client, for other http.Clients that must
+// connect the same way, like the ones that fetch tokens
+func (c *HttpClient) RoundTripper() http.RoundTripper {
+	if t, ok := c.GetTransport().(*TcpTransport); ok && t.Client.Transport != nil {
+		return t.Client.Transport
+	}
+	return http.DefaultTransport
+}
+
 func (c *HttpClient) GetTransport() Transport {
 	if c.Transport != nil {
 		return c.Transport
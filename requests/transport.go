@@ -52,6 +52,18 @@ func NewTlsTransport(pemFilename string) (*TcpTransport, error) {
 	}, nil
 }
 
+// NewTlsConfigTransport creates a transport like http.DefaultTransport that connects with tlsConfig
+func NewTlsConfigTransport(tlsConfig *tls.Config) *TcpTransport {
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tr.TLSClientConfig = tlsConfig
+
+	return &TcpTransport{
+		Client: &http.Client{
+			Transport: tr,
+		},
+	}
+}
+
 func replicatedCertPool(pemFilename string) (*x509.CertPool, error) {
 	file, err := ioutil.ReadFile(pemFilename)
 	if err != nil {